@@ -0,0 +1,871 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /api/v1 の一覧の既定件数と上限
+const apiDefaultLimit int = 50
+const apiMaxLimit int = 500
+
+// 近傍検索の既定と上限の半径 (メートル)
+const nearbyDefaultRadius int = 1000
+const nearbyMaxRadius int = 10000
+
+// これより古いリアルタイム情報は反映しない
+const realtimeMaxAge time.Duration = 30 * time.Minute
+
+// OpenAPI 定義
+const openAPIPath string = "static/openapi.json"
+
+// apiError は /api/v1 のエラー応答
+//
+//	{"error": {"code": "not_found", "message": "..."}}
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiPagination struct {
+	Limit  int   `json:"limit"`
+	Offset int   `json:"offset"`
+	Total  int64 `json:"total"`
+	// 次のページの offset。最後のページでは省略する
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// apiList は一覧の応答
+type apiList struct {
+	Data       interface{}   `json:"data"`
+	Pagination apiPagination `json:"pagination"`
+}
+
+// apiItem は1件の応答
+type apiItem struct {
+	Data interface{} `json:"data"`
+}
+
+type apiStop struct {
+	ID                 string  `json:"id"`
+	Code               string  `json:"code,omitempty"`
+	Name               string  `json:"name"`
+	Kana               string  `json:"kana,omitempty"`   // 検索結果のみ
+	Romaji             string  `json:"romaji,omitempty"` // 検索結果のみ
+	Desc               string  `json:"desc,omitempty"`
+	Lat                float64 `json:"lat"`
+	Lon                float64 `json:"lon"`
+	LocationType       int     `json:"location_type"`
+	ParentStation      string  `json:"parent_station,omitempty"`
+	WheelchairBoarding int     `json:"wheelchair_boarding"`
+}
+
+type apiStopDetail struct {
+	apiStop
+	Routes []apiRoute `json:"routes"`
+}
+
+type apiRoute struct {
+	ID         string `json:"id"`
+	AgencyID   string `json:"agency_id,omitempty"`
+	AgencyName string `json:"agency_name,omitempty"`
+	ShortName  string `json:"short_name,omitempty"`
+	LongName   string `json:"long_name,omitempty"`
+	Type       int    `json:"type"`
+	Color      string `json:"color,omitempty"`
+	TextColor  string `json:"text_color,omitempty"`
+	URL        string `json:"url,omitempty"`
+}
+
+type apiRouteDirection struct {
+	DirectionID int    `json:"direction_id"`
+	Headsign    string `json:"headsign,omitempty"`
+	// 停留所数が最も多い便の停車順
+	Stops []apiStop `json:"stops"`
+}
+
+type apiRouteDetail struct {
+	apiRoute
+	Directions []apiRouteDirection `json:"directions"`
+}
+
+type apiDeparture struct {
+	TripID             string     `json:"trip_id"`
+	StopID             string     `json:"stop_id"`
+	StopSequence       int        `json:"stop_sequence"`
+	Headsign           string     `json:"headsign,omitempty"`
+	Route              apiRoute   `json:"route"`
+	ScheduledDeparture string     `json:"scheduled_departure"`
+	ScheduledAt        time.Time  `json:"scheduled_at"`
+	Realtime           bool       `json:"realtime"`
+	Delay              *int       `json:"delay,omitempty"` // 秒
+	ExpectedAt         *time.Time `json:"expected_at,omitempty"`
+}
+
+type apiStopTime struct {
+	StopSequence  int    `json:"stop_sequence"`
+	StopID        string `json:"stop_id"`
+	StopName      string `json:"stop_name"`
+	ArrivalTime   string `json:"arrival_time"`
+	DepartureTime string `json:"departure_time"`
+	Delay         *int   `json:"delay,omitempty"` // 秒
+}
+
+type apiTrip struct {
+	ID          string        `json:"id"`
+	Route       apiRoute      `json:"route"`
+	ServiceID   string        `json:"service_id"`
+	Headsign    string        `json:"headsign,omitempty"`
+	DirectionID int           `json:"direction_id"`
+	ShapeID     string        `json:"shape_id,omitempty"`
+	StopTimes   []apiStopTime `json:"stop_times"`
+	Vehicle     *apiVehicle   `json:"vehicle,omitempty"`
+}
+
+type apiVehicle struct {
+	ID                  string    `json:"id"`
+	Label               string    `json:"label,omitempty"`
+	TripID              string    `json:"trip_id,omitempty"`
+	RouteID             string    `json:"route_id,omitempty"`
+	Lat                 float64   `json:"lat"`
+	Lon                 float64   `json:"lon"`
+	Speed               float64   `json:"speed"`
+	StopID              string    `json:"stop_id,omitempty"`
+	CurrentStopSequence int       `json:"current_stop_sequence"`
+	Timestamp           time.Time `json:"timestamp"`
+}
+
+// errAPINotFound は対象のデータが存在しないことを表す
+var errAPINotFound = errors.New("not found")
+
+func writeAPIJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	// 読み取り専用の公開データのため、他のオリジンからの利用を許可する
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string, message string) {
+	writeAPIJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: message}})
+}
+
+// writeAPIFailure はデータ取得時のエラーを応答に変換する。内部のエラー内容は応答に含めない
+func writeAPIFailure(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAPINotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "指定されたデータは存在しません")
+		return
+	}
+	log.Printf("/api/v1: %v", err)
+	writeAPIError(w, http.StatusInternalServerError, "internal_error", "データの取得に失敗しました")
+}
+
+// parsePagination は limit と offset を読み込む
+func parsePagination(r *http.Request) (limit int, offset int, err error) {
+	limit, offset = apiDefaultLimit, 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, fmt.Errorf("limit は 1 から %d の整数で指定してください", apiMaxLimit)
+		}
+	}
+	if s := r.URL.Query().Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset は 0 以上の整数で指定してください")
+		}
+	}
+	return limit, offset, nil
+}
+
+func newPagination(limit int, offset int, total int64) apiPagination {
+	p := apiPagination{Limit: limit, Offset: offset, Total: total}
+	if next := offset + limit; int64(next) < total {
+		p.NextOffset = &next
+	}
+	return p
+}
+
+// apiHandler は静的DBを読み取り専用で開いてハンドラに渡す
+func apiHandler(handler func(w http.ResponseWriter, r *http.Request, db *sql.DB)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db, err := openReadOnlyDb(staticDbFile)
+		if err != nil {
+			writeAPIFailure(w, err)
+			return
+		}
+		defer db.Close()
+		handler(w, r, db)
+	}
+}
+
+// apiNotFoundHandler は /api/v1 以下の未定義のパスに JSON で応答する
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", "指定されたAPIは存在しません")
+}
+
+// openAPIHandler は OpenAPI 定義を返す
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, openAPIPath)
+}
+
+const apiStopColumns = `
+	s.stop_id, COALESCE(s.stop_code, ''), COALESCE(s.stop_name, ''), COALESCE(s.stop_desc, ''),
+	CAST(COALESCE(s.stop_lat, 0) AS REAL), CAST(COALESCE(s.stop_lon, 0) AS REAL), CAST(COALESCE(s.location_type, 0) AS INTEGER),
+	COALESCE(s.parent_station, ''), CAST(COALESCE(s.wheelchair_boarding, 0) AS INTEGER)`
+
+func scanStop(rows interface{ Scan(...interface{}) error }) (apiStop, error) {
+	var s apiStop
+	err := rows.Scan(&s.ID, &s.Code, &s.Name, &s.Desc, &s.Lat, &s.Lon, &s.LocationType, &s.ParentStation, &s.WheelchairBoarding)
+	return s, err
+}
+
+const apiRouteColumns = `
+	r.route_id, COALESCE(r.agency_id, ''), COALESCE(a.agency_name, ''), COALESCE(r.route_short_name, ''),
+	COALESCE(r.route_long_name, ''), CAST(COALESCE(r.route_type, 3) AS INTEGER), COALESCE(r.route_color, ''),
+	COALESCE(r.route_text_color, ''), COALESCE(r.route_url, '')`
+
+func scanRoute(rows interface{ Scan(...interface{}) error }) (apiRoute, error) {
+	var r apiRoute
+	err := rows.Scan(&r.ID, &r.AgencyID, &r.AgencyName, &r.ShortName, &r.LongName, &r.Type, &r.Color, &r.TextColor, &r.URL)
+	applyRouteColor(&r)
+	return r, err
+}
+
+// queryStops は停留所の一覧を取得する
+func queryStops(db *sql.DB, query string, args ...interface{}) ([]apiStop, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("stopsの取得に失敗: %w", err)
+	}
+	defer rows.Close()
+
+	stops := make([]apiStop, 0)
+	for rows.Next() {
+		s, err := scanStop(rows)
+		if err != nil {
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		stops = append(stops, s)
+	}
+	return stops, rows.Err()
+}
+
+// queryRoutes は路線の一覧を取得する
+func queryRoutes(db *sql.DB, query string, args ...interface{}) ([]apiRoute, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("routesの取得に失敗: %w", err)
+	}
+	defer rows.Close()
+
+	routes := make([]apiRoute, 0)
+	for rows.Next() {
+		r, err := scanRoute(rows)
+		if err != nil {
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		routes = append(routes, r)
+	}
+	return routes, rows.Err()
+}
+
+// GET /api/v1/stops?q=
+// 停留所名・読み仮名・ローマ字で検索し、一致度の高い順に返す。q を省略すると全件を停留所名順に返す
+func apiStopsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		index, err := currentStopIndex()
+		if err != nil {
+			writeAPIFailure(w, err)
+			return
+		}
+		stops := index.Search(q)
+		writeAPIJSON(w, http.StatusOK, apiList{Data: pageOf(stops, limit, offset), Pagination: newPagination(limit, offset, int64(len(stops)))})
+		return
+	}
+
+	// CSVのヘッダ行が取り込まれているため除外する
+	var total int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM stops WHERE stop_id <> 'stop_id'`).Scan(&total); err != nil {
+		writeAPIFailure(w, fmt.Errorf("stopsの件数の取得に失敗: %w", err))
+		return
+	}
+	stops, err := queryStops(db, `SELECT `+apiStopColumns+` FROM stops AS s WHERE s.stop_id <> 'stop_id' ORDER BY s.stop_name, s.stop_id LIMIT ? OFFSET ?`,
+		limit, offset)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiList{Data: stops, Pagination: newPagination(limit, offset, total)})
+}
+
+// GET /api/v1/stops/nearby?lat=&lon=&radius=
+// 指定地点から radius メートル (既定 1000、最大 10000) 以内の停留所を近い順に返す
+func apiNearbyStopsHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+	lon, errLon := strconv.ParseFloat(query.Get("lon"), 64)
+	if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", "lat と lon に緯度・経度を指定してください")
+		return
+	}
+	radius := float64(nearbyDefaultRadius)
+	if s := query.Get("radius"); s != "" {
+		radius, err = strconv.ParseFloat(s, 64)
+		if err != nil || radius <= 0 || radius > float64(nearbyMaxRadius) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("radius は %d 以下の正の数 (メートル) で指定してください", nearbyMaxRadius))
+			return
+		}
+	}
+
+	index, err := currentStopIndex()
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	stops := index.Nearby(lat, lon, radius)
+	writeAPIJSON(w, http.StatusOK, apiList{Data: pageOf(stops, limit, offset), Pagination: newPagination(limit, offset, int64(len(stops)))})
+}
+
+// pageOf は一覧から1ページ分を切り出す
+func pageOf[T any](items []T, limit int, offset int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	return items[offset:min(offset+limit, len(items))]
+}
+
+// GET /api/v1/stops/{stop_id}
+func apiStopHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	stopID := r.PathValue("stop_id")
+
+	stops, err := queryStops(db, `SELECT `+apiStopColumns+` FROM stops AS s WHERE s.stop_id = ?`, stopID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	if len(stops) == 0 {
+		writeAPIFailure(w, errAPINotFound)
+		return
+	}
+
+	// 駅 (親停留所) の場合は子の停留所を通る路線も含める
+	routes, err := queryRoutes(db, `
+		SELECT DISTINCT `+apiRouteColumns+`
+		FROM routes AS r
+		LEFT JOIN agency AS a ON a.agency_id = r.agency_id
+		WHERE r.route_id IN (
+			SELECT t.route_id
+			FROM stop_times AS st
+			JOIN trips AS t ON t.trip_id = st.trip_id
+			WHERE st.stop_id IN (SELECT stop_id FROM stops WHERE stop_id = ? OR parent_station = ?)
+		)
+		ORDER BY r.route_id`, stopID, stopID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiItem{Data: apiStopDetail{apiStop: stops[0], Routes: routes}})
+}
+
+// activeServicesSQL は指定日に運行する便を絞り込む条件 (引数は日付を4回)
+func activeServicesSQL(date time.Time) string {
+	weekday := strings.ToLower(date.Weekday().String())
+	return `(
+		SELECT service_id FROM calendar
+		WHERE start_date <= ? AND end_date >= ? AND CAST(` + weekday + ` AS INTEGER) = 1
+		UNION
+		SELECT service_id FROM calendar_dates WHERE date = ? AND CAST(exception_type AS INTEGER) = 1
+	)
+	AND t.service_id NOT IN (
+		SELECT service_id FROM calendar_dates WHERE date = ? AND CAST(exception_type AS INTEGER) = 2
+	)`
+}
+
+// parseServiceDate は date (YYYYMMDD) と、timeParam で指定した名前の時刻 (HH:MM) を読み込む。
+// 省略時は今日の現在時刻以降とする
+func parseServiceDate(r *http.Request, now time.Time, timeParam string) (date time.Time, from string, err error) {
+	date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	from = now.Format("15:04:05")
+	if s := r.URL.Query().Get("date"); s != "" {
+		date, err = time.ParseInLocation("20060102", s, now.Location())
+		if err != nil {
+			return time.Time{}, "", errors.New("date は YYYYMMDD 形式で指定してください")
+		}
+		if !sameDay(date, now) {
+			from = "00:00:00"
+		}
+	}
+	if s := r.URL.Query().Get(timeParam); s != "" {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("%s は HH:MM 形式で指定してください", timeParam)
+		}
+		from = t.Format("15:04:05")
+	}
+	return date, from, nil
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// gtfsTimeOn は GTFS の時刻 (24時以降を含む HH:MM:SS) を運行日の日時に変換する
+func gtfsTimeOn(date time.Time, value string) (time.Time, bool) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	s, err3 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return time.Time{}, false
+	}
+	return date.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second), true
+}
+
+// GET /api/v1/stops/{stop_id}/departures?date=YYYYMMDD&from=HH:MM
+// 時刻表上の発車予定に、当日分はリアルタイムの遅延を加えて返す
+func apiDeparturesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	now := time.Now()
+	date, from, err := parseServiceDate(r, now, "from")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	stopID := r.PathValue("stop_id")
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM stops WHERE stop_id = ?`, stopID).Scan(&exists); err != nil {
+		writeAPIFailure(w, fmt.Errorf("stopsの取得に失敗: %w", err))
+		return
+	}
+	if exists == 0 {
+		writeAPIFailure(w, errAPINotFound)
+		return
+	}
+
+	day := date.Format("20060102")
+	where := `
+		st.stop_id IN (SELECT stop_id FROM stops WHERE stop_id = ? OR parent_station = ?)
+		AND st.departure_time GLOB '[0-9]*' AND st.departure_time >= ?
+		AND CAST(COALESCE(st.pickup_type, 0) AS INTEGER) <> 1
+		AND t.service_id IN ` + activeServicesSQL(date)
+	args := []interface{}{stopID, stopID, from, day, day, day, day}
+
+	var total int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM stop_times AS st JOIN trips AS t ON t.trip_id = st.trip_id WHERE `+where, args...).Scan(&total); err != nil {
+		writeAPIFailure(w, fmt.Errorf("stop_timesの件数の取得に失敗: %w", err))
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT st.trip_id, st.stop_id, CAST(st.stop_sequence AS INTEGER), st.departure_time,
+			COALESCE(NULLIF(st.stop_headsign, ''), t.trip_headsign, ''), `+apiRouteColumns+`
+		FROM stop_times AS st
+		JOIN trips AS t ON t.trip_id = st.trip_id
+		JOIN routes AS r ON r.route_id = t.route_id
+		LEFT JOIN agency AS a ON a.agency_id = r.agency_id
+		WHERE `+where+`
+		ORDER BY st.departure_time, st.trip_id
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		writeAPIFailure(w, fmt.Errorf("stop_timesの取得に失敗: %w", err))
+		return
+	}
+	defer rows.Close()
+
+	departures := make([]apiDeparture, 0)
+	tripIDs := make([]string, 0)
+	for rows.Next() {
+		var d apiDeparture
+		route := &d.Route
+		err := rows.Scan(&d.TripID, &d.StopID, &d.StopSequence, &d.ScheduledDeparture, &d.Headsign,
+			&route.ID, &route.AgencyID, &route.AgencyName, &route.ShortName, &route.LongName, &route.Type, &route.Color, &route.TextColor, &route.URL)
+		if err != nil {
+			writeAPIFailure(w, fmt.Errorf("スキャンに失敗しました: %w", err))
+			return
+		}
+		applyRouteColor(route)
+		d.ScheduledAt, _ = gtfsTimeOn(date, d.ScheduledDeparture)
+		departures = append(departures, d)
+		tripIDs = append(tripIDs, d.TripID)
+	}
+	if err := rows.Err(); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+
+	// リアルタイム情報は当日の便のみに適用する
+	if sameDay(date, now) {
+		delays := loadRealtimeDelays(tripIDs, now)
+		for i := range departures {
+			d := &departures[i]
+			if delay, ok := delays[d.TripID].delayAt(d.StopSequence); ok {
+				expected := d.ScheduledAt.Add(time.Duration(delay) * time.Second)
+				d.Realtime, d.Delay, d.ExpectedAt = true, &delay, &expected
+			}
+		}
+	}
+
+	writeAPIJSON(w, http.StatusOK, apiList{Data: departures, Pagination: newPagination(limit, offset, total)})
+}
+
+// GET /api/v1/routes?agency_id=
+func apiRoutesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	where := `r.route_id <> 'route_id'`
+	args := []interface{}{}
+	if agencyID := r.URL.Query().Get("agency_id"); agencyID != "" {
+		where += ` AND r.agency_id = ?`
+		args = append(args, agencyID)
+	}
+
+	var total int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM routes AS r WHERE `+where, args...).Scan(&total); err != nil {
+		writeAPIFailure(w, fmt.Errorf("routesの件数の取得に失敗: %w", err))
+		return
+	}
+	routes, err := queryRoutes(db, `
+		SELECT `+apiRouteColumns+`
+		FROM routes AS r
+		LEFT JOIN agency AS a ON a.agency_id = r.agency_id
+		WHERE `+where+`
+		ORDER BY r.route_id
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiList{Data: routes, Pagination: newPagination(limit, offset, total)})
+}
+
+// GET /api/v1/routes/{route_id}
+// 方向ごとに、停留所数が最も多い便の停車順を返す
+func apiRouteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	routeID := r.PathValue("route_id")
+
+	routes, err := queryRoutes(db, `
+		SELECT `+apiRouteColumns+`
+		FROM routes AS r
+		LEFT JOIN agency AS a ON a.agency_id = r.agency_id
+		WHERE r.route_id = ?`, routeID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	if len(routes) == 0 {
+		writeAPIFailure(w, errAPINotFound)
+		return
+	}
+
+	rows, err := QueryRows(db, `
+		SELECT t.trip_id, CAST(COALESCE(t.direction_id, 0) AS INTEGER) AS direction_id,
+			COALESCE(t.trip_headsign, '') AS trip_headsign, COUNT(*) AS stop_count
+		FROM trips AS t
+		JOIN stop_times AS st ON st.trip_id = t.trip_id
+		WHERE t.route_id = ?
+		GROUP BY t.trip_id
+		ORDER BY direction_id, stop_count DESC, t.trip_id`, routeID)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+
+	detail := apiRouteDetail{apiRoute: routes[0], Directions: make([]apiRouteDirection, 0)}
+	seen := make(map[int64]bool)
+	for _, row := range rows {
+		direction := row["direction_id"].(int64)
+		if seen[direction] {
+			continue
+		}
+		seen[direction] = true
+
+		stops, err := queryStops(db, `
+			SELECT `+apiStopColumns+`
+			FROM stop_times AS st
+			JOIN stops AS s ON s.stop_id = st.stop_id
+			WHERE st.trip_id = ?
+			ORDER BY CAST(st.stop_sequence AS INTEGER)`, row["trip_id"])
+		if err != nil {
+			writeAPIFailure(w, err)
+			return
+		}
+		detail.Directions = append(detail.Directions, apiRouteDirection{
+			DirectionID: int(direction),
+			Headsign:    row["trip_headsign"].(string),
+			Stops:       stops,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, apiItem{Data: detail})
+}
+
+// GET /api/v1/trips/{trip_id}
+func apiTripHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID := r.PathValue("trip_id")
+
+	var trip apiTrip
+	route := &trip.Route
+	err := db.QueryRow(`
+		SELECT t.trip_id, COALESCE(t.service_id, ''), COALESCE(t.trip_headsign, ''),
+			CAST(COALESCE(t.direction_id, 0) AS INTEGER), COALESCE(t.shape_id, ''), `+apiRouteColumns+`
+		FROM trips AS t
+		JOIN routes AS r ON r.route_id = t.route_id
+		LEFT JOIN agency AS a ON a.agency_id = r.agency_id
+		WHERE t.trip_id = ?`, tripID).Scan(&trip.ID, &trip.ServiceID, &trip.Headsign, &trip.DirectionID, &trip.ShapeID,
+		&route.ID, &route.AgencyID, &route.AgencyName, &route.ShortName, &route.LongName, &route.Type, &route.Color, &route.TextColor, &route.URL)
+	if err == sql.ErrNoRows {
+		writeAPIFailure(w, errAPINotFound)
+		return
+	}
+	if err != nil {
+		writeAPIFailure(w, fmt.Errorf("tripsの取得に失敗: %w", err))
+		return
+	}
+	applyRouteColor(route)
+
+	rows, err := db.Query(`
+		SELECT CAST(st.stop_sequence AS INTEGER), st.stop_id, COALESCE(s.stop_name, ''),
+			COALESCE(st.arrival_time, ''), COALESCE(st.departure_time, '')
+		FROM stop_times AS st
+		LEFT JOIN stops AS s ON s.stop_id = st.stop_id
+		WHERE st.trip_id = ?
+		ORDER BY CAST(st.stop_sequence AS INTEGER)`, tripID)
+	if err != nil {
+		writeAPIFailure(w, fmt.Errorf("stop_timesの取得に失敗: %w", err))
+		return
+	}
+	defer rows.Close()
+
+	delays := loadRealtimeDelays([]string{tripID}, time.Now())[tripID]
+	trip.StopTimes = make([]apiStopTime, 0)
+	for rows.Next() {
+		var st apiStopTime
+		if err := rows.Scan(&st.StopSequence, &st.StopID, &st.StopName, &st.ArrivalTime, &st.DepartureTime); err != nil {
+			writeAPIFailure(w, fmt.Errorf("スキャンに失敗しました: %w", err))
+			return
+		}
+		if delay, ok := delays.delayAt(st.StopSequence); ok {
+			st.Delay = &delay
+		}
+		trip.StopTimes = append(trip.StopTimes, st)
+	}
+	if err := rows.Err(); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+
+	vehicles, _, err := queryVehicles("vp.trip_id = ?", []interface{}{tripID}, 1, 0)
+	if err != nil {
+		log.Printf("/api/v1: %v", err)
+	}
+	if len(vehicles) > 0 {
+		trip.Vehicle = &vehicles[0]
+	}
+
+	writeAPIJSON(w, http.StatusOK, apiItem{Data: trip})
+}
+
+// GET /api/v1/vehicles?route_id=&trip_id=
+func apiVehiclesHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	where := "1 = 1"
+	args := []interface{}{}
+	if routeID := r.URL.Query().Get("route_id"); routeID != "" {
+		where += " AND tr.route_id = ?"
+		args = append(args, routeID)
+	}
+	if tripID := r.URL.Query().Get("trip_id"); tripID != "" {
+		where += " AND vp.trip_id = ?"
+		args = append(args, tripID)
+	}
+
+	vehicles, total, err := queryVehicles(where, args, limit, offset)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiList{Data: vehicles, Pagination: newPagination(limit, offset, total)})
+}
+
+// openRealtimeDb は動的DBを読み取り専用で開く。まだ作成されていなければ nil を返す
+func openRealtimeDb() (*sql.DB, error) {
+	if _, err := os.Stat(databasePath(dynamicDbFile)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return openReadOnlyDb(dynamicDbFile)
+}
+
+// queryVehicles は動的DBの最新の車両位置を取得する
+func queryVehicles(where string, args []interface{}, limit int, offset int) ([]apiVehicle, int64, error) {
+	vehicles := make([]apiVehicle, 0)
+	db, err := openRealtimeDb()
+	if err != nil || db == nil {
+		return vehicles, 0, err
+	}
+	defer db.Close()
+
+	from := `
+		FROM vehicle_position AS vp
+		LEFT JOIN vehicle AS v ON v.id = vp.vehicle_id
+		LEFT JOIN trip AS tr ON tr.trip_id = vp.trip_id
+		WHERE ` + where
+
+	var total int64
+	if err := db.QueryRow(`SELECT COUNT(*) `+from, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("vehicle_positionの件数の取得に失敗: %w", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT COALESCE(vp.vehicle_id, vp.entity_id), COALESCE(v.label, ''), COALESCE(vp.trip_id, ''), COALESCE(tr.route_id, ''),
+			COALESCE(vp.latitude, 0), COALESCE(vp.longitude, 0), COALESCE(vp.speed, 0), COALESCE(vp.stop_id, ''),
+			COALESCE(vp.current_stop_sequence, 0), COALESCE(vp.position_timestamp, '')
+		`+from+`
+		ORDER BY vp.vehicle_id
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("vehicle_positionの取得に失敗: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v apiVehicle
+		var timestamp string
+		if err := rows.Scan(&v.ID, &v.Label, &v.TripID, &v.RouteID, &v.Lat, &v.Lon, &v.Speed, &v.StopID, &v.CurrentStopSequence, &timestamp); err != nil {
+			return nil, 0, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		if sec, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+			v.Timestamp = time.Unix(sec, 0)
+		}
+		vehicles = append(vehicles, v)
+	}
+	return vehicles, total, rows.Err()
+}
+
+// stopDelay は stop_time_update の1件
+type stopDelay struct {
+	stopSequence int
+	delay        int
+}
+
+// realtimeTrip は1便の最新の stop_time_update (stop_sequence 順)
+type realtimeTrip []stopDelay
+
+// delayAt は停留所での遅延を返す。更新のない停留所には直前の停留所の遅延を引き継ぐ (GTFS-Realtime の規定どおり)
+func (t realtimeTrip) delayAt(stopSequence int) (int, bool) {
+	delay, ok := 0, false
+	for _, u := range t {
+		if u.stopSequence > stopSequence {
+			break
+		}
+		delay, ok = u.delay, true
+	}
+	return delay, ok
+}
+
+// loadRealtimeDelays は便ごとの最新の遅延情報を動的DBから取得する。
+// 動的DBが読めない場合はリアルタイム情報なしとして扱う
+func loadRealtimeDelays(tripIDs []string, now time.Time) map[string]realtimeTrip {
+	if len(tripIDs) == 0 {
+		return make(map[string]realtimeTrip)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(tripIDs)), ",")
+	args := make([]interface{}, len(tripIDs))
+	for i, id := range tripIDs {
+		args[i] = id
+	}
+	return queryRealtimeDelays(now, `tu.trip_id IN (`+placeholders+`)`, args...)
+}
+
+// loadAllRealtimeDelays はすべての便の最新の遅延情報を動的DBから取得する
+func loadAllRealtimeDelays(now time.Time) map[string]realtimeTrip {
+	return queryRealtimeDelays(now, `1 = 1`)
+}
+
+func queryRealtimeDelays(now time.Time, where string, args ...interface{}) map[string]realtimeTrip {
+	delays := make(map[string]realtimeTrip)
+	db, err := openRealtimeDb()
+	if err != nil || db == nil {
+		if err != nil {
+			log.Printf("/api/v1: %v", err)
+		}
+		return delays
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT tu.trip_id, tu.entity_id, e.response_timestamp, stu.stop_sequence,
+			COALESCE(stu.departure_delay, stu.arrival_delay, 0)
+		FROM trip_update AS tu
+		JOIN entity AS e ON e.id = tu.entity_id
+		JOIN stop_time_update AS stu ON stu.trip_update_entity_id = tu.entity_id
+		WHERE `+where+`
+		ORDER BY tu.trip_id, CAST(e.response_timestamp AS INTEGER) DESC, tu.entity_id, stu.stop_sequence`, args...)
+	if err != nil {
+		log.Printf("/api/v1: stop_time_updateの取得に失敗: %v", err)
+		return delays
+	}
+	defer rows.Close()
+
+	// 便ごとに最も新しい entity のみを使う
+	latestEntity := make(map[string]string)
+	for rows.Next() {
+		var tripID, entityID, timestamp string
+		var u stopDelay
+		if err := rows.Scan(&tripID, &entityID, &timestamp, &u.stopSequence, &u.delay); err != nil {
+			log.Printf("/api/v1: スキャンに失敗しました: %v", err)
+			return delays
+		}
+		if sec, err := strconv.ParseInt(timestamp, 10, 64); err == nil && now.Sub(time.Unix(sec, 0)) > realtimeMaxAge {
+			continue
+		}
+		if latest, ok := latestEntity[tripID]; ok && latest != entityID {
+			continue
+		}
+		latestEntity[tripID] = entityID
+		delays[tripID] = append(delays[tripID], u)
+	}
+	return delays
+}
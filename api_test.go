@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// newTestAPIServer は路線3件・停留所2件の静的DBを作り、/api/v1 のハンドラを登録したサーバを返す。
+// CSVのヘッダ行が取り込まれた状態を再現するため、route_id = 'route_id' の行も入れる
+func newTestAPIServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	c := &Config{}
+	applyConfigDefaults(c)
+	prevConfig := appConfig
+	appConfig = &ConfigManager{}
+	appConfig.current.Store(c)
+	prevDir := databaseDir
+	databaseDir = t.TempDir()
+	t.Cleanup(func() {
+		appConfig = prevConfig
+		databaseDir = prevDir
+	})
+
+	db, err := sql.Open("sqlite3", databasePath(staticDbFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := createStaticTables(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`INSERT INTO agency (agency_id, agency_name) VALUES ('a1', 'テストバス')`,
+		`INSERT INTO routes (route_id, agency_id, route_long_name, route_type) VALUES
+			('route_id', 'agency_id', 'route_long_name', 'route_type'),
+			('r1', 'a1', '駅前線', 3), ('r2', 'a1', '病院線', 3), ('r3', 'a1', '市役所線', 3)`,
+		`INSERT INTO stops (stop_id, stop_name, stop_lat, stop_lon) VALUES
+			('A', '駅前', 37.75, 140.46), ('B', '市役所', 37.76, 140.47)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/", apiNotFoundHandler)
+	mux.HandleFunc("GET /api/v1/stops/nearby", apiNearbyStopsHandler)
+	mux.HandleFunc("GET /api/v1/stops/{stop_id}", apiHandler(apiStopHandler))
+	mux.HandleFunc("GET /api/v1/routes", apiHandler(apiRoutesHandler))
+	mux.HandleFunc("GET /api/v1/routes/{route_id}", apiHandler(apiRouteHandler))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// getAPI は /api/v1 にリクエストし、ステータスと JSON の本文を返す
+func getAPI(t *testing.T, server *httptest.Server, path string, body interface{}) int {
+	t.Helper()
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type = %q", path, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+		t.Fatalf("%s: JSONの解析に失敗: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestAPIRoutesPagination(t *testing.T) {
+	server := newTestAPIServer(t)
+
+	tests := []struct {
+		path       string
+		wantIDs    []string
+		wantTotal  int64
+		wantOffset int
+		wantNext   int // 0 は最後のページ
+	}{
+		{"/api/v1/routes", []string{"r1", "r2", "r3"}, 3, 0, 0},
+		{"/api/v1/routes?limit=2", []string{"r1", "r2"}, 3, 0, 2},
+		{"/api/v1/routes?limit=2&offset=2", []string{"r3"}, 3, 2, 0},
+		{"/api/v1/routes?offset=5", []string{}, 3, 5, 0},
+		{"/api/v1/routes?agency_id=other", []string{}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		var body struct {
+			Data       []apiRoute    `json:"data"`
+			Pagination apiPagination `json:"pagination"`
+		}
+		if status := getAPI(t, server, tt.path, &body); status != http.StatusOK {
+			t.Errorf("%s: status = %d", tt.path, status)
+			continue
+		}
+
+		ids := make([]string, 0, len(body.Data))
+		for _, r := range body.Data {
+			ids = append(ids, r.ID)
+		}
+		if !slices.Equal(ids, tt.wantIDs) {
+			t.Errorf("%s: data = %v, want %v", tt.path, ids, tt.wantIDs)
+		}
+
+		p := body.Pagination
+		next := 0
+		if p.NextOffset != nil {
+			next = *p.NextOffset
+		}
+		if p.Total != tt.wantTotal || p.Offset != tt.wantOffset || next != tt.wantNext {
+			t.Errorf("%s: pagination = total %d offset %d next %d, want %d %d %d",
+				tt.path, p.Total, p.Offset, next, tt.wantTotal, tt.wantOffset, tt.wantNext)
+		}
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	server := newTestAPIServer(t)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"存在しない停留所", "/api/v1/stops/Z", http.StatusNotFound, "not_found"},
+		{"存在しない路線", "/api/v1/routes/r9", http.StatusNotFound, "not_found"},
+		{"未定義のAPI", "/api/v1/unknown", http.StatusNotFound, "not_found"},
+		{"limit が0", "/api/v1/routes?limit=0", http.StatusBadRequest, "invalid_parameter"},
+		{"limit が上限超過", "/api/v1/routes?limit=501", http.StatusBadRequest, "invalid_parameter"},
+		{"offset が負", "/api/v1/routes?offset=-1", http.StatusBadRequest, "invalid_parameter"},
+		{"緯度がない", "/api/v1/stops/nearby?lon=140.46", http.StatusBadRequest, "invalid_parameter"},
+		{"半径が上限超過", "/api/v1/stops/nearby?lat=37.75&lon=140.46&radius=20000", http.StatusBadRequest, "invalid_parameter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body struct {
+				Error *apiError `json:"error"`
+			}
+			status := getAPI(t, server, tt.path, &body)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if body.Error == nil || body.Error.Code != tt.wantCode || body.Error.Message == "" {
+				t.Errorf("error = %+v, want code %q", body.Error, tt.wantCode)
+			}
+		})
+	}
+}
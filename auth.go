@@ -0,0 +1,474 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookieName string = "signage_session"
+
+// CSRFトークンはJavaScriptから読めるCookieで渡し、X-CSRF-Token ヘッダで送り返してもらう。
+// フォームの値では受け付けないため、ログイン中の管理操作はすべて fetch で送ること (templates/base.html)
+const csrfCookieName string = "signage_csrf"
+const csrfHeaderName string = "X-CSRF-Token"
+
+const sessionLifetime time.Duration = 12 * time.Hour
+const minPasswordLength int = 8
+
+// ログインの失敗がこの回数を超えたIPは一定時間ログインできない
+const maxLoginFailures int = 5
+const loginLockout time.Duration = 5 * time.Minute
+
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleAdmin
+)
+
+func (r role) String() string {
+	switch r {
+	case roleAdmin:
+		return "admin"
+	case roleViewer:
+		return "viewer"
+	}
+	return "none"
+}
+
+type session struct {
+	role      role
+	csrfToken string
+	expires   time.Time
+}
+
+var sessions = make(map[string]*session)
+var sessionMutex sync.Mutex
+
+type loginAttempts struct {
+	failures int
+	until    time.Time
+}
+
+var loginFailures = make(map[string]*loginAttempts)
+var loginMutex sync.Mutex
+
+// randomToken は推測できないランダムな文字列を返す
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("乱数の生成に失敗: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken はAPIトークンを保存用にハッシュ化する
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("パスワードのハッシュ化に失敗: %w", err)
+	}
+	return string(b), nil
+}
+
+func checkPassword(hash, password string) bool {
+	return hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// newSession はセッションを作成し、セッションとCSRFトークンのCookieを設定する
+func newSession(w http.ResponseWriter, r *http.Request, ro role) {
+	id := randomToken()
+	s := &session{role: ro, csrfToken: randomToken(), expires: time.Now().Add(sessionLifetime)}
+
+	sessionMutex.Lock()
+	for k, v := range sessions {
+		if time.Now().After(v.expires) {
+			delete(sessions, k)
+		}
+	}
+	sessions[id] = s
+	sessionMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookieName, Value: id, Path: "/", Expires: s.expires,
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookieName, Value: s.csrfToken, Path: "/", Expires: s.expires,
+		Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// lookupSession はCookieのセッションを返す。期限切れの場合は削除する
+func lookupSession(r *http.Request) (string, *session) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", nil
+	}
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	s, ok := sessions[c.Value]
+	if !ok {
+		return "", nil
+	}
+	if time.Now().After(s.expires) {
+		delete(sessions, c.Value)
+		return "", nil
+	}
+	return c.Value, s
+}
+
+func destroySession(w http.ResponseWriter, r *http.Request) {
+	if id, _ := lookupSession(r); id != "" {
+		sessionMutex.Lock()
+		delete(sessions, id)
+		sessionMutex.Unlock()
+	}
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+	}
+}
+
+// destroySessionsByRole はパスワード変更時に、その権限の既存セッションを無効にする
+func destroySessionsByRole(ro role, keep string) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	for k, v := range sessions {
+		if v.role == ro && k != keep {
+			delete(sessions, k)
+		}
+	}
+}
+
+// hasAdminCredential は管理者のパスワードまたはトークンが設定されているかを返す
+func hasAdminCredential(config *Config) bool {
+	return config.Security.AdminPasswordHash != "" || config.Security.AdminTokenHash != ""
+}
+
+// clientIP はリクエスト元のIPアドレスを返す
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isLoopback はサーバ自身からの直接のリクエストかを返す (リバースプロキシ経由は除く)
+func isLoopback(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && ip.IsLoopback() && r.Header.Get("X-Forwarded-For") == ""
+}
+
+// bearerToken は Authorization: Bearer ヘッダのトークンを返す
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authenticate はリクエストの権限を判定する。
+// 管理者の認証情報が未設定の間は、サーバ自身 (localhost) からのアクセスのみ管理者として扱う。
+func authenticate(r *http.Request) (role, *session) {
+	config := appConfig.Get()
+
+	if token := bearerToken(r); token != "" {
+		hash := config.Security.AdminTokenHash
+		if hash != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(hash)) == 1 {
+			return roleAdmin, nil
+		}
+		return roleNone, nil
+	}
+	if _, s := lookupSession(r); s != nil {
+		return s.role, s
+	}
+	if !hasAdminCredential(config) && isLoopback(r) {
+		return roleAdmin, nil
+	}
+	return roleNone, nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// isSameOrigin は Origin (なければ Referer) ヘッダがこのサーバを指しているかを返す。
+// Origin と Referer を送らないブラウザもあるため、Sec-Fetch-Site が他のサイトを示す場合も拒否する
+func isSameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		// ブラウザ以外のクライアント
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// requireRole は required 以上の権限を持つリクエストのみ next に渡す。
+// GET 以外のリクエストではセッションのCSRFトークン (X-CSRF-Token ヘッダ) を確認する。
+// ログイン中にフォームを直接送信した場合はヘッダがないため403になる。
+func requireRole(required role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ro, s := authenticate(r)
+		if ro < required {
+			denyRequest(w, r, ro)
+			return
+		}
+
+		if !isSafeMethod(r.Method) {
+			switch {
+			case s != nil:
+				token := r.Header.Get(csrfHeaderName)
+				if subtle.ConstantTimeCompare([]byte(token), []byte(s.csrfToken)) != 1 {
+					http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+					return
+				}
+			case bearerToken(r) != "":
+				// トークン認証はCookieを使わないためCSRFの対象外
+			default:
+				if !isSameOrigin(r) {
+					http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+func denyRequest(w http.ResponseWriter, r *http.Request, ro role) {
+	if !hasAdminCredential(appConfig.Get()) {
+		http.Error(w, "管理者パスワードが設定されていません。サーバ本体のブラウザ (localhost) から設定ページを開いて設定してください。", http.StatusForbidden)
+		return
+	}
+	if ro != roleNone {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// ページの表示はログイン画面へ、APIは401を返す
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// safeRedirect はログイン後の遷移先を同一サイト内のパスに限定する
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginLocked はIPがログイン失敗により一時的に制限されているかを返す
+func loginLocked(ip string) bool {
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+	a, ok := loginFailures[ip]
+	return ok && time.Now().Before(a.until)
+}
+
+func recordLoginFailure(ip string) {
+	loginMutex.Lock()
+	defer loginMutex.Unlock()
+	a, ok := loginFailures[ip]
+	if !ok || (!a.until.IsZero() && time.Now().After(a.until)) {
+		a = &loginAttempts{}
+		loginFailures[ip] = a
+	}
+	a.failures++
+	if a.failures >= maxLoginFailures {
+		a.until = time.Now().Add(loginLockout)
+	}
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Next, ErrorMessage string
+	}{Next: safeRedirect(r.FormValue("next"))}
+
+	switch r.Method {
+	case http.MethodGet:
+		renderTemplate(w, "login", data)
+
+	case http.MethodPost:
+		ip := clientIP(r)
+		if !isSameOrigin(r) {
+			http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		if loginLocked(ip) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			data.ErrorMessage = "ログインの失敗が続いたため、しばらく待ってから再度お試しください。"
+			renderTemplate(w, "login", data)
+			return
+		}
+
+		config := appConfig.Get()
+		password := r.FormValue("password")
+		ro := roleNone
+		switch {
+		case checkPassword(config.Security.AdminPasswordHash, password):
+			ro = roleAdmin
+		case checkPassword(config.Security.ViewerPasswordHash, password):
+			ro = roleViewer
+		}
+
+		if ro == roleNone {
+			recordLoginFailure(ip)
+			log.Printf("ログインに失敗しました (%s)", ip)
+			w.WriteHeader(http.StatusUnauthorized)
+			data.ErrorMessage = "パスワードが違います。"
+			renderTemplate(w, "login", data)
+			return
+		}
+
+		loginMutex.Lock()
+		delete(loginFailures, ip)
+		loginMutex.Unlock()
+
+		destroySession(w, r)
+		newSession(w, r, ro)
+		log.Printf("%s としてログインしました (%s)", ro, ip)
+		http.Redirect(w, r, data.Next, http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSameOrigin(r) {
+		http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+		return
+	}
+	destroySession(w, r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// passwordHandler は管理者・閲覧者のパスワードを設定する
+func passwordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Role     string `json:"role"`
+		Password string `json:"password"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSettingsBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("パスワードは%d文字以上にしてください。", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file := appConfig.File()
+	var ro role
+	switch req.Role {
+	case "admin":
+		ro = roleAdmin
+		file.Security.AdminPasswordHash = hash
+	case "viewer":
+		ro = roleViewer
+		file.Security.ViewerPasswordHash = hash
+	default:
+		http.Error(w, "role は admin または viewer を指定してください。", http.StatusBadRequest)
+		return
+	}
+	if err := appConfig.Update(file); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, s := lookupSession(r)
+	destroySessionsByRole(ro, id)
+	// 初回設定時はログイン済みの状態にする
+	if s == nil && ro == roleAdmin && bearerToken(r) == "" {
+		newSession(w, r, roleAdmin)
+	}
+	log.Printf("%s のパスワードを変更しました。", ro)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenHandler は管理用APIトークンを発行 (POST) または失効 (DELETE) する。
+// トークンはハッシュのみ保存するため、発行時の応答でのみ確認できる。
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	file := appConfig.File()
+
+	switch r.Method {
+	case http.MethodPost:
+		token := randomToken()
+		file.Security.AdminTokenHash = hashToken(token)
+		if err := appConfig.Update(file); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("管理用APIトークンを発行しました。")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+
+	case http.MethodDelete:
+		file.Security.AdminTokenHash = ""
+		if err := appConfig.Update(file); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("管理用APIトークンを失効しました。")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
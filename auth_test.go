@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// useTestSecurity は認証の設定を appConfig に入れ、セッションとログイン失敗の記録を空にする
+func useTestSecurity(t *testing.T, security SecurityConfig) {
+	t.Helper()
+
+	c := &Config{Security: security}
+	applyConfigDefaults(c)
+	prev := appConfig
+	appConfig = &ConfigManager{}
+	appConfig.current.Store(c)
+
+	sessionMutex.Lock()
+	sessions = make(map[string]*session)
+	sessionMutex.Unlock()
+	loginMutex.Lock()
+	loginFailures = make(map[string]*loginAttempts)
+	loginMutex.Unlock()
+
+	t.Cleanup(func() { appConfig = prev })
+}
+
+// testSession はセッションを作成し、そのCookieとCSRFトークンを返す
+func testSession(t *testing.T, ro role) ([]*http.Cookie, string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	newSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), ro)
+	cookies := rec.Result().Cookies()
+	for _, c := range cookies {
+		if c.Name == csrfCookieName {
+			return cookies, c.Value
+		}
+	}
+	t.Fatal("CSRFトークンのCookieがありません")
+	return nil, ""
+}
+
+// okHandler は requireRole を通過したことを示す
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestRequireRole(t *testing.T) {
+	useTestSecurity(t, SecurityConfig{
+		AdminPasswordHash: "$2a$10$placeholder",
+		AdminTokenHash:    hashToken("admin-token"),
+	})
+	adminCookies, csrf := testSession(t, roleAdmin)
+	viewerCookies, _ := testSession(t, roleViewer)
+
+	tests := []struct {
+		name     string
+		required role
+		method   string
+		cookies  []*http.Cookie
+		header   map[string]string
+		want     int
+	}{
+		{"未ログインのAPI", roleViewer, http.MethodGet, nil, nil, http.StatusUnauthorized},
+		{"未ログインのページはログイン画面へ", roleViewer, http.MethodGet, nil, map[string]string{"Accept": "text/html"}, http.StatusSeeOther},
+		{"閲覧者が閲覧者のページ", roleViewer, http.MethodGet, viewerCookies, nil, http.StatusOK},
+		{"閲覧者が管理者のページ", roleAdmin, http.MethodGet, viewerCookies, nil, http.StatusForbidden},
+		{"管理者がCSRFトークンなしでPOST", roleAdmin, http.MethodPost, adminCookies, nil, http.StatusForbidden},
+		{"管理者が誤ったCSRFトークンでPOST", roleAdmin, http.MethodPost, adminCookies, map[string]string{csrfHeaderName: "wrong"}, http.StatusForbidden},
+		{"管理者がCSRFトークン付きでPOST", roleAdmin, http.MethodPost, adminCookies, map[string]string{csrfHeaderName: csrf}, http.StatusOK},
+		{"トークン認証はCSRFトークン不要", roleAdmin, http.MethodPost, nil, map[string]string{"Authorization": "Bearer admin-token", "Origin": "https://evil.example"}, http.StatusOK},
+		{"誤ったトークン", roleAdmin, http.MethodPost, nil, map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://signage.local/settings", nil)
+			for _, c := range tt.cookies {
+				r.AddCookie(c)
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			requireRole(tt.required, okHandler)(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireRoleLoopbackOrigin(t *testing.T) {
+	// 管理者の認証情報が未設定の間は localhost からのアクセスを管理者として扱う
+	useTestSecurity(t, SecurityConfig{})
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"ブラウザ以外のクライアント", nil, http.StatusOK},
+		{"同一オリジン", map[string]string{"Origin": "http://localhost:8888"}, http.StatusOK},
+		{"他のオリジン", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"他のサイトのRefererのみ", map[string]string{"Referer": "https://evil.example/page"}, http.StatusForbidden},
+		{"Origin・Refererなしの他のサイト", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"プロキシ経由", map[string]string{"X-Forwarded-For": "203.0.113.1"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://localhost:8888/update", nil)
+			r.RemoteAddr = "127.0.0.1:50000"
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			requireRole(roleAdmin, okHandler)(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	hash, err := hashPassword("correct-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestSecurity(t, SecurityConfig{AdminPasswordHash: hash})
+
+	login := func(password, remoteAddr string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		loginHandler(rec, r)
+		return rec
+	}
+
+	for i := 0; i < maxLoginFailures; i++ {
+		if rec := login("wrong-password", "192.0.2.1:1000"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%d回目の失敗: status = %d", i+1, rec.Code)
+		}
+	}
+	// 制限中は正しいパスワードでもログインできない
+	if rec := login("correct-password", "192.0.2.1:1000"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("制限中の status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// 他のIPは制限されない
+	rec := login("correct-password", "192.0.2.2:1000")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("他のIPの status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	var hasSession bool
+	for _, c := range rec.Result().Cookies() {
+		hasSession = hasSession || (c.Name == sessionCookieName && c.Value != "")
+	}
+	if !hasSession {
+		t.Error("ログイン後にセッションのCookieがありません")
+	}
+}
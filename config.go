@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 設定ファイルのスキーマのバージョン
+// 1: uid, agencyID, target のみ (version なし)
+// 2: server, realtime, display, signs, security を追加
+const configSchemaVersion int = 2
+
+// 設定の既定値
+const (
+	defaultPort           string = "8888"
+	defaultDatabaseDir    string = "./databases"
+	defaultPollInterval   int    = 30
+	defaultDelayThreshold int    = 60
+	defaultMaxRows        int    = 128
+	defaultStopName       string = "福島駅東口"
+
+	defaultDepartingThreshold int = 120
+	defaultDepartedRetention  int = 60
+
+	defaultMaxConnections      int = 64
+	defaultMaxConnectionsPerIP int = 8
+)
+
+type Config struct {
+	Version  int    `json:"version"`
+	UID      string `json:"uid,omitempty"`
+	AgencyID string `json:"agencyID,omitempty"`
+	Target   string `json:"target,omitempty"`
+	// 静的フィードの更新確認を行うcron式 (空の場合は毎晩3時)
+	FeedCheckCron string `json:"feedCheckCron,omitempty"`
+	// 複数事業者のフィードを統合する場合に設定 (空の場合は AgencyID のみ)
+	Feeds    []FeedConfig   `json:"feeds,omitempty"`
+	Server   ServerConfig   `json:"server"`
+	Realtime RealtimeConfig `json:"realtime"`
+	Display  DisplayConfig  `json:"display"`
+	Signs    []SignConfig   `json:"signs,omitempty"`
+	Layouts  []LayoutConfig `json:"layouts,omitempty"`
+	// 系統の色 (フィードの routes.route_color より優先)
+	RouteColors []RouteColorConfig `json:"routeColors,omitempty"`
+	Security    SecurityConfig     `json:"security"`
+
+	// 設定ファイルのAPIキーが暗号化されていなかった
+	plaintextSecret bool
+	// 復号できなかったAPIキーの暗号文。APIキーが再入力されるまで設定ファイルにそのまま書き戻す
+	undecryptableSecret string
+}
+
+// ServerConfig の変更は再起動後に反映される
+type ServerConfig struct {
+	Port        string `json:"port,omitempty"`
+	DatabaseDir string `json:"databaseDir,omitempty"`
+	// 設定ページからサーバ上のパスを指定して取り込めるディレクトリ (空の場合はパスでの取り込みを受け付けない)
+	ImportDir string `json:"importDir,omitempty"`
+}
+
+type RealtimeConfig struct {
+	// 運行情報の取得間隔 (秒)
+	PollInterval int `json:"pollInterval,omitempty"`
+}
+
+type DisplayConfig struct {
+	// 運行情報を表示する停留所名
+	StopName string `json:"stopName,omitempty"`
+	// この秒数を超える遅延のみ表示する。
+	// 以下の3項目は 0 も有効な値のため、未設定 (nil) の場合のみ既定値を使う
+	DelayThreshold *int `json:"delayThreshold,omitempty"`
+	// 出発予定までこの秒数以内の便を「まもなく」とする
+	DepartingThreshold *int `json:"departingThreshold,omitempty"`
+	// 発車済・運休の便を出発予定時刻からこの秒数表示し続ける
+	DepartedRetention *int `json:"departedRetention,omitempty"`
+	// 発車標に表示する最大行数
+	MaxRows int `json:"maxRows,omitempty"`
+	// 発車標のレイアウトID (空の場合は既定のレイアウト)
+	Layout string `json:"layout,omitempty"`
+}
+
+// SignConfig は設置された発車標ごとの設定
+type SignConfig struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// 空の場合は display.stopName を使用
+	StopName string `json:"stopName,omitempty"`
+	// レイアウトID (空の場合は display.layout を使用)
+	Layout string `json:"layout,omitempty"`
+}
+
+type SecurityConfig struct {
+	// websocket接続を許可するオリジン (空の場合は同一ホストのみ)
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// 管理者・閲覧者のパスワード (bcrypt)。設定ページまたは /api/password で設定する
+	AdminPasswordHash  string `json:"adminPasswordHash,omitempty"`
+	ViewerPasswordHash string `json:"viewerPasswordHash,omitempty"`
+	// 管理用APIトークンのSHA-256
+	AdminTokenHash string `json:"adminTokenHash,omitempty"`
+	// websocketの同時接続数の上限 (全体・IPごと)
+	MaxConnections      int `json:"maxConnections,omitempty"`
+	MaxConnectionsPerIP int `json:"maxConnectionsPerIP,omitempty"`
+}
+
+var sha256HexPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// clone はスライスも含めて設定を複製する
+func (c *Config) clone() *Config {
+	n := *c
+	n.Feeds = append([]FeedConfig(nil), c.Feeds...)
+	n.Signs = append([]SignConfig(nil), c.Signs...)
+	n.RouteColors = append([]RouteColorConfig(nil), c.RouteColors...)
+	n.Layouts = make([]LayoutConfig, len(c.Layouts))
+	for i, l := range c.Layouts {
+		n.Layouts[i] = l.clone()
+	}
+	n.Security.AllowedOrigins = append([]string(nil), c.Security.AllowedOrigins...)
+	return &n
+}
+
+// signStopNames は発車標に表示する停留所名を重複なく返す (display.stopName と各発車標の stopName)
+func (c *Config) signStopNames() []string {
+	names := []string{c.Display.StopName}
+	for _, s := range c.Signs {
+		if s.StopName != "" && !slices.Contains(names, s.StopName) {
+			names = append(names, s.StopName)
+		}
+	}
+	return names
+}
+
+// migrateConfig は古いスキーマの設定を現在のスキーマに変換する
+func migrateConfig(c *Config) error {
+	if c.Version > configSchemaVersion {
+		return fmt.Errorf("設定ファイルのバージョン %d には対応していません (対応: %d 以下)", c.Version, configSchemaVersion)
+	}
+	// バージョン1からの変更は項目の追加のみのため、既定値で補完する
+	c.Version = configSchemaVersion
+	return nil
+}
+
+// applyConfigDefaults は未設定の項目に既定値を入れる
+func applyConfigDefaults(c *Config) {
+	if c.Server.Port == "" {
+		c.Server.Port = defaultPort
+	}
+	if c.Server.DatabaseDir == "" {
+		c.Server.DatabaseDir = defaultDatabaseDir
+	}
+	if c.Realtime.PollInterval == 0 {
+		c.Realtime.PollInterval = defaultPollInterval
+	}
+	if c.Display.StopName == "" {
+		c.Display.StopName = defaultStopName
+	}
+	if c.Display.DelayThreshold == nil {
+		c.Display.DelayThreshold = optionalInt(defaultDelayThreshold)
+	}
+	if c.Display.MaxRows == 0 {
+		c.Display.MaxRows = defaultMaxRows
+	}
+	if c.Display.DepartingThreshold == nil {
+		c.Display.DepartingThreshold = optionalInt(defaultDepartingThreshold)
+	}
+	if c.Display.DepartedRetention == nil {
+		c.Display.DepartedRetention = optionalInt(defaultDepartedRetention)
+	}
+	if c.Security.MaxConnections == 0 {
+		c.Security.MaxConnections = defaultMaxConnections
+	}
+	if c.Security.MaxConnectionsPerIP == 0 {
+		c.Security.MaxConnectionsPerIP = defaultMaxConnectionsPerIP
+	}
+}
+
+// configOption はフラグと環境変数で上書きできる設定項目
+type configOption struct {
+	// フラグ名。環境変数名は SIGNAGE_ に大文字のフラグ名を続けたもの (port -> SIGNAGE_PORT)
+	name  string
+	usage string
+	// プロセス一覧から見えないよう、環境変数でのみ指定できる項目
+	envOnly bool
+	set     func(c *Config, v string) error
+}
+
+var configOptions = []configOption{
+	{name: "uid", usage: "APIキー", envOnly: true, set: func(c *Config, v string) error {
+		c.UID = v
+		return nil
+	}},
+	{name: "agency-id", usage: "事業者ID", set: func(c *Config, v string) error {
+		c.AgencyID = v
+		return nil
+	}},
+	{name: "port", usage: "待ち受けるポート番号", set: func(c *Config, v string) error {
+		c.Server.Port = v
+		return nil
+	}},
+	{name: "db-dir", usage: "DBを保存するディレクトリ", set: func(c *Config, v string) error {
+		c.Server.DatabaseDir = v
+		return nil
+	}},
+	{name: "import-dir", usage: "設定ページからパスを指定して静的GTFSを取り込めるディレクトリ", set: func(c *Config, v string) error {
+		c.Server.ImportDir = v
+		return nil
+	}},
+	{name: "poll-interval", usage: "運行情報の取得間隔 (秒)", set: func(c *Config, v string) error {
+		return setInt(&c.Realtime.PollInterval, v)
+	}},
+	{name: "stop-name", usage: "運行情報を表示する停留所名", set: func(c *Config, v string) error {
+		c.Display.StopName = v
+		return nil
+	}},
+	{name: "delay-threshold", usage: "この秒数を超える遅延のみ表示する", set: func(c *Config, v string) error {
+		return setOptionalInt(&c.Display.DelayThreshold, v)
+	}},
+	{name: "departing-threshold", usage: "出発予定までこの秒数以内の便を「まもなく」と表示する", set: func(c *Config, v string) error {
+		return setOptionalInt(&c.Display.DepartingThreshold, v)
+	}},
+	{name: "departed-retention", usage: "発車済・運休の便を出発予定時刻からこの秒数表示し続ける", set: func(c *Config, v string) error {
+		return setOptionalInt(&c.Display.DepartedRetention, v)
+	}},
+	{name: "max-rows", usage: "発車標に表示する最大行数", set: func(c *Config, v string) error {
+		return setInt(&c.Display.MaxRows, v)
+	}},
+	{name: "feed-check-cron", usage: "静的フィードの更新確認を行うcron式", set: func(c *Config, v string) error {
+		c.FeedCheckCron = v
+		return nil
+	}},
+	{name: "max-connections", usage: "websocketの同時接続数の上限", set: func(c *Config, v string) error {
+		return setInt(&c.Security.MaxConnections, v)
+	}},
+	{name: "max-connections-per-ip", usage: "IPごとのwebsocketの同時接続数の上限", set: func(c *Config, v string) error {
+		return setInt(&c.Security.MaxConnectionsPerIP, v)
+	}},
+	{name: "allowed-origins", usage: "websocket接続を許可するオリジン (カンマ区切り)", set: func(c *Config, v string) error {
+		c.Security.AllowedOrigins = splitList(v)
+		return nil
+	}},
+}
+
+func (o configOption) envName() string {
+	return "SIGNAGE_" + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("整数ではありません: %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+// setOptionalInt は未設定と 0 を区別する項目に値を入れる。
+// 設定ファイルの内容と値を共有しないよう、常に新しい値を割り当てる
+func setOptionalInt(dst **int, v string) error {
+	var n int
+	if err := setInt(&n, v); err != nil {
+		return err
+	}
+	*dst = &n
+	return nil
+}
+
+func optionalInt(n int) *int {
+	return &n
+}
+
+func splitList(v string) []string {
+	list := make([]string, 0)
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// コマンドラインで指定された設定値 (フラグ名 -> 値)
+var configFlags = make(map[string]string)
+
+// registerConfigFlags は設定を上書きするフラグを登録する
+func registerConfigFlags(fs *flag.FlagSet) {
+	for _, opt := range configOptions {
+		if opt.envOnly {
+			continue
+		}
+		opt := opt
+		fs.Func(opt.name, opt.usage+" (環境変数 "+opt.envName()+")", func(v string) error {
+			if err := opt.set(&Config{}, v); err != nil {
+				return err
+			}
+			configFlags[opt.name] = v
+			return nil
+		})
+	}
+}
+
+// resolveConfig は設定ファイルの内容に 環境変数、フラグ、既定値 の順で適用した設定を返す。
+// 優先順位は フラグ > 環境変数 > 設定ファイル > 既定値。
+func resolveConfig(file *Config) (*Config, error) {
+	c := file.clone()
+	if err := migrateConfig(c); err != nil {
+		return c, err
+	}
+
+	errs := make([]error, 0)
+	for _, opt := range configOptions {
+		if v := os.Getenv(opt.envName()); v != "" {
+			if err := opt.set(c, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", opt.envName(), err))
+			}
+		}
+	}
+	for _, opt := range configOptions {
+		if v, ok := configFlags[opt.name]; ok {
+			if err := opt.set(c, v); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", opt.name, err))
+			}
+		}
+	}
+
+	applyConfigDefaults(c)
+	errs = append(errs, validateConfig(c))
+	return c, errors.Join(errs...)
+}
+
+// validateConfig は設定の内容を検証し、不正な項目をすべて返す
+func validateConfig(config *Config) error {
+	errs := make([]error, 0)
+
+	if port, err := strconv.Atoi(config.Server.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port は1から65535の数値で指定してください: %q", config.Server.Port))
+	}
+	if config.Realtime.PollInterval < 5 || config.Realtime.PollInterval > 3600 {
+		errs = append(errs, fmt.Errorf("realtime.pollInterval は5から3600秒で指定してください: %d", config.Realtime.PollInterval))
+	}
+	if *config.Display.DelayThreshold < 0 {
+		errs = append(errs, fmt.Errorf("display.delayThreshold は0以上で指定してください: %d", *config.Display.DelayThreshold))
+	}
+	if *config.Display.DepartingThreshold < 0 || *config.Display.DepartingThreshold > 3600 {
+		errs = append(errs, fmt.Errorf("display.departingThreshold は0から3600秒で指定してください: %d", *config.Display.DepartingThreshold))
+	}
+	if *config.Display.DepartedRetention < 0 || *config.Display.DepartedRetention > 3600 {
+		errs = append(errs, fmt.Errorf("display.departedRetention は0から3600秒で指定してください: %d", *config.Display.DepartedRetention))
+	}
+	if config.Display.MaxRows < 1 || config.Display.MaxRows > 1000 {
+		errs = append(errs, fmt.Errorf("display.maxRows は1から1000で指定してください: %d", config.Display.MaxRows))
+	}
+
+	if config.FeedCheckCron != "" {
+		if _, err := parseCron(config.FeedCheckCron); err != nil {
+			errs = append(errs, fmt.Errorf("feedCheckCron が不正です: %w", err))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range config.Feeds {
+		if !feedIDPattern.MatchString(f.ID) {
+			errs = append(errs, fmt.Errorf("フィードID %q は英数字と_のみ使用できます", f.ID))
+		}
+		if seen[f.ID] {
+			errs = append(errs, fmt.Errorf("フィードID %q が重複しています", f.ID))
+		}
+		seen[f.ID] = true
+		if f.AgencyID == "" {
+			errs = append(errs, fmt.Errorf("フィード %s の agencyID が空です", f.ID))
+		}
+	}
+
+	seenSigns := make(map[string]bool)
+	for _, s := range config.Signs {
+		if !feedIDPattern.MatchString(s.ID) {
+			errs = append(errs, fmt.Errorf("発車標ID %q は英数字と_のみ使用できます", s.ID))
+		}
+		if seenSigns[s.ID] {
+			errs = append(errs, fmt.Errorf("発車標ID %q が重複しています", s.ID))
+		}
+		seenSigns[s.ID] = true
+	}
+	errs = append(errs, validateLayouts(config))
+	errs = append(errs, validateRouteColors(config))
+
+	if config.Security.MaxConnections < 1 {
+		errs = append(errs, fmt.Errorf("security.maxConnections は1以上で指定してください: %d", config.Security.MaxConnections))
+	}
+	if config.Security.MaxConnectionsPerIP < 1 || config.Security.MaxConnectionsPerIP > config.Security.MaxConnections {
+		errs = append(errs, fmt.Errorf("security.maxConnectionsPerIP は1以上 maxConnections 以下で指定してください: %d", config.Security.MaxConnectionsPerIP))
+	}
+	if hash := config.Security.AdminPasswordHash; hash != "" && !strings.HasPrefix(hash, "$2") {
+		errs = append(errs, fmt.Errorf("security.adminPasswordHash はbcryptのハッシュで指定してください"))
+	}
+	if hash := config.Security.ViewerPasswordHash; hash != "" && !strings.HasPrefix(hash, "$2") {
+		errs = append(errs, fmt.Errorf("security.viewerPasswordHash はbcryptのハッシュで指定してください"))
+	}
+	if hash := config.Security.AdminTokenHash; hash != "" && !sha256HexPattern.MatchString(hash) {
+		errs = append(errs, fmt.Errorf("security.adminTokenHash はSHA-256の16進数で指定してください"))
+	}
+
+	for _, origin := range config.Security.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("security.allowedOrigins の %q は http(s)://host の形式で指定してください", origin))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 設定ファイルの変更を確認する間隔
+const configWatchInterval time.Duration = 2 * time.Second
+
+// ConfigManager は設定を1か所で保持し、変更を購読者に通知する。
+// 保持している *Config は差し替えのみ行い書き換えないため、Get の戻り値はそのまま読んでよい。
+type ConfigManager struct {
+	path    string
+	current atomic.Pointer[Config]
+
+	mu          sync.Mutex
+	modTime     time.Time
+	file        *Config // 環境変数・フラグ・既定値を適用する前の設定ファイルの内容
+	lastErr     error   // 最後に読み込んだ設定ファイルの検証エラー
+	subscribers []chan *Config
+}
+
+// アプリ全体で共有する設定
+var appConfig *ConfigManager
+
+// newConfigManager は設定ファイルを読み込み (存在しなければ作成し) ConfigManager を返す
+func newConfigManager(path string) (*ConfigManager, error) {
+	m := &ConfigManager{path: path, file: &Config{}}
+	config, _ := resolveConfig(m.file)
+	m.current.Store(config)
+
+	file, err := readOrCreateConfig(path)
+	if err != nil {
+		m.lastErr = err
+		return m, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		m.modTime = info.ModTime()
+	}
+	m.encryptPlaintextSecret(file)
+	m.file = file
+
+	config, err = resolveConfig(file)
+	m.lastErr = err
+	if err != nil {
+		return m, err
+	}
+	m.current.Store(config)
+	return m, nil
+}
+
+// Get は現在の設定を返す
+func (m *ConfigManager) Get() *Config {
+	return m.current.Load()
+}
+
+// File は設定ファイルの内容 (環境変数・フラグ・既定値の適用前) の複製を返す
+func (m *ConfigManager) File() *Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.clone()
+}
+
+// Err は最後に読み込んだ設定ファイルの検証エラーを返す
+func (m *ConfigManager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastErr
+}
+
+// Subscribe は設定が変わるたびに新しい設定を受け取るチャネルを返す。
+// 受信が遅れた場合は最新の設定のみが残る。
+func (m *ConfigManager) Subscribe() <-chan *Config {
+	ch := make(chan *Config, 1)
+	m.mu.Lock()
+	m.subscribers = append(m.subscribers, ch)
+	m.mu.Unlock()
+	return ch
+}
+
+// Update は設定ファイルの内容を検証して書き込み、購読者に通知する
+func (m *ConfigManager) Update(file *Config) error {
+	file = file.clone()
+	file.Version = configSchemaVersion
+	config, err := resolveConfig(file)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := writeConfig(m.path, file); err != nil {
+		return err
+	}
+	if info, err := os.Stat(m.path); err == nil {
+		m.modTime = info.ModTime()
+	}
+	m.file = file
+	m.lastErr = nil
+	m.publish(config)
+	return nil
+}
+
+// Reload は設定ファイルが更新されていれば読み直す。
+// 新しい設定が不正な場合は現在の設定を維持する。
+func (m *ConfigManager) Reload() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat config file: %w", err)
+	}
+	if info.ModTime().Equal(m.modTime) {
+		return false, nil
+	}
+
+	// 書き込み途中で読めなかった場合は次回に再試行する
+	file, err := readConfig(m.path)
+	if err != nil {
+		return false, err
+	}
+	m.modTime = info.ModTime()
+	m.encryptPlaintextSecret(file)
+
+	config, err := resolveConfig(file)
+	m.lastErr = err
+	if err != nil {
+		return false, err
+	}
+	if prev := m.Get(); prev.Server != config.Server {
+		log.Println("server の設定の変更はサーバの再起動後に反映されます。")
+	}
+	m.file = file
+	m.publish(config)
+	return true, nil
+}
+
+// encryptPlaintextSecret は平文で保存されたAPIキーを暗号化して書き直す (m.mu を保持して呼ぶこと)
+func (m *ConfigManager) encryptPlaintextSecret(file *Config) {
+	if !file.plaintextSecret {
+		return
+	}
+	if err := writeConfig(m.path, file); err != nil {
+		log.Printf("APIキーの暗号化に失敗しました: %v", err)
+		return
+	}
+	file.plaintextSecret = false
+	if info, err := os.Stat(m.path); err == nil {
+		m.modTime = info.ModTime()
+	}
+	log.Println("設定ファイルのAPIキーを暗号化して保存しました。")
+}
+
+// publish は設定を差し替えて購読者に通知する (m.mu を保持して呼ぶこと)
+func (m *ConfigManager) publish(config *Config) {
+	m.current.Store(config)
+	for _, ch := range m.subscribers {
+		// 未受信の古い設定は捨てて最新のみを残す
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- config
+	}
+}
+
+// watch は設定ファイルの更新を監視し、変更があれば再読み込みする
+func (m *ConfigManager) watch() {
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := m.Reload()
+		if err != nil {
+			log.Printf("設定ファイルの再読み込みに失敗しました。現在の設定を使用します: %v", err)
+			continue
+		}
+		if changed {
+			log.Println("設定ファイルの変更を反映しました。")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rewriteConfig は設定ファイルを書き直し、更新時刻を進めて Reload が変更を検出できるようにする
+func rewriteConfig(t *testing.T, path string, content string, modTime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigManagerReload(t *testing.T) {
+	useSecretKey(t, 1)
+	path := filepath.Join(t.TempDir(), "settings.json")
+	rewriteConfig(t, path, `{"version": 2, "display": {"stopName": "駅前"}}`, time.Now().Add(-time.Hour))
+
+	m, err := newConfigManager(path)
+	if err != nil {
+		t.Fatalf("newConfigManager: %v", err)
+	}
+	changes := m.Subscribe()
+
+	// 変更がなければ読み直さない
+	if changed, err := m.Reload(); changed || err != nil {
+		t.Fatalf("Reload (変更なし) = %v, %v", changed, err)
+	}
+
+	rewriteConfig(t, path, `{"version": 2, "display": {"stopName": "市役所", "maxRows": 8}}`, time.Now().Add(-time.Minute))
+	if changed, err := m.Reload(); !changed || err != nil {
+		t.Fatalf("Reload = %v, %v", changed, err)
+	}
+	select {
+	case c := <-changes:
+		if c.Display.StopName != "市役所" || c.Display.MaxRows != 8 {
+			t.Errorf("通知された設定 = %+v", c.Display)
+		}
+	default:
+		t.Fatal("購読者に新しい設定が通知されていません")
+	}
+	if got := m.Get().Display.StopName; got != "市役所" {
+		t.Errorf("Get().Display.StopName = %q", got)
+	}
+
+	// 不正な設定は現在の設定を置き換えない
+	invalid := []struct {
+		name    string
+		content string
+	}{
+		{"検証エラー", `{"version": 2, "display": {"stopName": "病院", "maxRows": -1}}`},
+		{"JSONの構文エラー", `{"version": 2, "display": {`},
+	}
+	for i, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriteConfig(t, path, tt.content, time.Now().Add(time.Duration(i)*time.Second))
+			if changed, err := m.Reload(); changed || err == nil {
+				t.Fatalf("Reload = %v, %v, want エラー", changed, err)
+			}
+			if got := m.Get().Display.StopName; got != "市役所" {
+				t.Errorf("Get().Display.StopName = %q, want 市役所", got)
+			}
+			if got := m.File().Display.StopName; got != "市役所" {
+				t.Errorf("File().Display.StopName = %q, want 市役所", got)
+			}
+			select {
+			case c := <-changes:
+				t.Errorf("不正な設定が通知されました: %+v", c.Display)
+			default:
+			}
+		})
+	}
+	if m.Err() == nil {
+		t.Error("検証エラーが Err() に残っていません")
+	}
+}
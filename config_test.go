@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResolveConfigOptionalInt(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+		want int
+	}{
+		{"未設定の場合は既定値", `{"display":{}}`, "", defaultDepartingThreshold},
+		{"null の場合は既定値", `{"display":{"departingThreshold":null}}`, "", defaultDepartingThreshold},
+		{"0 を指定", `{"display":{"departingThreshold":0}}`, "", 0},
+		{"値を指定", `{"display":{"departingThreshold":30}}`, "", 30},
+		{"環境変数で 0 を指定", `{"display":{"departingThreshold":30}}`, "0", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("SIGNAGE_DEPARTING_THRESHOLD", tt.env)
+			}
+			var file Config
+			if err := json.Unmarshal([]byte(tt.file), &file); err != nil {
+				t.Fatal(err)
+			}
+			before, _ := json.Marshal(file)
+
+			c, err := resolveConfig(&file)
+			if err != nil {
+				t.Fatalf("resolveConfig: %v", err)
+			}
+			if got := *c.Display.DepartingThreshold; got != tt.want {
+				t.Errorf("departingThreshold = %d, want %d", got, tt.want)
+			}
+
+			// 既定値や環境変数で設定ファイルの内容が変わらないこと
+			if after, _ := json.Marshal(file); string(after) != string(before) {
+				t.Errorf("設定ファイルの内容が変わりました: %s -> %s", before, after)
+			}
+		})
+	}
+}
+
+func TestOptionalIntJSON(t *testing.T) {
+	// 0 は保存され、未設定は保存されない
+	b, err := json.Marshal(DisplayConfig{DelayThreshold: optionalInt(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"delayThreshold":0}` {
+		t.Errorf("json = %s", b)
+	}
+}
+
+func TestValidateConfigOptionalInt(t *testing.T) {
+	file := Config{Display: DisplayConfig{DepartedRetention: optionalInt(-1)}}
+	if _, err := resolveConfig(&file); err == nil {
+		t.Error("負の departedRetention にエラーがありません")
+	}
+}
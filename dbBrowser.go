@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DBブラウザの1ページあたりの行数
+const dbBrowserPageSize int = 50
+
+// DBブラウザで参照できるDB (クエリパラメータ -> ファイル名)
+var browsableDbs = map[string]string{
+	"static":  staticDbFile,
+	"dynamic": dynamicDbFile,
+}
+
+type dbTableInfo struct {
+	Name  string
+	Count int64
+}
+
+// dbGrid はテーブル表示用のカラム名と行
+type dbGrid struct {
+	Columns []string
+	Rows    [][]string
+}
+
+type dbBrowserPage struct {
+	Db           string
+	Tables       []dbTableInfo
+	FeedInfo     []map[string]interface{}
+	Table        string
+	Columns      []string
+	Rows         dbGrid
+	FilterColumn string
+	Filter       string
+	Page         int
+	PrevPage     int
+	NextPage     int
+	TotalRows    int64
+	TotalPages   int
+	Stop         string
+	Stops        dbGrid
+	Departures   dbGrid
+	Trip         string
+	TripRows     dbGrid
+	StopTimes    dbGrid
+	ErrorMessage string
+}
+
+// 指定されたテーブル・カラムがDBに存在しない
+var errDbObjectNotFound = errors.New("存在しません")
+
+var stopTimeLookupColumns = []string{"stop_sequence", "arrival_time", "departure_time", "stop_id", "stop_name", "stop_headsign"}
+var departureLookupColumns = []string{"departure_time", "trip_id", "route_id", "route_long_name", "stop_headsign", "stop_id"}
+
+// openReadOnlyDb はDBを読み取り専用で開く
+func openReadOnlyDb(dbFile string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+databasePath(dbFile)+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("データベース接続に失敗: %w", err)
+	}
+	return db, nil
+}
+
+// listTables はDB内のテーブル名の一覧を返す
+func listTables(db *sql.DB) ([]string, error) {
+	rows, err := QueryRows(db, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]string, 0, len(rows))
+	for _, r := range rows {
+		tables = append(tables, r["name"].(string))
+	}
+	return tables, nil
+}
+
+// listColumns はテーブルのカラム名を定義順に返す
+func listColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := QueryRows(db, `SELECT name FROM pragma_table_info(?) ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(rows))
+	for _, r := range rows {
+		columns = append(columns, r["name"].(string))
+	}
+	return columns, nil
+}
+
+// quoteIdent はSQLの識別子をクォートする (一覧に存在する名前のみに使用すること)
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// rowsToStrings は QueryRows の結果をカラム順の文字列に変換する
+func rowsToStrings(rows []map[string]interface{}, columns []string) [][]string {
+	result := make([][]string, 0, len(rows))
+	for _, r := range rows {
+		values := make([]string, len(columns))
+		for i, c := range columns {
+			if v := r[c]; v != nil {
+				values[i] = fmt.Sprint(v)
+			}
+		}
+		result = append(result, values)
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dbBrowserHandler は読み取り専用のDBブラウザを表示する
+func dbBrowserHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	data := dbBrowserPage{
+		Db:           query.Get("db"),
+		Table:        query.Get("table"),
+		FilterColumn: query.Get("col"),
+		Filter:       query.Get("q"),
+		Stop:         strings.TrimSpace(query.Get("stop")),
+		Trip:         strings.TrimSpace(query.Get("trip")),
+		Page:         1,
+	}
+	if data.Db == "" {
+		data.Db = "static"
+	}
+	if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 0 {
+		data.Page = p
+	}
+
+	dbFile, ok := browsableDbs[data.Db]
+	if !ok {
+		http.Error(w, "Unknown database", http.StatusBadRequest)
+		return
+	}
+
+	db, err := openReadOnlyDb(dbFile)
+	if err != nil {
+		data.ErrorMessage = err.Error()
+		renderTemplate(w, "db", data)
+		return
+	}
+	defer db.Close()
+
+	if err := loadDbBrowserPage(db, &data); err != nil {
+		data.ErrorMessage = err.Error()
+		if errors.Is(err, errDbObjectNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+
+	renderTemplate(w, "db", data)
+}
+
+func loadDbBrowserPage(db *sql.DB, data *dbBrowserPage) error {
+	tables, err := listTables(db)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tables {
+		count, _ := QueryRows(db, "SELECT COUNT(*) AS count FROM "+quoteIdent(t))
+		info := dbTableInfo{Name: t}
+		if len(count) == 1 {
+			info.Count, _ = count[0]["count"].(int64)
+		}
+		data.Tables = append(data.Tables, info)
+	}
+
+	if contains(tables, "feed_info") {
+		data.FeedInfo, _ = QueryRows(db, `SELECT * FROM feed_info WHERE feed_start_date GLOB '[0-9]*'`)
+	}
+
+	if data.Stop != "" && contains(tables, "stops") && contains(tables, "stop_times") {
+		if err := lookupStop(db, data); err != nil {
+			return err
+		}
+	}
+	if data.Trip != "" && contains(tables, "trips") && contains(tables, "stop_times") {
+		if err := lookupTrip(db, data); err != nil {
+			return err
+		}
+	}
+
+	if data.Table == "" {
+		return nil
+	}
+	// テーブル名・カラム名はDB内に存在するものだけを受け付ける
+	if !contains(tables, data.Table) {
+		return fmt.Errorf("テーブル %q は%w", data.Table, errDbObjectNotFound)
+	}
+	data.Columns, err = listColumns(db, data.Table)
+	if err != nil {
+		return err
+	}
+
+	where := ""
+	args := make([]interface{}, 0)
+	if data.Filter != "" {
+		if !contains(data.Columns, data.FilterColumn) {
+			return fmt.Errorf("カラム %q は%w", data.FilterColumn, errDbObjectNotFound)
+		}
+		where = " WHERE CAST(" + quoteIdent(data.FilterColumn) + " AS TEXT) LIKE ?"
+		args = append(args, "%"+data.Filter+"%")
+	}
+
+	count, err := QueryRows(db, "SELECT COUNT(*) AS count FROM "+quoteIdent(data.Table)+where, args...)
+	if err != nil {
+		return err
+	}
+	if len(count) == 1 {
+		data.TotalRows, _ = count[0]["count"].(int64)
+	}
+	data.TotalPages = int((data.TotalRows + int64(dbBrowserPageSize) - 1) / int64(dbBrowserPageSize))
+	if data.Page > 1 {
+		data.PrevPage = data.Page - 1
+	}
+	if data.Page < data.TotalPages {
+		data.NextPage = data.Page + 1
+	}
+
+	args = append(args, dbBrowserPageSize, (data.Page-1)*dbBrowserPageSize)
+	rows, err := QueryRows(db, "SELECT * FROM "+quoteIdent(data.Table)+where+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return err
+	}
+	data.Rows = dbGrid{data.Columns, rowsToStrings(rows, data.Columns)}
+
+	return nil
+}
+
+// lookupStop は停留所IDまたは停留所名で停留所を検索し、その停留所の発車時刻を取得する
+func lookupStop(db *sql.DB, data *dbBrowserPage) error {
+	stopColumns, err := listColumns(db, "stops")
+	if err != nil {
+		return err
+	}
+
+	stops, err := QueryRows(db, `SELECT * FROM stops WHERE stop_id = ? OR stop_name = ?`, data.Stop, data.Stop)
+	if err != nil {
+		return err
+	}
+	data.Stops = dbGrid{stopColumns, rowsToStrings(stops, stopColumns)}
+
+	departures, err := QueryRows(db, `
+		SELECT st.departure_time, st.trip_id, t.route_id, r.route_long_name, st.stop_headsign, st.stop_id
+		FROM stop_times AS st
+		JOIN stops AS s ON st.stop_id = s.stop_id
+		LEFT JOIN trips AS t ON st.trip_id = t.trip_id
+		LEFT JOIN routes AS r ON t.route_id = r.route_id
+		WHERE s.stop_id = ? OR s.stop_name = ?
+		ORDER BY st.departure_time
+		LIMIT 1000
+	`, data.Stop, data.Stop)
+	if err != nil {
+		return err
+	}
+	data.Departures = dbGrid{departureLookupColumns, rowsToStrings(departures, departureLookupColumns)}
+	return nil
+}
+
+// lookupTrip は便の情報と全停車時刻を取得する
+func lookupTrip(db *sql.DB, data *dbBrowserPage) error {
+	tripColumns, err := listColumns(db, "trips")
+	if err != nil {
+		return err
+	}
+
+	trips, err := QueryRows(db, `SELECT * FROM trips WHERE trip_id = ?`, data.Trip)
+	if err != nil {
+		return err
+	}
+	data.TripRows = dbGrid{tripColumns, rowsToStrings(trips, tripColumns)}
+
+	stopTimes, err := QueryRows(db, `
+		SELECT st.stop_sequence, st.arrival_time, st.departure_time, st.stop_id, s.stop_name, st.stop_headsign
+		FROM stop_times AS st
+		LEFT JOIN stops AS s ON st.stop_id = s.stop_id
+		WHERE st.trip_id = ?
+		ORDER BY st.stop_sequence
+	`, data.Trip)
+	if err != nil {
+		return err
+	}
+	data.StopTimes = dbGrid{stopTimeLookupColumns, rowsToStrings(stopTimes, stopTimeLookupColumns)}
+	return nil
+}
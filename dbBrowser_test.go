@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newTestBrowserDb は停留所を n 件登録した静的DBを一時ディレクトリに作る。
+// 停留所名は3件に1件が「駅」を含む
+func newTestBrowserDb(t *testing.T, n int) *sql.DB {
+	t.Helper()
+
+	prevDir := databaseDir
+	databaseDir = t.TempDir()
+	t.Cleanup(func() { databaseDir = prevDir })
+
+	db, err := sql.Open("sqlite3", databasePath(staticDbFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := createStaticTables(db); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("停留所%d", i)
+		if i%3 == 0 {
+			name = fmt.Sprintf("駅前%d", i)
+		}
+		if _, err := db.Exec(`INSERT INTO stops (stop_id, stop_name) VALUES (?, ?)`, fmt.Sprintf("S%03d", i), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestDbBrowserHandlerStatus(t *testing.T) {
+	db := newTestBrowserDb(t, 3)
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  int
+	}{
+		{"テーブル一覧", url.Values{}, http.StatusOK},
+		{"テーブルを表示", url.Values{"table": {"stops"}}, http.StatusOK},
+		{"未知のDB", url.Values{"db": {"../settings"}}, http.StatusBadRequest},
+		{"未知のテーブル", url.Values{"table": {"nope"}}, http.StatusNotFound},
+		{"SQLを含むテーブル名", url.Values{"table": {`stops"; DROP TABLE stops; --`}}, http.StatusNotFound},
+		{"未知のカラムで絞り込み", url.Values{"table": {"stops"}, "col": {"stop_name) OR 1=1 --"}, "q": {"駅"}}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			dbBrowserHandler(rec, httptest.NewRequest(http.MethodGet, "/db?"+tt.query.Encode(), nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	// テーブル名はSQLとして実行されていない
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM stops`).Scan(&count); err != nil || count != 3 {
+		t.Errorf("stops の件数 = %d, %v, want 3", count, err)
+	}
+}
+
+func TestLoadDbBrowserPage(t *testing.T) {
+	db := newTestBrowserDb(t, 120)
+
+	tests := []struct {
+		name      string
+		page      int
+		col, q    string
+		wantTotal int64
+		wantPages int
+		wantRows  int
+		wantPrev  int
+		wantNext  int
+	}{
+		{"1ページ目", 1, "", "", 120, 3, 50, 0, 2},
+		{"2ページ目", 2, "", "", 120, 3, 50, 1, 3},
+		{"最後のページ", 3, "", "", 120, 3, 20, 2, 0},
+		{"範囲外のページ", 4, "", "", 120, 3, 0, 3, 0},
+		{"部分一致で絞り込み", 1, "stop_name", "駅", 40, 1, 40, 0, 0},
+		{"停留所IDで絞り込み", 1, "stop_id", "S11", 10, 1, 10, 0, 0},
+		{"一致なし", 1, "stop_name", "空港", 0, 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := dbBrowserPage{Table: "stops", FilterColumn: tt.col, Filter: tt.q, Page: tt.page}
+			if err := loadDbBrowserPage(db, &data); err != nil {
+				t.Fatalf("loadDbBrowserPage: %v", err)
+			}
+			if data.TotalRows != tt.wantTotal || data.TotalPages != tt.wantPages {
+				t.Errorf("件数 = %d (%dページ), want %d (%dページ)", data.TotalRows, data.TotalPages, tt.wantTotal, tt.wantPages)
+			}
+			if len(data.Rows.Rows) != tt.wantRows {
+				t.Errorf("行数 = %d, want %d", len(data.Rows.Rows), tt.wantRows)
+			}
+			if data.PrevPage != tt.wantPrev || data.NextPage != tt.wantNext {
+				t.Errorf("前後のページ = %d/%d, want %d/%d", data.PrevPage, data.NextPage, tt.wantPrev, tt.wantNext)
+			}
+		})
+	}
+}
@@ -7,11 +7,23 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+type Agency struct {
+	AgencyID       string
+	AgencyName     string
+	AgencyURL      string
+	AgencyTimezone string
+	AgencyLang     string
+	AgencyPhone    string
+	AgencyFareURL  string
+	AgencyEmail    string
+}
+
 type CalendarDate struct {
 	ServiceID     string
 	Date          string
@@ -140,15 +152,23 @@ type Trip struct {
 	JPOfficeID           int
 }
 
+// DBを保存するディレクトリ (起動時に設定の server.databaseDir で上書きされる)
+var databaseDir string = defaultDatabaseDir
+
+// databasePath はDBディレクトリ内のファイルのパスを返す
+func databasePath(name string) string {
+	return filepath.Join(databaseDir, name)
+}
+
 // SQLite3データベースに接続し、必要であればディレクトリとテーブルを作成する関数
 func setupDb(dbFile string) (*sql.DB, error) {
 	// データベースディレクトリが存在しない場合は作成
-	err := os.MkdirAll("./databases", os.ModePerm)
+	err := os.MkdirAll(databaseDir, os.ModePerm)
 	if err != nil {
 		return nil, fmt.Errorf("データベースディレクトリの作成に失敗: %w", err)
 	}
 
-	dbPath := fmt.Sprintf("./databases/%s", dbFile)
+	dbPath := databasePath(dbFile)
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("データベース接続に失敗: %w", err)
@@ -348,7 +368,9 @@ func insertTripUpdateResponse(db *sql.DB, response *TripUpdateResponse) error {
 	return tx.Commit()
 }
 
-// VehiclePositionResponseのデータをテーブルに挿入
+// VehiclePositionResponseのデータをテーブルに挿入。
+// 車両位置は毎回同じ entity ID で届き、最新のもののみが必要なため、前回挿入した分は削除して置き換える
+// (削除しないと2回目以降は entity の主キーが重複して保存に失敗し、最初の車両位置が残り続ける)
 func insertVehiclePositionResponse(db *sql.DB, response *VehiclePositionResponse) error {
 	tx, err := db.Begin()
 	if err != nil {
@@ -356,6 +378,16 @@ func insertVehiclePositionResponse(db *sql.DB, response *VehiclePositionResponse
 	}
 	defer tx.Rollback() // エラーが発生した場合にロールバック
 
+	for _, query := range []string{
+		`DELETE FROM vehicle_position`,
+		`DELETE FROM entity WHERE response_type = 'vehicle_position'`,
+		`DELETE FROM response_header WHERE response_type = 'vehicle_position'`,
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("前回の車両位置の削除に失敗: %w", err)
+		}
+	}
+
 	if len(response.Entity) > 0 && response.Entity[0].Vehicle != nil {
 		// response_header への挿入
 		_, err = tx.Exec(`
@@ -417,8 +449,27 @@ func insertVehiclePositionResponse(db *sql.DB, response *VehiclePositionResponse
 
 // GTFSの静的情報に関連するテーブルをまとめて作成
 func createStaticTables(db *sql.DB) error {
-	// calendar_datesテーブルを作成
+	// agencyテーブルを作成
 	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS agency (
+			agency_id TEXT PRIMARY KEY,
+			agency_name TEXT,
+			agency_url TEXT,
+			agency_timezone TEXT,
+			agency_lang TEXT,
+			agency_phone TEXT,
+			agency_fare_url TEXT,
+			agency_email TEXT,
+			feed_id TEXT
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("agencyテーブル作成に失敗: %w", err)
+	}
+	fmt.Println("agencyテーブルを作成または確認しました。")
+
+	// calendar_datesテーブルを作成
+	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS calendar_dates (
 			service_id TEXT,
 			date TEXT,
@@ -493,7 +544,8 @@ func createStaticTables(db *sql.DB) error {
 			feed_lang TEXT,
 			feed_start_date TEXT,
 			feed_end_date TEXT,
-			feed_version TEXT
+			feed_version TEXT,
+			feed_id TEXT
 		)
 	`)
 	if err != nil {
@@ -644,6 +696,18 @@ func createStaticTables(db *sql.DB) error {
 	return nil
 }
 
+// agencyテーブルにデータを挿入
+func insertAgency(db *sql.DB, a *Agency) error {
+	_, err := db.Exec(`
+		INSERT INTO agency (agency_id, agency_name, agency_url, agency_timezone, agency_lang, agency_phone, agency_fare_url, agency_email)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.AgencyID, a.AgencyName, a.AgencyURL, a.AgencyTimezone, a.AgencyLang, a.AgencyPhone, a.AgencyFareURL, a.AgencyEmail)
+	if err != nil {
+		return fmt.Errorf("agencyテーブルへのデータ挿入に失敗: %w", err)
+	}
+	return nil
+}
+
 // calendar_datesテーブルにデータを挿入
 func insertCalendarDate(db *sql.DB, cd *CalendarDate) error {
 	_, err := db.Exec(`
@@ -788,6 +852,50 @@ func insertTrip(db *sql.DB, tr *Trip) error {
 	return nil
 }
 
+// agency.txtを処理しdbを操作
+func processAgencyFile(db *sql.DB, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("agencyファイルオープンに失敗: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comma = ','
+	reader.FieldsPerRecord = -1
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("agencyレコードの読み込みに失敗: %w", err)
+		}
+		// 任意項目が省略されている場合に備えて8列に揃える
+		for len(record) < 8 {
+			record = append(record, "")
+		}
+
+		agency := &Agency{
+			AgencyID:       record[0],
+			AgencyName:     record[1],
+			AgencyURL:      record[2],
+			AgencyTimezone: record[3],
+			AgencyLang:     record[4],
+			AgencyPhone:    record[5],
+			AgencyFareURL:  record[6],
+			AgencyEmail:    record[7],
+		}
+
+		err = insertAgency(db, agency)
+		if err != nil {
+			log.Printf("agencyデータの挿入エラー: %v", err)
+		}
+	}
+	return nil
+}
+
 // calendar_dates.txtを処理しdbを操作
 func processCalendarDatesFile(db *sql.DB, filename string) error {
 	file, err := os.Open(filename)
@@ -1300,115 +1408,143 @@ func atoi(s string) int {
 }
 
 func initStaticDb(dbFile string) {
+	var err error
+
+	// 複数事業者の場合は ./static/gtfs/<フィードID> からそれぞれ取り込んで統合する
+	config := appConfig.Get()
+	if isMultiFeed(config.feeds()) {
+		err = buildMultiFeedStaticDb(dbFile, "./static/gtfs", config.feeds())
+	} else {
+		err = buildStaticDb(dbFile, "./static/gtfs")
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// buildStaticDb は gtfsDir に展開された静的GTFSファイルから dbFile を作成する
+func buildStaticDb(dbFile string, gtfsDir string) error {
 
 	db, err := setupDb(dbFile)
 	if err != nil {
-		log.Fatalf("データベース接続に失敗: %v", err)
+		return fmt.Errorf("データベース接続に失敗: %w", err)
 	}
 	defer db.Close()
 
 	err = createStaticTables(db)
 	if err != nil {
-		log.Fatalf("routesテーブルの作成に失敗: %v", err)
+		return fmt.Errorf("routesテーブルの作成に失敗: %w", err)
 	}
 
 	db.Exec("DROP DATABASE IF EXISTS")
 
+	// agency.txt の処理 (任意)
+	agencyFile := filepath.Join(gtfsDir, "agency.txt")
+	if _, err := os.Stat(agencyFile); err == nil {
+		err = processAgencyFile(db, agencyFile)
+		if err != nil {
+			return fmt.Errorf("agencyファイルの処理に失敗: %w", err)
+		}
+		fmt.Println("agencyデータの登録が完了しました。")
+	}
+
 	// calendar_dates.txt の処理
-	calendarDatesFile := "./static/gtfs/calendar_dates.txt"
+	calendarDatesFile := filepath.Join(gtfsDir, "calendar_dates.txt")
 	err = processCalendarDatesFile(db, calendarDatesFile)
 	if err != nil {
-		log.Fatalf("calendar_datesファイルの処理に失敗: %v", err)
+		return fmt.Errorf("calendar_datesファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("calendar_datesデータの登録が完了しました。")
 
 	// calendar.txt の処理
-	calendarFile := "./static/gtfs/calendar.txt"
+	calendarFile := filepath.Join(gtfsDir, "calendar.txt")
 	err = processCalendarFile(db, calendarFile)
 	if err != nil {
-		log.Fatalf("calendarファイルの処理に失敗: %v", err)
+		return fmt.Errorf("calendarファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("calendarデータの登録が完了しました。")
 
 	// fare_attributes.txt の処理
-	fareAttributesFile := "./static/gtfs/fare_attributes.txt"
+	fareAttributesFile := filepath.Join(gtfsDir, "fare_attributes.txt")
 	err = processFareAttributesFile(db, fareAttributesFile)
 	if err != nil {
-		log.Fatalf("fare_attributeファイルの処理に失敗: %v", err)
+		return fmt.Errorf("fare_attributeファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("fare_attributeデータの登録が完了しました。")
 
 	// fare_rules.txt の処理
-	fareRulesFile := "./static/gtfs/fare_rules.txt"
+	fareRulesFile := filepath.Join(gtfsDir, "fare_rules.txt")
 	err = processFareRulesFile(db, fareRulesFile)
 	if err != nil {
-		log.Fatalf("fare_rulesファイルの処理に失敗: %v", err)
+		return fmt.Errorf("fare_rulesファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("fare_rulesデータの登録が完了しました。")
 
 	// feed_info.txt の処理
-	feedInfoFile := "./static/gtfs/feed_info.txt"
+	feedInfoFile := filepath.Join(gtfsDir, "feed_info.txt")
 	err = processFeedInfoFile(db, feedInfoFile)
 	if err != nil {
-		log.Fatalf("feed_infoファイルの処理に失敗: %v", err)
+		return fmt.Errorf("feed_infoファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("feed_infoデータの登録が完了しました。")
 
 	// office_jp.txt の処理
-	officeJPFile := "./static/gtfs/office_jp.txt"
+	officeJPFile := filepath.Join(gtfsDir, "office_jp.txt")
 	err = processOfficeJPFile(db, officeJPFile)
 	if err != nil {
-		log.Fatalf("office_jpファイルの処理に失敗: %v", err)
+		return fmt.Errorf("office_jpファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("office_jpデータの登録が完了しました。")
 
 	// routes.txt の処理
-	routesFile := "./static/gtfs/routes.txt"
+	routesFile := filepath.Join(gtfsDir, "routes.txt")
 	err = processRoutesFile(db, routesFile)
 	if err != nil {
-		log.Fatalf("routesファイルの処理に失敗: %v", err)
+		return fmt.Errorf("routesファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("routesデータの登録が完了しました。")
 
 	// shapes.txt の処理
-	shapesFile := "./static/gtfs/shapes.txt"
+	shapesFile := filepath.Join(gtfsDir, "shapes.txt")
 	err = processShapesFile(db, shapesFile)
 	if err != nil {
-		log.Fatalf("shapesファイルの処理に失敗: %v", err)
+		return fmt.Errorf("shapesファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("shapesデータの登録が完了しました。")
 
 	// stops.txt の処理
-	stopsFile := "./static/gtfs/stops.txt"
+	stopsFile := filepath.Join(gtfsDir, "stops.txt")
 	err = processStopsFile(db, stopsFile)
 	if err != nil {
-		log.Fatalf("stopsファイルの処理に失敗: %v", err)
+		return fmt.Errorf("stopsファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("stopsデータの登録が完了しました。")
 
 	// stop_times.txt の処理
-	stopTimesFile := "./static/gtfs/stop_times.txt"
+	stopTimesFile := filepath.Join(gtfsDir, "stop_times.txt")
 	err = processStopTimesFile(db, stopTimesFile)
 	if err != nil {
-		log.Fatalf("stop_timesファイルの処理に失敗: %v", err)
+		return fmt.Errorf("stop_timesファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("stop_timesデータの登録が完了しました。")
 
 	// translations.txt の処理
-	translationsFile := "./static/gtfs/translations.txt"
+	translationsFile := filepath.Join(gtfsDir, "translations.txt")
 	err = processTranslationsFile(db, translationsFile)
 	if err != nil {
-		log.Fatalf("translationsファイルの処理に失敗: %v", err)
+		return fmt.Errorf("translationsファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("translationsデータの登録が完了しました。")
 
 	// trips.txt の処理
-	tripsFile := "./static/gtfs/trips.txt"
+	tripsFile := filepath.Join(gtfsDir, "trips.txt")
 	err = processTripsFile(db, tripsFile)
 	if err != nil {
-		log.Fatalf("tripsファイルの処理に失敗: %v", err)
+		return fmt.Errorf("tripsファイルの処理に失敗: %w", err)
 	}
 	fmt.Println("tripsデータの登録が完了しました。")
+
+	return nil
 }
 
 func initDynamicDb(dbFile string) {
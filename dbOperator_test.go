@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testVehiclePositions(t *testing.T, timestamp string, stopSequence int) *VehiclePositionResponse {
+	t.Helper()
+
+	var response VehiclePositionResponse
+	data := `{"entity":[{"id":"v1","vehicle":{"id":"v1","timestamp":"` + timestamp + `","currentStopSequence":` + strconv.Itoa(stopSequence) + `,"trip":{"tripId":"t1"}}}]}`
+	if err := json.Unmarshal([]byte(data), &response); err != nil {
+		t.Fatal(err)
+	}
+	return &response
+}
+
+func TestInsertVehiclePositionResponseReplaces(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "dynamic.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := createDynamicTables(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じ entity の車両位置が毎回届くため、2回目以降も保存できること
+	if err := insertVehiclePositionResponse(db, testVehiclePositions(t, "100", 1)); err != nil {
+		t.Fatalf("1回目: %v", err)
+	}
+	if err := insertVehiclePositionResponse(db, testVehiclePositions(t, "130", 2)); err != nil {
+		t.Fatalf("2回目: %v", err)
+	}
+
+	var count int
+	var stopSequence int64
+	if err := db.QueryRow(`SELECT COUNT(*), MAX(current_stop_sequence) FROM vehicle_position`).Scan(&count, &stopSequence); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || stopSequence != 2 {
+		t.Errorf("vehicle_position = %d 件, current_stop_sequence = %d", count, stopSequence)
+	}
+
+	var headers int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM response_header WHERE response_type = 'vehicle_position'`).Scan(&headers); err != nil {
+		t.Fatal(err)
+	}
+	if headers != 1 {
+		t.Errorf("response_header = %d 件", headers)
+	}
+}
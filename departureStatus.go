@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 発車標に表示する便の運行状況
+//
+// TripUpdate の schedule_relationship、departure_delay と車両の current_stop_sequence から判定する。
+// 「まもなく」と発車済・運休の表示時間の閾値は display.departingThreshold と display.departedRetention で変更できる。
+
+type DepartureStatus string
+
+const (
+	departureOnTime DepartureStatus = "on_time"
+	// display.delayThreshold を超えて遅れている
+	departureDelayed DepartureStatus = "delayed"
+	// 出発予定まで display.departingThreshold 秒以内
+	departureDeparting DepartureStatus = "departing"
+	// 車両がこの停留所を通過した
+	departureDeparted DepartureStatus = "departed"
+	// 便の運休 (CANCELED, DELETED) またはこの停留所の通過 (SKIPPED)
+	departureCancelled DepartureStatus = "cancelled"
+	// 車両が始発の停留所で出発を待っている
+	departureWaiting DepartureStatus = "waiting"
+	// 時刻表にない臨時便 (ADDED)
+	departureAdded DepartureStatus = "added"
+)
+
+// departureFacts は運行状況の判定に使う便の情報
+type departureFacts struct {
+	// 時刻表の出発時刻と遅延 (秒)
+	Scheduled time.Time
+	Delay     int
+	// この停留所、始発の停留所、車両の現在地 (不明な場合は 0) の stop_sequence
+	StopSequence        int64
+	FirstStopSequence   int64
+	VehicleStopSequence int64
+	TripRelationship    gtfsEnum
+	StopRelationship    gtfsEnum
+}
+
+// expected は遅延を反映した出発予定時刻を返す
+func (f departureFacts) expected() time.Time {
+	return f.Scheduled.Add(time.Duration(f.Delay) * time.Second)
+}
+
+// classifyDeparture は便の運行状況を判定する。複数に該当する場合は運休、発車済、まもなく、始発待ち、遅延、臨時便の順に優先する。
+// 発車済は車両の現在地がこの停留所を過ぎた場合のみとし、出発予定時刻を過ぎても車両が停留所の手前にいる間は
+// 「まもなく」のままにする (遅延の情報は車両位置より遅れて届くことがあり、まだ乗れる便を発車済と表示しないため)。
+// そのような便も出発予定時刻から display.departedRetention 秒を過ぎると visible で表示しなくなる
+func classifyDeparture(f departureFacts, display DisplayConfig, now time.Time) DepartureStatus {
+	switch {
+	case f.TripRelationship.is("CANCELED", 3) || f.TripRelationship.is("DELETED", 7) || f.StopRelationship.is("SKIPPED", 1):
+		return departureCancelled
+	case f.VehicleStopSequence > f.StopSequence:
+		return departureDeparted
+	case f.expected().Sub(now) <= time.Duration(*display.DepartingThreshold)*time.Second:
+		return departureDeparting
+	case f.VehicleStopSequence > 0 && f.VehicleStopSequence <= f.FirstStopSequence && f.StopSequence > f.FirstStopSequence:
+		return departureWaiting
+	case f.Delay > *display.DelayThreshold:
+		return departureDelayed
+	case f.TripRelationship.is("ADDED", 1):
+		return departureAdded
+	}
+	return departureOnTime
+}
+
+// visible は発車標に表示し続けるかを返す。出発予定時刻から display.departedRetention 秒を過ぎた便は表示しない
+func (f departureFacts) visible(display DisplayConfig, now time.Time) bool {
+	return !f.expected().Before(now.Add(-time.Duration(*display.DepartedRetention) * time.Second))
+}
+
+// departureStatusLabel は運行状況の表示名を返す
+func departureStatusLabel(status DepartureStatus, delay int) string {
+	switch status {
+	case departureDelayed:
+		return fmt.Sprintf("遅れ 約%d分", delay/60)
+	case departureDeparting:
+		return "まもなく発車"
+	case departureDeparted:
+		return "発車済"
+	case departureCancelled:
+		return "運休"
+	case departureWaiting:
+		return "始発待ち"
+	case departureAdded:
+		return "臨時便"
+	}
+	return "定刻"
+}
+
+// realtimeRelationships は TripUpdate の便・停留所ごとの schedule_relationship
+type realtimeRelationships struct {
+	trips map[string]gtfsEnum
+	// trip_id -> stop_sequence -> schedule_relationship
+	stops map[string]map[int64]gtfsEnum
+}
+
+func newRealtimeRelationships(response *TripUpdateResponse) realtimeRelationships {
+	rel := realtimeRelationships{trips: make(map[string]gtfsEnum), stops: make(map[string]map[int64]gtfsEnum)}
+	for _, entity := range response.Entity {
+		if entity.TripUpdate == nil {
+			continue
+		}
+		tripID := entity.TripUpdate.Trip.TripID
+		if entity.TripUpdate.Trip.ScheduleRelationship != "" {
+			rel.trips[tripID] = entity.TripUpdate.Trip.ScheduleRelationship
+		}
+		for _, stu := range entity.TripUpdate.StopTimeUpdate {
+			if stu.ScheduleRelationship == "" {
+				continue
+			}
+			if rel.stops[tripID] == nil {
+				rel.stops[tripID] = make(map[int64]gtfsEnum)
+			}
+			rel.stops[tripID][int64(stu.StopSequence)] = stu.ScheduleRelationship
+		}
+	}
+	return rel
+}
+
+// cancelledTrips は運休になった便の trip_id を順に返す (運休の便は車両位置がないため別に表示する)。
+// display.maxRows で打ち切っても毎回同じ便が選ばれるよう並べ替える
+func (rel realtimeRelationships) cancelledTrips() []string {
+	tripIDs := make([]string, 0)
+	for tripID, r := range rel.trips {
+		if r.is("CANCELED", 3) || r.is("DELETED", 7) {
+			tripIDs = append(tripIDs, tripID)
+		}
+	}
+	sort.Strings(tripIDs)
+	return tripIDs
+}
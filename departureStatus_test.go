@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testDisplayConfig() DisplayConfig {
+	return DisplayConfig{
+		DelayThreshold:     optionalInt(60),
+		DepartingThreshold: optionalInt(120),
+		DepartedRetention:  optionalInt(60),
+	}
+}
+
+func TestClassifyDeparture(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	scheduled := now.Add(10 * time.Minute)
+
+	tests := []struct {
+		name  string
+		facts departureFacts
+		want  DepartureStatus
+	}{
+		{"定刻", departureFacts{Scheduled: scheduled, StopSequence: 5, FirstStopSequence: 1, VehicleStopSequence: 3}, departureOnTime},
+		{"遅延", departureFacts{Scheduled: scheduled, Delay: 180, StopSequence: 5, FirstStopSequence: 1, VehicleStopSequence: 3}, departureDelayed},
+		{"閾値以下の遅延", departureFacts{Scheduled: scheduled, Delay: 60, StopSequence: 5, VehicleStopSequence: 3}, departureOnTime},
+		{"まもなく", departureFacts{Scheduled: now.Add(2 * time.Minute), StopSequence: 5, VehicleStopSequence: 4}, departureDeparting},
+		{"遅延を含めるとまもなくではない", departureFacts{Scheduled: now.Add(2 * time.Minute), Delay: 300, StopSequence: 5, VehicleStopSequence: 4}, departureDelayed},
+		// 出発予定時刻を過ぎても、車両が停留所の手前にいる間は発車済にしない
+		{"出発予定時刻を過ぎても車両が手前", departureFacts{Scheduled: now.Add(-time.Minute), StopSequence: 5, VehicleStopSequence: 5}, departureDeparting},
+		{"発車済", departureFacts{Scheduled: scheduled, StopSequence: 5, VehicleStopSequence: 6}, departureDeparted},
+		{"始発待ち", departureFacts{Scheduled: scheduled, StopSequence: 5, FirstStopSequence: 1, VehicleStopSequence: 1}, departureWaiting},
+		{"始発の停留所では始発待ちにしない", departureFacts{Scheduled: scheduled, StopSequence: 1, FirstStopSequence: 1, VehicleStopSequence: 1}, departureOnTime},
+		{"車両位置が不明", departureFacts{Scheduled: scheduled, StopSequence: 5, FirstStopSequence: 1}, departureOnTime},
+		{"臨時便", departureFacts{Scheduled: scheduled, StopSequence: 5, VehicleStopSequence: 3, TripRelationship: "ADDED"}, departureAdded},
+		{"運休 (名前)", departureFacts{Scheduled: scheduled, StopSequence: 5, TripRelationship: "CANCELED"}, departureCancelled},
+		{"運休 (番号)", departureFacts{Scheduled: scheduled, StopSequence: 5, TripRelationship: "3"}, departureCancelled},
+		{"削除", departureFacts{Scheduled: scheduled, StopSequence: 5, TripRelationship: "DELETED"}, departureCancelled},
+		{"通過", departureFacts{Scheduled: scheduled, StopSequence: 5, VehicleStopSequence: 3, StopRelationship: "SKIPPED"}, departureCancelled},
+		{"運休は発車済より優先", departureFacts{Scheduled: scheduled, StopSequence: 5, VehicleStopSequence: 6, TripRelationship: "CANCELED"}, departureCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyDeparture(tt.facts, testDisplayConfig(), now); got != tt.want {
+				t.Errorf("classifyDeparture() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// 閾値が 0 の場合は出発予定時刻を過ぎるまで「まもなく」にしない
+	display := testDisplayConfig()
+	display.DepartingThreshold = optionalInt(0)
+	facts := departureFacts{Scheduled: now.Add(time.Minute), StopSequence: 5, VehicleStopSequence: 4}
+	if got := classifyDeparture(facts, display, now); got != departureOnTime {
+		t.Errorf("departingThreshold = 0 の場合 = %s", got)
+	}
+}
+
+func TestDepartureVisible(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		scheduled time.Time
+		delay     int
+		retention int
+		want      bool
+	}{
+		{"これから出発", now.Add(time.Minute), 0, 60, true},
+		{"表示時間内", now.Add(-59 * time.Second), 0, 60, true},
+		{"表示時間ちょうど", now.Add(-60 * time.Second), 0, 60, true},
+		{"表示時間を過ぎた", now.Add(-61 * time.Second), 0, 60, false},
+		{"遅延を含めると表示時間内", now.Add(-5 * time.Minute), 270, 60, true},
+		{"表示時間が 0", now.Add(-time.Second), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			display := testDisplayConfig()
+			display.DepartedRetention = optionalInt(tt.retention)
+			facts := departureFacts{Scheduled: tt.scheduled, Delay: tt.delay}
+			if got := facts.visible(display, now); got != tt.want {
+				t.Errorf("visible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGtfsEnum(t *testing.T) {
+	tests := []struct {
+		json   string
+		name   string
+		number int
+		want   bool
+	}{
+		{`"CANCELED"`, "CANCELED", 3, true},
+		{`3`, "CANCELED", 3, true},
+		{`"SCHEDULED"`, "CANCELED", 3, false},
+		{`0`, "CANCELED", 3, false},
+		{`1`, "SKIPPED", 1, true},
+		{`"SKIPPED"`, "SKIPPED", 1, true},
+	}
+	for _, tt := range tests {
+		var e gtfsEnum
+		if err := json.Unmarshal([]byte(tt.json), &e); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.json, err)
+			continue
+		}
+		if got := e.is(tt.name, tt.number); got != tt.want {
+			t.Errorf("%s.is(%q, %d) = %v, want %v", tt.json, tt.name, tt.number, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{`true`, `{}`, `1.5`} {
+		var e gtfsEnum
+		if err := json.Unmarshal([]byte(invalid), &e); err == nil {
+			t.Errorf("Unmarshal(%s) にエラーがありません", invalid)
+		}
+	}
+}
+
+func TestCancelledTripsSorted(t *testing.T) {
+	var response TripUpdateResponse
+	data := `{"entity":[
+		{"id":"1","tripUpdate":{"trip":{"tripId":"c","scheduleRelationship":"CANCELED"}}},
+		{"id":"2","tripUpdate":{"trip":{"tripId":"a","scheduleRelationship":3}}},
+		{"id":"3","tripUpdate":{"trip":{"tripId":"d","scheduleRelationship":"SCHEDULED"}}},
+		{"id":"4","tripUpdate":{"trip":{"tripId":"b","scheduleRelationship":"DELETED"}}}
+	]}`
+	if err := json.Unmarshal([]byte(data), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	rel := newRealtimeRelationships(&response)
+	for range 10 {
+		if got := strings.Join(rel.cancelledTrips(), ","); got != "a,b,c" {
+			t.Fatalf("cancelledTrips() = %s", got)
+		}
+	}
+}
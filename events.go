@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server-Sent Events の切断後、ブラウザが再接続するまでの時間 (ミリ秒)
+const sseRetry int = 5000
+
+// boardAPIHandler は最新の運行情報を websocket と同じ形式 (wsEnvelope) で返す。
+// If-None-Match が一致すれば 304 を返すため、ポーリングするクライアントは毎回本文を受け取らずに済む
+func boardAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	board := hub.Latest()
+	if board == nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "運行情報を準備中です", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("ETag", board.etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), board.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(board.data)
+}
+
+// etagMatches は If-None-Match ヘッダに etag が含まれるかを返す (弱い比較)
+func etagMatches(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// eventsHandler は運行情報を Server-Sent Events で配信する。
+// websocket と同じく hub に登録し、board と heartbeat を data 行で送る
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := clientIP(r)
+	if err := acquireConnection(ip); err != nil {
+		log.Printf("Server-Sent Events の接続を拒否しました: %v", err)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseConnection(ip)
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// リバースプロキシにバッファリングさせない
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	if err := rc.Flush(); err != nil {
+		log.Printf("Server-Sent Events に対応していない接続です (%s): %v", ip, err)
+		return
+	}
+
+	client := &hubClient{hub: hub, ip: ip, send: make(chan []byte, wsSendBuffer)}
+	hub.register <- client
+	defer func() {
+		hub.unregister <- client
+	}()
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				// hub が登録を解除した (送信が追いつかない)
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", message); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
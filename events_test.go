@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestBoardHub は /api/board と /events が参照する hub をテスト用に差し替える
+func useTestBoardHub(t *testing.T) *Hub {
+	t.Helper()
+
+	c := &Config{}
+	applyConfigDefaults(c)
+	prevConfig := appConfig
+	appConfig = &ConfigManager{}
+	appConfig.current.Store(c)
+
+	prev := hub
+	hub = newHub()
+	go hub.run()
+	t.Cleanup(func() {
+		hub = prev
+		appConfig = prevConfig
+	})
+	return hub
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{``, false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`*`, true},
+		{`"x", "abc"`, true},
+		{`"x",W/"abc"`, true},
+		{`"x", "y"`, false},
+		{`"abcd"`, false},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestBoardAPIHandler(t *testing.T) {
+	h := useTestBoardHub(t)
+
+	// 最初の配信までは準備中
+	rec := httptest.NewRecorder()
+	boardAPIHandler(rec, httptest.NewRequest(http.MethodGet, "/api/board", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("配信前の status = %d", rec.Code)
+	}
+
+	message, err := newBoardMessage(1, []TimeTable{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.broadcast <- message
+	syncHub(h)
+
+	tests := []struct {
+		name        string
+		method      string
+		ifNoneMatch string
+		want        int
+		wantBody    bool
+	}{
+		{"条件なし", http.MethodGet, "", http.StatusOK, true},
+		{"一致", http.MethodGet, message.etag, http.StatusNotModified, false},
+		{"弱いETag", http.MethodGet, "W/" + message.etag, http.StatusNotModified, false},
+		{"ワイルドカード", http.MethodGet, "*", http.StatusNotModified, false},
+		{"リスト", http.MethodGet, `"old", ` + message.etag, http.StatusNotModified, false},
+		{"不一致", http.MethodGet, `"old"`, http.StatusOK, true},
+		{"HEAD", http.MethodHead, "", http.StatusOK, false},
+		{"POST", http.MethodPost, "", http.StatusMethodNotAllowed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/board", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			boardAPIHandler(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want != http.StatusMethodNotAllowed && rec.Header().Get("ETag") != message.etag {
+				t.Errorf("ETag = %q, want %q", rec.Header().Get("ETag"), message.etag)
+			}
+			if got := rec.Body.Len() > 0; got != tt.wantBody {
+				t.Errorf("本文の有無 = %v, want %v", got, tt.wantBody)
+			}
+			if tt.want == http.StatusOK && tt.wantBody && rec.Body.String() != string(message.data) {
+				t.Errorf("本文 = %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	h := useTestBoardHub(t)
+	h.broadcast <- testHubMessage(1)
+
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	t.Cleanup(func() {
+		server.Close()
+		// hub を元に戻す前に接続の終了を待つ
+		waitForConnections(t, 0)
+	})
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	// readEvent は heartbeat を読み飛ばして次の data 行を返す
+	readEvent := func() string {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatal("接続が閉じられました")
+				}
+				if strings.HasPrefix(line, "data: ") && !strings.Contains(line, `"type":"heartbeat"`) {
+					return strings.TrimPrefix(line, "data: ")
+				}
+			case <-timeout:
+				t.Fatal("イベントを受信できません")
+			}
+		}
+	}
+
+	// 接続直後に最新の board を受け取り、その後は配信のたびに受け取る
+	if got := readEvent(); got != string(testHubMessage(1).data) {
+		t.Errorf("接続直後のイベント = %s", got)
+	}
+	h.broadcast <- testHubMessage(2)
+	if got := readEvent(); got != string(testHubMessage(2).data) {
+		t.Errorf("配信されたイベント = %s", got)
+	}
+}
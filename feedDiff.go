@@ -0,0 +1,573 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 差し替え前の静的DB (差分表示用)
+const previousStaticDbFile string = "static-prev.sql"
+
+// feedSnapshot は差分比較に必要な静的フィードの内容を保持する
+type feedSnapshot struct {
+	FeedVersion string
+	Routes      map[string]string // route_id -> 路線名
+	Stops       map[string]string // stop_id -> 停留所名
+	Trips       map[string]*snapshotTrip
+}
+
+type snapshotTrip struct {
+	RouteID  string
+	Headsign string
+	Times    map[stopCall]string // 停車 -> departure_time
+}
+
+// stopCall は便の停車を停留所IDと、その停留所への何回目の停車かで識別する。
+// 循環便は同じ停留所に2回停車するため、停留所IDだけでは区別できない。
+// stop_sequence はフィードの版で振り直されることがあるため、キーには使わない
+type stopCall struct {
+	StopID     string
+	Occurrence int
+}
+
+// snapshotStopTime は読み込み中の stop_times の1行
+type snapshotStopTime struct {
+	sequence  int
+	stopID    string
+	departure string
+}
+
+// setStopTimes は便ごとの停車を stop_sequence 順に並べ、停車ごとの時刻を Times に入れる
+func (s *feedSnapshot) setStopTimes(stopTimes map[string][]snapshotStopTime) {
+	for tripID, times := range stopTimes {
+		t, ok := s.Trips[tripID]
+		if !ok {
+			continue
+		}
+		sort.SliceStable(times, func(i, j int) bool { return times[i].sequence < times[j].sequence })
+		for _, st := range times {
+			call := stopCall{StopID: st.stopID}
+			for {
+				if _, ok := t.Times[call]; !ok {
+					break
+				}
+				call.Occurrence++
+			}
+			t.Times[call] = st.departure
+		}
+	}
+}
+
+// FeedDiff は2つの静的フィードの差分
+type FeedDiff struct {
+	OldVersion  string      `json:"old_version"`
+	NewVersion  string      `json:"new_version"`
+	StopFilter  []string    `json:"stop_filter,omitempty"`
+	GeneratedAt string      `json:"generated_at"`
+	Routes      []RouteDiff `json:"routes"`
+	Stops       []StopDiff  `json:"stops"`
+}
+
+// RouteDiff は路線ごとの差分の集計
+type RouteDiff struct {
+	RouteID      string `json:"route_id"`
+	Name         string `json:"name"`
+	Status       string `json:"status"` // added, removed, changed
+	TripsAdded   int    `json:"trips_added"`
+	TripsRemoved int    `json:"trips_removed"`
+	TripsRetimed int    `json:"trips_retimed"`
+}
+
+// StopDiff は停留所ごとの差分の集計
+type StopDiff struct {
+	StopID            string `json:"stop_id"`
+	Name              string `json:"name"`
+	Status            string `json:"status"` // added, removed, changed
+	DeparturesAdded   int    `json:"departures_added"`
+	DeparturesRemoved int    `json:"departures_removed"`
+	DeparturesRetimed int    `json:"departures_retimed"`
+}
+
+// loadFeedSnapshot は静的DBファイル、または展開済みのGTFSディレクトリを読み込む
+func loadFeedSnapshot(source string) (*feedSnapshot, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("比較対象が見つかりません: %w", err)
+	}
+	if info.IsDir() {
+		return loadSnapshotFromDir(source)
+	}
+	return loadSnapshotFromDb(source)
+}
+
+func newFeedSnapshot() *feedSnapshot {
+	return &feedSnapshot{
+		Routes: make(map[string]string),
+		Stops:  make(map[string]string),
+		Trips:  make(map[string]*snapshotTrip),
+	}
+}
+
+func loadSnapshotFromDb(path string) (*feedSnapshot, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("データベース接続に失敗: %w", err)
+	}
+	defer db.Close()
+
+	s := newFeedSnapshot()
+
+	// feed_info.txt は任意のファイルのため、行がなければバージョンは空のままにする
+	err = db.QueryRow(`SELECT COALESCE(feed_version, '') FROM feed_info WHERE feed_start_date GLOB '[0-9]*' LIMIT 1`).Scan(&s.FeedVersion)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("feed_infoの取得に失敗: %w", err)
+	}
+
+	rows, err := db.Query(`SELECT route_id, COALESCE(route_long_name, ''), COALESCE(route_short_name, '') FROM routes`)
+	if err != nil {
+		return nil, fmt.Errorf("routesの取得に失敗: %w", err)
+	}
+	for rows.Next() {
+		var id, longName, shortName string
+		if err := rows.Scan(&id, &longName, &shortName); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		s.Routes[id] = routeDisplayName(longName, shortName)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT stop_id, COALESCE(stop_name, '') FROM stops`)
+	if err != nil {
+		return nil, fmt.Errorf("stopsの取得に失敗: %w", err)
+	}
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		s.Stops[id] = name
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT trip_id, COALESCE(route_id, ''), COALESCE(trip_headsign, '') FROM trips`)
+	if err != nil {
+		return nil, fmt.Errorf("tripsの取得に失敗: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		t := &snapshotTrip{Times: make(map[stopCall]string)}
+		if err := rows.Scan(&id, &t.RouteID, &t.Headsign); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		s.Trips[id] = t
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT trip_id, COALESCE(stop_sequence, 0), COALESCE(stop_id, ''), COALESCE(departure_time, '') FROM stop_times`)
+	if err != nil {
+		return nil, fmt.Errorf("stop_timesの取得に失敗: %w", err)
+	}
+	defer rows.Close()
+	stopTimes := make(map[string][]snapshotStopTime)
+	for rows.Next() {
+		var tripID string
+		var st snapshotStopTime
+		if err := rows.Scan(&tripID, &st.sequence, &st.stopID, &st.departure); err != nil {
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		stopTimes[tripID] = append(stopTimes[tripID], st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("行の反復処理中にエラーが発生しました: %w", err)
+	}
+	s.setStopTimes(stopTimes)
+
+	return s, nil
+}
+
+func loadSnapshotFromDir(dir string) (*feedSnapshot, error) {
+	s := newFeedSnapshot()
+
+	err := readGtfsCsv(dir, "feed_info.txt", func(rec map[string]string) {
+		if s.FeedVersion == "" {
+			s.FeedVersion = rec["feed_version"]
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := readGtfsCsv(dir, "routes.txt", func(rec map[string]string) {
+		s.Routes[rec["route_id"]] = routeDisplayName(rec["route_long_name"], rec["route_short_name"])
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := readGtfsCsv(dir, "stops.txt", func(rec map[string]string) {
+		s.Stops[rec["stop_id"]] = rec["stop_name"]
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := readGtfsCsv(dir, "trips.txt", func(rec map[string]string) {
+		s.Trips[rec["trip_id"]] = &snapshotTrip{
+			RouteID:  rec["route_id"],
+			Headsign: rec["trip_headsign"],
+			Times:    make(map[stopCall]string),
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	stopTimes := make(map[string][]snapshotStopTime)
+	if err := readGtfsCsv(dir, "stop_times.txt", func(rec map[string]string) {
+		// stop_sequence が数値でない行は0番目として扱う (並び順はファイルの順になる)
+		sequence, _ := strconv.Atoi(strings.TrimSpace(rec["stop_sequence"]))
+		stopTimes[rec["trip_id"]] = append(stopTimes[rec["trip_id"]], snapshotStopTime{
+			sequence:  sequence,
+			stopID:    rec["stop_id"],
+			departure: rec["departure_time"],
+		})
+	}); err != nil {
+		return nil, err
+	}
+	s.setStopTimes(stopTimes)
+
+	return s, nil
+}
+
+// readGtfsCsv はヘッダ付きのGTFSファイルを1行ずつ読み込み、カラム名をキーにして fn に渡す
+func readGtfsCsv(dir, name string, fn func(map[string]string)) error {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%sのヘッダ読み込みに失敗: %w", name, err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%sレコードの読み込みに失敗: %w", name, err)
+		}
+
+		rec := make(map[string]string, len(header))
+		for i, col := range header {
+			if i < len(record) {
+				rec[col] = record[i]
+			}
+		}
+		fn(rec)
+	}
+	return nil
+}
+
+func routeDisplayName(longName, shortName string) string {
+	if longName != "" {
+		return longName
+	}
+	return shortName
+}
+
+// diffFeedSnapshots は2つのフィードを比較し、路線・停留所ごとに集計する。
+// stopNames が空でない場合は、いずれかの名前の停留所に停車する便のみを対象にする。
+func diffFeedSnapshots(oldFeed, newFeed *feedSnapshot, stopNames []string) *FeedDiff {
+	diff := &FeedDiff{
+		OldVersion:  oldFeed.FeedVersion,
+		NewVersion:  newFeed.FeedVersion,
+		StopFilter:  stopNames,
+		GeneratedAt: time.Now().Format(time.RFC3339),
+		Routes:      make([]RouteDiff, 0),
+		Stops:       make([]StopDiff, 0),
+	}
+
+	routes := make(map[string]*RouteDiff)
+	stops := make(map[string]*StopDiff)
+
+	routeDiff := func(id string) *RouteDiff {
+		if r, ok := routes[id]; ok {
+			return r
+		}
+		r := &RouteDiff{RouteID: id, Name: newFeed.Routes[id], Status: "changed"}
+		if r.Name == "" {
+			r.Name = oldFeed.Routes[id]
+		}
+		routes[id] = r
+		return r
+	}
+	stopDiff := func(id string) *StopDiff {
+		if s, ok := stops[id]; ok {
+			return s
+		}
+		s := &StopDiff{StopID: id, Name: newFeed.Stops[id], Status: "changed"}
+		if s.Name == "" {
+			s.Name = oldFeed.Stops[id]
+		}
+		stops[id] = s
+		return s
+	}
+
+	filter := make(map[string]bool, len(stopNames))
+	for _, name := range stopNames {
+		filter[name] = true
+	}
+	matchesName := func(name string) bool {
+		return len(filter) == 0 || filter[name]
+	}
+	// 対象の停留所に停車するかどうか
+	servesStop := func(feed *feedSnapshot, t *snapshotTrip) bool {
+		if len(filter) == 0 {
+			return true
+		}
+		for call := range t.Times {
+			if filter[feed.Stops[call.StopID]] {
+				return true
+			}
+		}
+		return false
+	}
+	inScope := func(feed *feedSnapshot, stopID string) bool {
+		return matchesName(feed.Stops[stopID])
+	}
+
+	for id, oldTrip := range oldFeed.Trips {
+		newTrip, ok := newFeed.Trips[id]
+		if !ok {
+			if !servesStop(oldFeed, oldTrip) {
+				continue
+			}
+			routeDiff(oldTrip.RouteID).TripsRemoved++
+			for call := range oldTrip.Times {
+				if inScope(oldFeed, call.StopID) {
+					stopDiff(call.StopID).DeparturesRemoved++
+				}
+			}
+			continue
+		}
+
+		if !servesStop(oldFeed, oldTrip) && !servesStop(newFeed, newTrip) {
+			continue
+		}
+
+		retimed := false
+		for call, oldTime := range oldTrip.Times {
+			newTime, ok := newTrip.Times[call]
+			switch {
+			case !ok:
+				if inScope(oldFeed, call.StopID) {
+					stopDiff(call.StopID).DeparturesRemoved++
+				}
+				retimed = true
+			case newTime != oldTime:
+				if inScope(newFeed, call.StopID) {
+					stopDiff(call.StopID).DeparturesRetimed++
+				}
+				retimed = true
+			}
+		}
+		for call := range newTrip.Times {
+			if _, ok := oldTrip.Times[call]; !ok {
+				if inScope(newFeed, call.StopID) {
+					stopDiff(call.StopID).DeparturesAdded++
+				}
+				retimed = true
+			}
+		}
+		if retimed {
+			routeDiff(newTrip.RouteID).TripsRetimed++
+		}
+	}
+
+	for id, newTrip := range newFeed.Trips {
+		if _, ok := oldFeed.Trips[id]; ok || !servesStop(newFeed, newTrip) {
+			continue
+		}
+		routeDiff(newTrip.RouteID).TripsAdded++
+		for call := range newTrip.Times {
+			if inScope(newFeed, call.StopID) {
+				stopDiff(call.StopID).DeparturesAdded++
+			}
+		}
+	}
+
+	// 路線・停留所そのものの追加と削除
+	for id := range newFeed.Routes {
+		if _, ok := oldFeed.Routes[id]; ok {
+			continue
+		}
+		if r, ok := routes[id]; ok {
+			r.Status = "added"
+		} else if len(filter) == 0 {
+			routeDiff(id).Status = "added"
+		}
+	}
+	for id := range oldFeed.Routes {
+		if _, ok := newFeed.Routes[id]; ok {
+			continue
+		}
+		if r, ok := routes[id]; ok {
+			r.Status = "removed"
+		} else if len(filter) == 0 {
+			routeDiff(id).Status = "removed"
+		}
+	}
+	for id, name := range newFeed.Stops {
+		if _, ok := oldFeed.Stops[id]; !ok && matchesName(name) {
+			stopDiff(id).Status = "added"
+		}
+	}
+	for id, name := range oldFeed.Stops {
+		if _, ok := newFeed.Stops[id]; !ok && matchesName(name) {
+			stopDiff(id).Status = "removed"
+		}
+	}
+
+	for _, r := range routes {
+		diff.Routes = append(diff.Routes, *r)
+	}
+	for _, s := range stops {
+		diff.Stops = append(diff.Stops, *s)
+	}
+	sort.Slice(diff.Routes, func(i, j int) bool { return diff.Routes[i].RouteID < diff.Routes[j].RouteID })
+	sort.Slice(diff.Stops, func(i, j int) bool { return diff.Stops[i].StopID < diff.Stops[j].StopID })
+
+	return diff
+}
+
+// diffFeeds は2つの静的フィード (DBファイルまたはGTFSディレクトリ) を比較する
+func diffFeeds(oldSource, newSource string, stopNames []string) (*FeedDiff, error) {
+	oldFeed, err := loadFeedSnapshot(oldSource)
+	if err != nil {
+		return nil, fmt.Errorf("旧フィードの読み込みに失敗: %w", err)
+	}
+	newFeed, err := loadFeedSnapshot(newSource)
+	if err != nil {
+		return nil, fmt.Errorf("新フィードの読み込みに失敗: %w", err)
+	}
+	return diffFeedSnapshots(oldFeed, newFeed, stopNames), nil
+}
+
+// 差分の計算結果のキャッシュ (DBファイルの更新時刻と停留所名で判定)
+var feedDiffCache struct {
+	sync.Mutex
+	key  string
+	diff *FeedDiff
+}
+
+// currentFeedDiff は差し替え前の静的DBと現在の静的DBの差分を返す
+func currentFeedDiff(stopNames []string) (*FeedDiff, error) {
+	oldPath := databasePath(previousStaticDbFile)
+	newPath := databasePath(staticDbFile)
+
+	oldInfo, err := os.Stat(oldPath)
+	if err != nil {
+		return nil, fmt.Errorf("比較対象の旧フィードがありません")
+	}
+	newInfo, err := os.Stat(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("現在の静的DBがありません")
+	}
+
+	key := fmt.Sprintf("%d|%d|%s", oldInfo.ModTime().UnixNano(), newInfo.ModTime().UnixNano(), strings.Join(stopNames, "\x00"))
+
+	feedDiffCache.Lock()
+	defer feedDiffCache.Unlock()
+	if feedDiffCache.key == key && feedDiffCache.diff != nil {
+		return feedDiffCache.diff, nil
+	}
+
+	diff, err := diffFeeds(oldPath, newPath, stopNames)
+	if err != nil {
+		return nil, err
+	}
+	feedDiffCache.key = key
+	feedDiffCache.diff = diff
+	return diff, nil
+}
+
+// logFeedDiff は差分の概要をログに出力する
+func logFeedDiff(diff *FeedDiff) {
+	var added, removed, retimed int
+	for _, r := range diff.Routes {
+		added += r.TripsAdded
+		removed += r.TripsRemoved
+		retimed += r.TripsRetimed
+	}
+	log.Printf("  差分: 路線 %d件, 停留所 %d件, 便の追加 %d件, 削除 %d件, 時刻変更 %d件",
+		len(diff.Routes), len(diff.Stops), added, removed, retimed)
+}
+
+// 全停留所を対象にする場合の stop パラメータ
+const allStopsFilter string = "*"
+
+// feedDiffStops は差分の対象とする停留所名を返す。
+// stop パラメータがない場合は発車標に設定された停留所、"*" の場合は全停留所 (nil) を対象にする
+func feedDiffStops(r *http.Request) []string {
+	stop := strings.TrimSpace(r.URL.Query().Get("stop"))
+	switch stop {
+	case "":
+		return appConfig.Get().signStopNames()
+	case allStopsFilter:
+		return nil
+	}
+	return []string{stop}
+}
+
+// feedDiffHandler はフィード差分をHTMLで表示する
+func feedDiffHandler(w http.ResponseWriter, r *http.Request) {
+	diff, err := currentFeedDiff(feedDiffStops(r))
+
+	data := struct {
+		Diff         *FeedDiff
+		Stop         string
+		ErrorMessage string
+	}{
+		Diff: diff,
+		Stop: r.URL.Query().Get("stop"),
+	}
+	if err != nil {
+		data.ErrorMessage = err.Error()
+	}
+
+	renderTemplate(w, "feed-diff", data)
+}
+
+// feedDiffAPIHandler はフィード差分をJSONで返す
+func feedDiffAPIHandler(w http.ResponseWriter, r *http.Request) {
+	diff, err := currentFeedDiff(feedDiffStops(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
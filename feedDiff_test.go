@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// testFeed は停留所 A (駅前), B (市役所), C (病院) と、路線 r1, r2 のフィードを作る
+func testFeed(version string, trips map[string]*snapshotTrip) *feedSnapshot {
+	s := newFeedSnapshot()
+	s.FeedVersion = version
+	s.Routes["r1"] = "駅前線"
+	s.Routes["r2"] = "病院線"
+	s.Stops["A"] = "駅前"
+	s.Stops["B"] = "市役所"
+	s.Stops["C"] = "病院"
+	s.Trips = trips
+	return s
+}
+
+// testTrip は各停留所に1回ずつ停車する便を作る
+func testTrip(routeID string, times map[string]string) *snapshotTrip {
+	t := &snapshotTrip{RouteID: routeID, Times: make(map[stopCall]string, len(times))}
+	for stopID, departure := range times {
+		t.Times[stopCall{StopID: stopID}] = departure
+	}
+	return t
+}
+
+func findRouteDiff(diff *FeedDiff, id string) *RouteDiff {
+	for i := range diff.Routes {
+		if diff.Routes[i].RouteID == id {
+			return &diff.Routes[i]
+		}
+	}
+	return nil
+}
+
+func findStopDiff(diff *FeedDiff, id string) *StopDiff {
+	for i := range diff.Stops {
+		if diff.Stops[i].StopID == id {
+			return &diff.Stops[i]
+		}
+	}
+	return nil
+}
+
+func TestDiffFeedSnapshots(t *testing.T) {
+	oldFeed := testFeed("1", map[string]*snapshotTrip{
+		"same":    testTrip("r1", map[string]string{"A": "08:00:00", "B": "08:10:00"}),
+		"retimed": testTrip("r1", map[string]string{"A": "09:00:00", "B": "09:10:00"}),
+		"removed": testTrip("r2", map[string]string{"B": "10:00:00", "C": "10:20:00"}),
+	})
+	newFeed := testFeed("2", map[string]*snapshotTrip{
+		"same":    testTrip("r1", map[string]string{"A": "08:00:00", "B": "08:10:00"}),
+		"retimed": testTrip("r1", map[string]string{"A": "09:05:00", "B": "09:15:00"}),
+		"added":   testTrip("r2", map[string]string{"A": "11:00:00", "C": "11:30:00"}),
+	})
+
+	diff := diffFeedSnapshots(oldFeed, newFeed, nil)
+	if diff.OldVersion != "1" || diff.NewVersion != "2" {
+		t.Errorf("バージョン = %q -> %q", diff.OldVersion, diff.NewVersion)
+	}
+
+	routeTests := []struct {
+		id                      string
+		added, removed, retimed int
+	}{
+		{"r1", 0, 0, 1},
+		{"r2", 1, 1, 0},
+	}
+	for _, tt := range routeTests {
+		r := findRouteDiff(diff, tt.id)
+		if r == nil {
+			t.Errorf("路線 %s の差分がありません", tt.id)
+			continue
+		}
+		if r.TripsAdded != tt.added || r.TripsRemoved != tt.removed || r.TripsRetimed != tt.retimed {
+			t.Errorf("路線 %s = +%d -%d ~%d, want +%d -%d ~%d", tt.id,
+				r.TripsAdded, r.TripsRemoved, r.TripsRetimed, tt.added, tt.removed, tt.retimed)
+		}
+	}
+
+	stopTests := []struct {
+		id                      string
+		added, removed, retimed int
+	}{
+		{"A", 1, 0, 1},
+		{"B", 0, 1, 1},
+		{"C", 1, 1, 0},
+	}
+	for _, tt := range stopTests {
+		s := findStopDiff(diff, tt.id)
+		if s == nil {
+			t.Errorf("停留所 %s の差分がありません", tt.id)
+			continue
+		}
+		if s.DeparturesAdded != tt.added || s.DeparturesRemoved != tt.removed || s.DeparturesRetimed != tt.retimed {
+			t.Errorf("停留所 %s = +%d -%d ~%d, want +%d -%d ~%d", tt.id,
+				s.DeparturesAdded, s.DeparturesRemoved, s.DeparturesRetimed, tt.added, tt.removed, tt.retimed)
+		}
+	}
+}
+
+func TestDiffFeedSnapshotsStopFilter(t *testing.T) {
+	oldFeed := testFeed("1", map[string]*snapshotTrip{
+		"a": testTrip("r1", map[string]string{"A": "08:00:00", "B": "08:10:00"}),
+		"c": testTrip("r2", map[string]string{"C": "09:00:00"}),
+	})
+	newFeed := testFeed("2", map[string]*snapshotTrip{
+		"a": testTrip("r1", map[string]string{"A": "08:00:00", "B": "08:12:00"}),
+		"c": testTrip("r2", map[string]string{"C": "09:30:00"}),
+	})
+	newFeed.Routes["r3"] = "新路線"
+
+	// 市役所に停車する便の、市役所の時刻のみが対象になる
+	diff := diffFeedSnapshots(oldFeed, newFeed, []string{"市役所"})
+	if len(diff.Routes) != 1 || diff.Routes[0].RouteID != "r1" || diff.Routes[0].TripsRetimed != 1 {
+		t.Errorf("路線の差分 = %+v", diff.Routes)
+	}
+	if len(diff.Stops) != 1 || diff.Stops[0].StopID != "B" || diff.Stops[0].DeparturesRetimed != 1 {
+		t.Errorf("停留所の差分 = %+v", diff.Stops)
+	}
+
+	// 絞り込まない場合は追加された路線も含む
+	diff = diffFeedSnapshots(oldFeed, newFeed, nil)
+	if r := findRouteDiff(diff, "r3"); r == nil || r.Status != "added" {
+		t.Errorf("追加された路線 = %+v", r)
+	}
+}
+
+func TestDiffFeedSnapshotsLoopTrip(t *testing.T) {
+	// 駅前を出て駅前に戻る循環便。帰りの駅前の時刻だけが変わった
+	dir := t.TempDir()
+	writeFeedFiles := func(name, lastDeparture string) string {
+		path := filepath.Join(dir, name)
+		if err := os.Mkdir(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]string{
+			"routes.txt": "route_id,route_long_name\nr1,循環線\n",
+			"stops.txt":  "stop_id,stop_name\nA,駅前\nB,市役所\n",
+			"trips.txt":  "route_id,trip_id,trip_headsign\nr1,loop,循環\n",
+			// ファイル内の行の順序は stop_sequence の順とは限らない
+			"stop_times.txt": "trip_id,departure_time,stop_id,stop_sequence\n" +
+				"loop," + lastDeparture + ",A,3\n" +
+				"loop,08:00:00,A,1\n" +
+				"loop,08:10:00,B,2\n",
+		}
+		for file, content := range files {
+			if err := os.WriteFile(filepath.Join(path, file), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return path
+	}
+	oldDir := writeFeedFiles("old", "08:20:00")
+	newDir := writeFeedFiles("new", "08:25:00")
+
+	oldFeed, err := loadSnapshotFromDir(oldDir)
+	if err != nil {
+		t.Fatalf("loadSnapshotFromDir: %v", err)
+	}
+	loop := oldFeed.Trips["loop"]
+	wantTimes := map[stopCall]string{
+		{StopID: "A", Occurrence: 0}: "08:00:00",
+		{StopID: "B", Occurrence: 0}: "08:10:00",
+		{StopID: "A", Occurrence: 1}: "08:20:00",
+	}
+	if len(loop.Times) != len(wantTimes) {
+		t.Fatalf("停車 = %v, want %v", loop.Times, wantTimes)
+	}
+	for call, want := range wantTimes {
+		if got := loop.Times[call]; got != want {
+			t.Errorf("%+v の時刻 = %q, want %q", call, got, want)
+		}
+	}
+
+	diff, err := diffFeeds(oldDir, newDir, []string{"駅前"})
+	if err != nil {
+		t.Fatalf("diffFeeds: %v", err)
+	}
+	s := findStopDiff(diff, "A")
+	if s == nil || s.DeparturesRetimed != 1 || s.DeparturesAdded != 0 || s.DeparturesRemoved != 0 {
+		t.Errorf("駅前の差分 = %+v, want 時刻変更1件のみ", s)
+	}
+	if r := findRouteDiff(diff, "r1"); r == nil || r.TripsRetimed != 1 {
+		t.Errorf("循環線の差分 = %+v", r)
+	}
+}
+
+func TestFeedDiffStops(t *testing.T) {
+	c := &Config{
+		Display: DisplayConfig{StopName: "駅前"},
+		Signs: []SignConfig{
+			{ID: "east", StopName: "市役所"},
+			{ID: "west"},
+			{ID: "north", StopName: "駅前"},
+		},
+	}
+	applyConfigDefaults(c)
+	appConfig = &ConfigManager{}
+	appConfig.current.Store(c)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"未指定は発車標の停留所", "", []string{"駅前", "市役所"}},
+		{"停留所名を指定", "?stop=病院", []string{"病院"}},
+		{"全停留所", "?stop=*", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/feed-diff"+tt.query, nil)
+			if got := feedDiffStops(r); !slices.Equal(got, tt.want) {
+				t.Errorf("feedDiffStops = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotFromDbFeedInfo(t *testing.T) {
+	dir := t.TempDir()
+
+	// feed_info が空の場合はバージョンが空になる
+	path := filepath.Join(dir, "static.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createStaticTables(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := loadSnapshotFromDb(path)
+	if err != nil {
+		t.Fatalf("loadSnapshotFromDb: %v", err)
+	}
+	if s.FeedVersion != "" {
+		t.Errorf("FeedVersion = %q", s.FeedVersion)
+	}
+
+	// feed_info テーブルがない場合はエラーにする
+	path = filepath.Join(dir, "broken.db")
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE routes (route_id TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := loadSnapshotFromDb(path); err == nil {
+		t.Error("feed_info がない場合にエラーがありません")
+	}
+}
@@ -5,18 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
-type Config struct {
-	UID      string `json:"uid,omitempty"`
-	AgencyID string `json:"agencyID,omitempty"`
-	Target   string `json:"target,omitempty"`
-}
-
 func readConfig(path string) (*Config, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -31,6 +30,17 @@ func readConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to decode JSON: %w", err)
 	}
 
+	// APIキーは暗号化して保存されている
+	uid, plaintext, err := decryptSecret(config.UID)
+	if err != nil {
+		// 復号できない場合は未設定として扱い、設定ページから再入力してもらう。
+		// 鍵ファイルを戻せば読めるよう、再入力されるまで暗号文は残す
+		log.Printf("APIキーを読み込めませんでした。設定ページから再設定してください: %v", err)
+		config.undecryptableSecret = config.UID
+	}
+	config.UID = uid
+	config.plaintextSecret = plaintext
+
 	return &config, nil
 }
 
@@ -38,7 +48,7 @@ func readOrCreateConfig(path string) (*Config, error) {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		// ファイルが存在しない場合は作成する
-		emptyConfig := &Config{}
+		emptyConfig := &Config{Version: configSchemaVersion}
 		if err := writeConfig(path, emptyConfig); err != nil {
 			return nil, fmt.Errorf("failed to create default config: %w", err)
 		}
@@ -52,155 +62,482 @@ func readOrCreateConfig(path string) (*Config, error) {
 	return readConfig(path)
 }
 
+// writeConfig は一時ファイルに書き込んでからリネームし、読み込み側が書き込み途中の内容を見ないようにする
 func writeConfig(path string, config *Config) error {
-	f, err := os.Create(path)
+	stored := config.clone()
+	uid, err := encryptSecret(config.UID)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+	stored.UID = uid
+	if config.UID == "" && config.undecryptableSecret != "" {
+		stored.UID = config.undecryptableSecret
 	}
-	defer f.Close()
 
-	encoder := json.NewEncoder(f)
-	err = encoder.Encode(config)
+	b, err := json.MarshalIndent(stored, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to encode JSON: %w", err)
 	}
-	return nil
-}
 
-func getExecutableDir() (string, error) {
-	exePath, err := os.Executable()
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	// APIキーを含むため所有者のみ読み書きできるようにする
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to chmod file: %w", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write file: %w", err)
 	}
-	return filepath.Dir(exePath), nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return os.Rename(tmp, path)
 }
 
-// 静的GTFSデータのダウンロードに必要な情報を返す
-func gtfsDownloadInfo() (string, string, string) {
-	config, err := readConfig(configPath)
-	if err != nil {
-		fmt.Printf("Failed to open config file: %v\n", err)
+// feedDownloadURL は事業者の静的GTFSデータのダウンロード先を返す
+func feedDownloadURL(config *Config, feed FeedConfig) string {
+	query := url.Values{"agency_id": {feed.AgencyID}, "uid": {config.UID}}
+	return "https://www.ptd-hs.jp/GetData?" + query.Encode()
+}
+
+// downloadHandler は静的GTFSデータを期限にかかわらず取得し直す。
+// 自動更新と同じく検証してから新しいDBに取り込んで差し替えるため、更新中も表示は止まらない
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
 	}
 
-	var targetURL string = "https://www.ptd-hs.jp/GetData?agency_id=" + config.AgencyID + "&uid=" + config.UID
+	if !feedUpdateMutex.TryLock() {
+		http.Error(w, "静的フィードの更新は既に実行中です", http.StatusConflict)
+		return
+	}
+	go func() {
+		defer feedUpdateMutex.Unlock()
+		if _, err := refreshStaticFeedLocked(staticDbFile, true); err != nil {
+			log.Printf("静的フィードの更新に失敗しました: %v", err)
+		}
+	}()
 
-	exeDir, _ := getExecutableDir()
-	zipPath := filepath.Join(exeDir, "static", "gtfs.zip")
-	destDir := filepath.Join(exeDir, "static")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Download started.")
+}
 
-	return targetURL, zipPath, destDir
+// 展開を許可するGTFSのファイル名
+var gtfsFileAllowList = map[string]bool{
+	"agency.txt":          true,
+	"agency_jp.txt":       true,
+	"attributions.txt":    true,
+	"calendar.txt":        true,
+	"calendar_dates.txt":  true,
+	"fare_attributes.txt": true,
+	"fare_rules.txt":      true,
+	"feed_info.txt":       true,
+	"frequencies.txt":     true,
+	"levels.txt":          true,
+	"office_jp.txt":       true,
+	"pathways.txt":        true,
+	"pattern_jp.txt":      true,
+	"routes.txt":          true,
+	"routes_jp.txt":       true,
+	"shapes.txt":          true,
+	"stop_times.txt":      true,
+	"stops.txt":           true,
+	"transfers.txt":       true,
+	"translations.txt":    true,
+	"trips.txt":           true,
 }
 
-func updateStatic(dbFile string) {
+// ZIP爆弾対策の上限
+const maxExtractFiles int = 64
+const maxExtractTotalSize int64 = 2 << 30 // 展開後の合計 2GiB
 
-	targetURL, zipPath, destDir := gtfsDownloadInfo()
+// validateZipEntry はZIP内のファイル名が展開先の外を指していないかを確認する
+func validateZipEntry(f *zip.File) error {
+	name := f.Name
+	if name == "" || strings.Contains(name, "\\") || strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("不正なパスを含むZIPです: %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return fmt.Errorf("展開先の外を指すパスを含むZIPです: %q", name)
+		}
+	}
+	if f.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("シンボリックリンクを含むZIPです: %q", name)
+	}
+	return nil
+}
 
-	// 旧バージョンのGTFSファイルを削除
-	os.Remove(zipPath)
-	os.RemoveAll("./static/gtfs")
+// zipEntryPrefix は全ファイルが1つのフォルダ (例: "gtfs/stops.txt") に入っている場合、そのフォルダ名 ("gtfs/") を返す。
+// macOS が付ける __MACOSX/ は無視する
+func zipEntryPrefix(files []*zip.File) string {
+	prefix := ""
+	for _, f := range files {
+		if f.Mode().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		i := strings.Index(f.Name, "/")
+		if i < 0 {
+			return ""
+		}
+		if prefix == "" {
+			prefix = f.Name[:i+1]
+		} else if f.Name[:i+1] != prefix {
+			return ""
+		}
+	}
+	return prefix
+}
 
-	// 既存のDBを消去
-	staticDbFile := filepath.Join("./databases", dbFile)
-	os.Remove(staticDbFile)
+func extract(src, dest string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-	downloadFile(zipPath, targetURL)
+	// 展開前に全エントリを検査し、不正なZIPは何も書き込まずに拒否する
+	for _, f := range r.File {
+		if err := validateZipEntry(f); err != nil {
+			return err
+		}
+	}
 
-	if err := extract(zipPath, destDir); err != nil {
-		fmt.Println(err)
+	// GTFSファイルを1つのフォルダに入れたZIPは、フォルダを除いた名前で展開する
+	prefix := zipEntryPrefix(r.File)
+	files := make([]*zip.File, 0, len(r.File))
+	names := make([]string, 0, len(r.File))
+	var totalSize uint64
+	for _, f := range r.File {
+		if f.Mode().IsDir() {
+			continue
+		}
+		name := strings.TrimPrefix(f.Name, prefix)
+		if !gtfsFileAllowList[name] {
+			fmt.Printf("GTFS以外のファイルをスキップします: %s\n", f.Name)
+			continue
+		}
+
+		files = append(files, f)
+		names = append(names, name)
+		if len(files) > maxExtractFiles {
+			return fmt.Errorf("ZIP内のファイル数が上限 (%d) を超えています", maxExtractFiles)
+		}
+		totalSize += f.UncompressedSize64
+		if totalSize > uint64(maxExtractTotalSize) {
+			return fmt.Errorf("ZIPの展開後のサイズが上限 (%d bytes) を超えています", maxExtractTotalSize)
+		}
 	}
+	if len(files) == 0 {
+		return fmt.Errorf("ZIP内にGTFSファイルがありません")
+	}
+
+	ext := filepath.Ext(src)
+	rep := regexp.MustCompile(regexp.QuoteMeta(ext) + "$")
+	dir := filepath.Base(rep.ReplaceAllString(src, ""))
 
-	// 新データでDB初期化
-	initStaticDb(dbFile)
+	destDir := filepath.Join(dest, dir)
+	// ファイル名のディレクトリを作成する
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
 
+	// ヘッダのサイズが偽装されている場合に備え、実際に書き込んだ量でも制限する
+	remaining := maxExtractTotalSize
+	for i, f := range files {
+		written, err := saveExtractedFile(destDir, names[i], f, remaining)
+		if err != nil {
+			return err
+		}
+		remaining -= written
+	}
+	return nil
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-
-	if r.Method == "POST" {
+// saveExtractedFile は f を destDir/name に書き込む。limit を超えた場合や途中で失敗した場合は書きかけのファイルを削除する
+func saveExtractedFile(destDir string, name string, f *zip.File, limit int64) (int64, error) {
+	// 展開先のパス
+	destPath := filepath.Join(destDir, name)
 
-		targetURL, zipPath, destDir := gtfsDownloadInfo()
+	// 念のため展開先ディレクトリの外に出ていないか確認
+	rel, err := filepath.Rel(destDir, destPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return 0, fmt.Errorf("展開先の外を指すパスを含むZIPです: %q", f.Name)
+	}
 
-		downloadFile(zipPath, targetURL)
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
 
-		if err := extract(zipPath, destDir); err != nil {
-			fmt.Println(err)
-		}
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer destFile.Close()
 
-	} else {
-		fmt.Fprintf(w, "Download Failed.")
+	written, err := io.Copy(destFile, io.LimitReader(rc, limit+1))
+	if err != nil {
+		// ヘッダのサイズやCRCが実際の内容と一致しない場合もここで失敗する
+		destFile.Close()
+		os.Remove(destPath)
+		return written, fmt.Errorf("ZIPの展開に失敗: %q: %w", f.Name, err)
 	}
+	if written > limit {
+		destFile.Close()
+		os.Remove(destPath)
+		return written, fmt.Errorf("ZIPの展開後のサイズが上限 (%d bytes) を超えています: %q", maxExtractTotalSize, f.Name)
+	}
+
+	return written, nil
 }
 
-func downloadFile(filepath string, url string) error {
+// 静的DBの作成に必要なGTFSファイル
+var requiredGtfsFiles = []string{
+	"calendar_dates.txt",
+	"calendar.txt",
+	"fare_attributes.txt",
+	"fare_rules.txt",
+	"feed_info.txt",
+	"office_jp.txt",
+	"routes.txt",
+	"shapes.txt",
+	"stops.txt",
+	"stop_times.txt",
+	"translations.txt",
+	"trips.txt",
+}
 
-	resp, err := http.Get(url)
+// validateGtfsDir は静的DBの作成に必要なファイルが揃っているかを確認する
+func validateGtfsDir(dir string) error {
+	missing := make([]string, 0)
+	for _, name := range requiredGtfsFiles {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.IsDir() {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("GTFSファイルが不足しています: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer in.Close()
 
-	out, err := os.Create(filepath)
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	_, err = io.Copy(out, in)
 	return err
 }
 
-func extract(src, dest string) error {
-	r, err := zip.OpenReader(src)
+// copyGtfsDir はディレクトリ内のGTFSファイルのみを dest に複製する
+func copyGtfsDir(src, dest string) error {
+	entries, err := os.ReadDir(src)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
-
-	ext := filepath.Ext(src)
-	rep := regexp.MustCompile(ext + "$")
-	dir := filepath.Base(rep.ReplaceAllString(src, ""))
-
-	destDir := filepath.Join(dest, dir)
-	// ファイル名のディレクトリを作成する
-	if err := os.MkdirAll(destDir, 0600); err != nil {
+	if err := os.MkdirAll(dest, 0755); err != nil {
 		return err
 	}
 
-	for _, f := range r.File {
-		if f.Mode().IsDir() {
+	var totalSize int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !gtfsFileAllowList[e.Name()] {
 			continue
 		}
-		if err := saveExtractedFile(destDir, *f); err != nil {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		totalSize += info.Size()
+		if totalSize > maxExtractTotalSize {
+			return fmt.Errorf("GTFSファイルの合計サイズが上限 (%d bytes) を超えています", maxExtractTotalSize)
+		}
+		if err := copyFile(filepath.Join(src, e.Name()), filepath.Join(dest, e.Name())); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func saveExtractedFile(destDir string, f zip.File) error {
-	// 展開先のパス
-	destPath := filepath.Join(destDir, f.Name)
+// アップロードを受け付けるZIPの最大サイズ
+const maxUploadSize int64 = 512 << 20
+
+// importStatus は最後に実行した静的フィードの取り込みの状態
+type importStatus struct {
+	State      string `json:"state"` // idle, running, succeeded, failed
+	Source     string `json:"source,omitempty"`
+	FeedID     string `json:"feed_id,omitempty"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
 
-	// 子・孫ディレクトリがあれば作成
-	if err := os.MkdirAll(filepath.Dir(destPath), f.Mode()); err != nil {
-		return err
+var lastImport = importStatus{State: "idle"}
+var lastImportMutex sync.Mutex
+
+func setImportStatus(status importStatus) {
+	lastImportMutex.Lock()
+	defer lastImportMutex.Unlock()
+	lastImport = status
+}
+
+func getImportStatus() importStatus {
+	lastImportMutex.Lock()
+	defer lastImportMutex.Unlock()
+	return lastImport
+}
+
+// runImport は feedUpdateMutex を取得済みの状態で取り込みを実行し、結果を記録する。終了時に mutex を解放する
+func runImport(source string, name string, feedID string) {
+	defer feedUpdateMutex.Unlock()
+
+	status := importStatus{State: "running", Source: name, FeedID: feedID, StartedAt: time.Now().Format(time.RFC3339)}
+	setImportStatus(status)
+
+	err := importStaticFeedLocked(staticDbFile, source, feedID)
+	status.FinishedAt = time.Now().Format(time.RFC3339)
+	if err != nil {
+		log.Printf("静的フィードの取り込みに失敗しました: %v", err)
+		status.State = "failed"
+		status.Error = redactSecrets(err.Error())
+	} else {
+		log.Printf("静的フィードを取り込みました: %s", name)
+		status.State = "succeeded"
 	}
+	setImportStatus(status)
+}
 
-	rc, err := f.Open()
+// resolveImportPath はサーバ上のパス (絶対パス、または importDir からの相対パス) を解決する。
+// シンボリックリンクを含め importDir の外を指すパスは拒否する
+func resolveImportPath(importDir string, source string) (string, error) {
+	if importDir == "" {
+		return "", fmt.Errorf("サーバ上のパスからの取り込みは無効です (server.importDir が未設定です)")
+	}
+	base, err := filepath.EvalSymlinks(importDir)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("取り込み用のディレクトリが見つかりません: %w", err)
+	}
+	if base, err = filepath.Abs(base); err != nil {
+		return "", err
 	}
-	defer rc.Close()
 
-	destFile, err := os.Create(destPath)
+	if !filepath.IsAbs(source) {
+		source = filepath.Join(base, source)
+	}
+	resolved, err := filepath.EvalSymlinks(source)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("指定されたパスが見つかりません")
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return "", err
 	}
-	defer destFile.Close()
 
-	if _, err := io.Copy(destFile, rc); err != nil {
-		return err
+	rel, err := filepath.Rel(base, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("取り込み用のディレクトリ (server.importDir) の外のパスは指定できません")
 	}
+	return resolved, nil
+}
 
-	return nil
+// importHandler は設定ページからアップロードされたZIP、または server.importDir 内のパスから静的フィードを取り込む。
+// GET の場合は最後の取り込みの状態を返す
+func importHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(getImportStatus())
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	source := strings.TrimSpace(r.FormValue("path"))
+	feedID := strings.TrimSpace(r.FormValue("feed_id"))
+
+	file, header, err := r.FormFile("gtfs_zip")
+	if err == nil {
+		defer file.Close()
+
+		if !strings.EqualFold(filepath.Ext(header.Filename), ".zip") {
+			http.Error(w, "ZIPファイルを選択してください", http.StatusBadRequest)
+			return
+		}
+	} else if source != "" {
+		source, err = resolveImportPath(appConfig.Get().Server.ImportDir, source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		http.Error(w, "ZIPファイルまたはパスを指定してください", http.StatusBadRequest)
+		return
+	}
+
+	// 取り込みは時間がかかるため非同期で処理する。結果は GET /import で確認できる
+	if !feedUpdateMutex.TryLock() {
+		http.Error(w, "静的フィードの更新は既に実行中です", http.StatusConflict)
+		return
+	}
+
+	if file != nil {
+		// アップロードされたZIPは一時ファイルに保存してから取り込む
+		tmp, err := os.CreateTemp("", "gtfs-upload-*.zip")
+		if err != nil {
+			feedUpdateMutex.Unlock()
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(tmp, file)
+		tmp.Close()
+		if err != nil {
+			feedUpdateMutex.Unlock()
+			os.Remove(tmp.Name())
+			http.Error(w, "Failed to save file", http.StatusBadRequest)
+			return
+		}
+
+		go func() {
+			defer os.Remove(tmp.Name())
+			runImport(tmp.Name(), header.Filename, feedID)
+		}()
+	} else {
+		go runImport(source, source, feedID)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Import started.")
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"hash/crc32"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testZipEntry はテスト用のZIPに入れるエントリ
+type testZipEntry struct {
+	name string
+	body string
+	mode os.FileMode
+	// 0 でなければヘッダの展開後のサイズをこの値に偽装する
+	headerSize uint64
+}
+
+// writeTestZip はエントリから dir/gtfs.zip を作成してパスを返す
+func writeTestZip(t *testing.T, dir string, entries []testZipEntry) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		if e.headerSize != 0 {
+			writeRawZipEntry(t, w, e)
+			continue
+		}
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.mode != 0 {
+			header.SetMode(e.mode)
+		}
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "gtfs.zip")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeRawZipEntry は展開後のサイズを偽装したエントリを書き込む (CRCは実際の内容のもの)
+func writeRawZipEntry(t *testing.T, w *zip.Writer, e testZipEntry) {
+	t.Helper()
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(e.body))
+	fw.Close()
+
+	f, err := w.CreateRaw(&zip.FileHeader{
+		Name:               e.name,
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE([]byte(e.body)),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: e.headerSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(compressed.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// extractedFiles は dir 以下のファイルを dir からの相対パスで返す
+func extractedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files := make([]string, 0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+func TestExtract(t *testing.T) {
+	tooMany := make([]testZipEntry, maxExtractFiles+1)
+	for i := range tooMany {
+		tooMany[i] = testZipEntry{name: "stops.txt", body: "stop_id\n"}
+	}
+
+	tests := []struct {
+		name    string
+		entries []testZipEntry
+		// 空の場合は成功し、want のファイルが展開されること
+		wantErr string
+		want    []string
+	}{
+		{
+			name:    "GTFSファイルのみ展開する",
+			entries: []testZipEntry{{name: "stops.txt", body: "stop_id\n"}, {name: "readme.md", body: "x"}},
+			want:    []string{"gtfs/stops.txt"},
+		},
+		{
+			name: "1つのフォルダに入ったZIP",
+			entries: []testZipEntry{
+				{name: "feed/", mode: os.ModeDir | 0755},
+				{name: "feed/stops.txt", body: "stop_id\n"},
+				{name: "feed/trips.txt", body: "trip_id\n"},
+				{name: "__MACOSX/feed/._stops.txt", body: "x"},
+			},
+			want: []string{"gtfs/stops.txt", "gtfs/trips.txt"},
+		},
+		{
+			name:    "複数のフォルダに分かれたZIP",
+			entries: []testZipEntry{{name: "a/stops.txt", body: "x"}, {name: "b/trips.txt", body: "x"}},
+			wantErr: "GTFSファイルがありません",
+		},
+		{
+			name:    "親ディレクトリを指すパス",
+			entries: []testZipEntry{{name: "stops.txt", body: "x"}, {name: "../stops.txt", body: "x"}},
+			wantErr: "展開先の外",
+		},
+		{
+			name:    "途中に親ディレクトリを含むパス",
+			entries: []testZipEntry{{name: "feed/../../stops.txt", body: "x"}},
+			wantErr: "展開先の外",
+		},
+		{
+			name:    "絶対パス",
+			entries: []testZipEntry{{name: "/tmp/stops.txt", body: "x"}},
+			wantErr: "不正なパス",
+		},
+		{
+			name:    "バックスラッシュ区切りのパス",
+			entries: []testZipEntry{{name: `..\stops.txt`, body: "x"}},
+			wantErr: "不正なパス",
+		},
+		{
+			name:    "シンボリックリンク",
+			entries: []testZipEntry{{name: "stops.txt", body: "/etc/passwd", mode: os.ModeSymlink | 0777}},
+			wantErr: "シンボリックリンク",
+		},
+		{
+			name:    "ファイル数が多すぎる",
+			entries: tooMany,
+			wantErr: "ファイル数が上限",
+		},
+		{
+			name:    "展開後のサイズが大きすぎる",
+			entries: []testZipEntry{{name: "stop_times.txt", body: "x", headerSize: uint64(maxExtractTotalSize) + 1}},
+			wantErr: "サイズが上限",
+		},
+		{
+			// ヘッダには10バイトと書かれているが、実際には1MiBに展開される
+			name:    "サイズを偽装したZIP爆弾",
+			entries: []testZipEntry{{name: "stop_times.txt", body: strings.Repeat("0", 1<<20), headerSize: 10}},
+			wantErr: "展開に失敗",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := writeTestZip(t, dir, tt.entries)
+			dest := filepath.Join(dir, "out")
+
+			err := extract(src, dest)
+			got := extractedFiles(t, dest)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extract() error = %v, want %q", err, tt.wantErr)
+				}
+				if len(got) > 0 {
+					t.Errorf("失敗したのにファイルが残っています: %v", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("extract(): %v", err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("展開したファイル = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveExtractedFileLimit(t *testing.T) {
+	dir := t.TempDir()
+	src := writeTestZip(t, dir, []testZipEntry{{name: "stops.txt", body: strings.Repeat("x", 100)}})
+
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := saveExtractedFile(dir, "stops.txt", r.File[0], 50); err == nil {
+		t.Error("上限を超えたのにエラーがありません")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stops.txt")); !os.IsNotExist(err) {
+		t.Error("上限を超えたファイルが残っています")
+	}
+
+	written, err := saveExtractedFile(dir, "stops.txt", r.File[0], 100)
+	if err != nil || written != 100 {
+		t.Errorf("saveExtractedFile() = %d, %v", written, err)
+	}
+}
+
+func TestResolveImportPath(t *testing.T) {
+	dir := t.TempDir()
+	importDir := filepath.Join(dir, "import")
+	os.MkdirAll(filepath.Join(importDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(importDir, "sub", "gtfs.zip"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("x"), 0644)
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(importDir, "link.zip")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		importDir string
+		source    string
+		wantErr   bool
+	}{
+		{"絶対パス", importDir, filepath.Join(importDir, "sub", "gtfs.zip"), false},
+		{"相対パス", importDir, "sub/gtfs.zip", false},
+		{"ディレクトリの外", importDir, filepath.Join(dir, "secret.txt"), true},
+		{"親ディレクトリを指す相対パス", importDir, "../secret.txt", true},
+		{"外を指すシンボリックリンク", importDir, "link.zip", true},
+		{"存在しないパス", importDir, "missing.zip", true},
+		{"importDir が未設定", "", filepath.Join(importDir, "sub", "gtfs.zip"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveImportPath(tt.importDir, tt.source)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolveImportPath(%q) = %q, want error", tt.source, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveImportPath(%q): %v", tt.source, err)
+			}
+			if filepath.Base(got) != "gtfs.zip" {
+				t.Errorf("resolveImportPath(%q) = %q", tt.source, got)
+			}
+		})
+	}
+}
+
+func TestImportHandler(t *testing.T) {
+	importDir := t.TempDir()
+	c := &Config{}
+	applyConfigDefaults(c)
+	c.Server.ImportDir = importDir
+	appConfig = &ConfigManager{}
+	appConfig.current.Store(c)
+
+	setImportStatus(importStatus{State: "failed", Source: "gtfs.zip", Error: "ZIPの展開に失敗"})
+	defer setImportStatus(importStatus{State: "idle"})
+
+	rec := httptest.NewRecorder()
+	importHandler(rec, httptest.NewRequest(http.MethodGet, "/import", nil))
+	var status importStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != "failed" || status.Error != "ZIPの展開に失敗" {
+		t.Errorf("GET /import = %+v", status)
+	}
+
+	// importDir の外のパスは取り込みを始めずに拒否する
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("path", "/etc/passwd")
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/import", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec = httptest.NewRecorder()
+	importHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /import (importDir の外) = %d", rec.Code)
+	}
+	if getImportStatus().State != "failed" {
+		t.Error("拒否したのに取り込みの状態が変わりました")
+	}
+}
+
+func TestDownloadHandler(t *testing.T) {
+	// GET ではダウンロードしない
+	rec := httptest.NewRecorder()
+	downloadHandler(rec, httptest.NewRequest(http.MethodGet, "/dl", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	// 更新の実行中は新たに受け付けない
+	feedUpdateMutex.Lock()
+	defer feedUpdateMutex.Unlock()
+	rec = httptest.NewRecorder()
+	downloadHandler(rec, httptest.NewRequest(http.MethodPost, "/dl", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("実行中の POST status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
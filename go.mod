@@ -5,3 +5,5 @@ go 1.24.2
 require github.com/mattn/go-sqlite3 v1.14.28
 
 require github.com/gorilla/websocket v1.5.3
+
+require golang.org/x/crypto v0.48.0
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
 )
 
 // 車両の位置情報を格納する構造体
@@ -49,12 +51,16 @@ type TripUpdateResponse struct {
 				} `json:"departure"`
 				StopID       string `json:"stopId"`
 				StopSequence int    `json:"stopSequence"`
+				// SCHEDULED, SKIPPED, NO_DATA など
+				ScheduleRelationship gtfsEnum `json:"scheduleRelationship"`
 			} `json:"stopTimeUpdate"`
 			Trip struct {
 				RouteID   string `json:"routeId"`
 				StartDate string `json:"startDate"`
 				StartTime string `json:"startTime"`
 				TripID    string `json:"tripId"`
+				// SCHEDULED, ADDED, CANCELED など
+				ScheduleRelationship gtfsEnum `json:"scheduleRelationship"`
 			} `json:"trip"`
 			Vehicle *struct {
 				ID    string `json:"id"`
@@ -69,77 +75,115 @@ type TripUpdateResponse struct {
 	} `json:"header"`
 }
 
-func fetchVehiclePosition() *VehiclePositionResponse {
+// gtfsEnum は GTFS Realtime の列挙値。JSON では名前 ("CANCELED") と番号 (3) のどちらでも届くため、番号は文字列にして保持する
+type gtfsEnum string
 
-	config, err := readConfig(configPath)
-	if err != nil {
-		fmt.Printf("Failed to open config file: %v\n", err)
+func (e *gtfsEnum) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*e = gtfsEnum(name)
+		return nil
 	}
+	var number int
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("列挙値を解釈できません: %s", data)
+	}
+	*e = gtfsEnum(strconv.Itoa(number))
+	return nil
+}
 
-	var apiURL string = "https://www.ptd-hs.jp/GetVehiclePosition?agency_id=" + config.AgencyID + "&uid=" + config.UID + "&output=json"
+// is は列挙値が名前か番号のいずれかと一致するかを返す
+func (e gtfsEnum) is(name string, number int) bool {
+	return string(e) == name || string(e) == strconv.Itoa(number)
+}
 
-	resp, err := http.Get(apiURL)
-	if err != nil {
-		fmt.Println("HTTP request error:", err)
-		os.Exit(1)
-	}
-	defer resp.Body.Close()
+// リアルタイムGTFSのAPIのURL (テストで差し替える)
+var realtimeAPIBaseURL string = "https://www.ptd-hs.jp"
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Failed to read response body:", err)
-		os.Exit(1)
-	}
+// fetchVehiclePosition は設定された全事業者の車両位置情報を取得して1つにまとめる。
+// 取得できなかった事業者はログに出力し、残りの事業者の情報のみを返す
+func fetchVehiclePosition() *VehiclePositionResponse {
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		fmt.Printf("HTTP status error: %d, Response: %s\n", resp.StatusCode, string(body))
-		os.Exit(1)
+	config := appConfig.Get()
+
+	var merged VehiclePositionResponse
+	for _, feed := range config.feeds() {
+		data, err := fetchVehiclePositionFeed(config.UID, feed.AgencyID)
+		if err != nil {
+			log.Printf("車両位置情報の取得に失敗しました (事業者 %s): %v", feed.AgencyID, err)
+			continue
+		}
+		namespaceVehiclePosition(feed.ID, data)
+		merged.Entity = append(merged.Entity, data.Entity...)
 	}
 
+	return &merged
+}
+
+func fetchVehiclePositionFeed(uid string, agencyID string) (*VehiclePositionResponse, error) {
 	var data VehiclePositionResponse
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		fmt.Println("Failed to decode JSON format:", err)
-		//fmt.Println("Response:", string(body))
-		os.Exit(1)
+	if err := fetchRealtimeFeed("GetVehiclePosition", uid, agencyID, &data); err != nil {
+		return nil, err
 	}
-
-	return &data
+	return &data, nil
 }
 
+// fetchTripUpdate は設定された全事業者の運行情報を取得して1つにまとめる。
+// 取得できなかった事業者はログに出力し、残りの事業者の情報のみを返す
 func fetchTripUpdate() *TripUpdateResponse {
 
-	config, err := readConfig(configPath)
-	if err != nil {
-		fmt.Printf("Failed to open config file: %v\n", err)
+	config := appConfig.Get()
+
+	var merged TripUpdateResponse
+	fetched := false
+	for _, feed := range config.feeds() {
+		data, err := fetchTripUpdateFeed(config.UID, feed.AgencyID)
+		if err != nil {
+			log.Printf("運行情報の取得に失敗しました (事業者 %s): %v", feed.AgencyID, err)
+			continue
+		}
+		namespaceTripUpdate(feed.ID, data)
+		if !fetched {
+			merged.Header = data.Header
+			fetched = true
+		}
+		merged.Entity = append(merged.Entity, data.Entity...)
 	}
-	var apiURL string = "https://www.ptd-hs.jp/GetTripUpdate?agency_id=" + config.AgencyID + "&uid=" + config.UID + "&output=json"
+
+	return &merged
+}
+
+func fetchTripUpdateFeed(uid string, agencyID string) (*TripUpdateResponse, error) {
+	var data TripUpdateResponse
+	if err := fetchRealtimeFeed("GetTripUpdate", uid, agencyID, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// fetchRealtimeFeed はリアルタイムGTFSのAPIから事業者の情報をJSONで取得して v に格納する
+func fetchRealtimeFeed(endpoint string, uid string, agencyID string, v any) error {
+
+	query := url.Values{"agency_id": {agencyID}, "uid": {uid}, "output": {"json"}}
+	var apiURL string = realtimeAPIBaseURL + "/" + endpoint + "?" + query.Encode()
 
 	resp, err := http.Get(apiURL)
 	if err != nil {
-		fmt.Println("HTTP request error:", err)
-		os.Exit(1)
+		return fmt.Errorf("HTTPリクエストに失敗: %w", redactURLError(err))
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Println("Failed to read response body:", err)
-		os.Exit(1)
+		return fmt.Errorf("レスポンスの読み込みに失敗: %w", err)
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		fmt.Printf("HTTP status error: %d, Response: %s\n", resp.StatusCode, string(body))
-		os.Exit(1)
+		return fmt.Errorf("HTTPステータスエラー: %d, レスポンス: %s", resp.StatusCode, redactSecrets(string(body)))
 	}
 
-	var data TripUpdateResponse
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		fmt.Println("Failed to decode JSON format:", err)
-		//fmt.Println("Response:", string(body))
-		os.Exit(1)
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("JSONの解析に失敗: %w", err)
 	}
-
-	return &data
+	return nil
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withRealtimeAPI は事業者 ok のみが応答するテスト用のAPIに差し替える
+func withRealtimeAPI(t *testing.T) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("agency_id") {
+		case "ok":
+			if r.URL.Path == "/GetTripUpdate" {
+				fmt.Fprint(w, `{"header":{"timestamp":"1"},"entity":[{"id":"1","tripUpdate":{"trip":{"tripId":"t1","scheduleRelationship":3}}}]}`)
+			} else {
+				fmt.Fprint(w, `{"entity":[{"id":"1","vehicle":{"trip":{"tripId":"t1"}}}]}`)
+			}
+		case "broken":
+			fmt.Fprint(w, `{"entity":`)
+		default:
+			http.Error(w, "invalid uid "+r.URL.Query().Get("uid"), http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	base := realtimeAPIBaseURL
+	realtimeAPIBaseURL = server.URL
+	t.Cleanup(func() { realtimeAPIBaseURL = base })
+
+	c := &Config{UID: "secret-uid"}
+	applyConfigDefaults(c)
+	c.Feeds = []FeedConfig{{ID: "a", AgencyID: "denied"}, {ID: "b", AgencyID: "broken"}, {ID: "c", AgencyID: "ok"}}
+	appConfig = &ConfigManager{}
+	appConfig.current.Store(c)
+}
+
+// captureLog はテスト中のログを APIキーを除いて記録する
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	log.SetOutput(redactingWriter{&buf})
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestFetchRealtimeSkipsFailedFeeds(t *testing.T) {
+	withRealtimeAPI(t)
+	logs := captureLog(t)
+
+	vp := fetchVehiclePosition()
+	if len(vp.Entity) != 1 || vp.Entity[0].Vehicle.Trip.TripID != "c:t1" {
+		got, _ := json.Marshal(vp)
+		t.Errorf("fetchVehiclePosition() = %s", got)
+	}
+
+	tu := fetchTripUpdate()
+	if len(tu.Entity) != 1 || tu.Header.Timestamp != "1" || !tu.Entity[0].TripUpdate.Trip.ScheduleRelationship.is("CANCELED", 3) {
+		got, _ := json.Marshal(tu)
+		t.Errorf("fetchTripUpdate() = %s", got)
+	}
+
+	out := logs.String()
+	for _, want := range []string{"事業者 denied", "HTTPステータスエラー: 403", "事業者 broken", "JSONの解析に失敗"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("ログに %q がありません: %s", want, out)
+		}
+	}
+	if strings.Contains(out, "secret-uid") {
+		t.Errorf("ログにAPIキーが残っています: %s", out)
+	}
+}
+
+func TestFetchRealtimeFeedError(t *testing.T) {
+	withRealtimeAPI(t)
+
+	if _, err := fetchTripUpdateFeed("uid", "denied"); err == nil {
+		t.Error("HTTPステータスエラーがありません")
+	}
+	if _, err := fetchVehiclePositionFeed("uid", "broken"); err == nil {
+		t.Error("JSONの解析エラーがありません")
+	}
+}
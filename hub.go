@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkWebsocketOrigin,
+}
+
+const (
+	// クライアントから受け付けるメッセージの最大サイズ
+	wsReadLimit int64 = 4096
+	// この時間内に pong が返ってこない接続は切断する
+	wsPongWait time.Duration = 60 * time.Second
+	// ping の送信間隔 (wsPongWait より短くする)
+	wsPingPeriod time.Duration = wsPongWait * 9 / 10
+	// 1回の書き込みにかけられる時間
+	wsWriteWait time.Duration = 10 * time.Second
+	// クライアントごとの送信待ちメッセージ数
+	wsSendBuffer int = 8
+	// 送信待ちが溢れた回数がこれを超えたクライアントは切断する
+	wsMaxDropped int = 3
+	// heartbeat メッセージの送信間隔。ブラウザは ping を検知できないため、クライアントはこれで接続断を判断する
+	wsHeartbeatPeriod time.Duration = 15 * time.Second
+)
+
+// クライアントに送るメッセージの形式のバージョン。互換性のない変更をした場合に上げる
+const wsProtocolVersion int = 1
+
+// wsEnvelope はクライアントに送るメッセージの共通形式
+//
+//	{"version": 1, "type": "board", "seq": 12, "generated_at": "...", "payload": [...]}
+//
+// seq は運行情報 (board) を作成するたびに増える番号で、heartbeat には最新の board の seq が入る。
+// クライアントは heartbeat の seq が手元の board と異なれば resume を送って最新の board を取り直す。
+// ページ送りするクライアントには board の代わりに page (boardPage) を送る。seq は元の board のもの。
+type wsEnvelope struct {
+	Version     int         `json:"version"`
+	Type        string      `json:"type"`
+	Seq         uint64      `json:"seq"`
+	GeneratedAt time.Time   `json:"generated_at"`
+	Payload     interface{} `json:"payload"`
+}
+
+// heartbeatPayload は heartbeat メッセージの内容
+type heartbeatPayload struct {
+	// 次の heartbeat までの秒数
+	Interval int `json:"interval"`
+}
+
+// hubMessage は hub が配信する board メッセージ
+type hubMessage struct {
+	seq  uint64
+	data []byte
+	// /api/board の ETag
+	etag string
+	// ページ送りするクライアントに送る page の元の運行情報
+	board []TimeTable
+}
+
+// newBoardMessage は運行情報を board メッセージにする
+func newBoardMessage(seq uint64, timetable []TimeTable) (hubMessage, error) {
+	data, err := json.Marshal(wsEnvelope{
+		Version:     wsProtocolVersion,
+		Type:        "board",
+		Seq:         seq,
+		GeneratedAt: time.Now(),
+		Payload:     timetable,
+	})
+	sum := sha256.Sum256(data)
+	return hubMessage{seq: seq, data: data, etag: `"` + hex.EncodeToString(sum[:16]) + `"`, board: timetable}, err
+}
+
+// hubClient は hub に登録された1つの接続 (websocket または Server-Sent Events)。
+// websocket への書き込みは writePump のみが行う
+type hubClient struct {
+	hub  *Hub
+	conn *websocket.Conn // Server-Sent Events の場合は nil
+	ip   string
+	send chan []byte
+	// hello メッセージで通知された発車標の情報 (readPump のみが操作する)
+	hello clientHello
+	// 送信待ちが溢れて古いメッセージを捨てた回数 (hub.run のみが操作する)
+	dropped int
+	// ページ送りの状態。nil の場合は board をそのまま送る (hub.run のみが操作する)
+	pager *boardPager
+}
+
+// Hub は接続中のクライアントを管理し、メッセージを全クライアントに配信する。
+// clients は run のゴルーチンのみが操作するため、ロックは不要。
+type Hub struct {
+	clients    map[*hubClient]bool
+	register   chan *hubClient
+	unregister chan *hubClient
+	broadcast  chan hubMessage
+	// 最新の board を送り直すよう求めたクライアント
+	resume chan *hubClient
+	// hello でページ送りに対応していると通知したクライアント
+	paging chan pagingRequest
+	// 最後に配信した board。接続直後や resume を送ったクライアント、/api/board に返す
+	latest atomic.Pointer[hubMessage]
+}
+
+// clientHello は接続直後にクライアントが送る自己紹介
+//
+//	{"type": "hello", "sign_id": "east-1", "language": "ja", "capabilities": ["timetable", "pages"]}
+//
+// capabilities に "pages" を含めると、発車標のレイアウトの rows ごとにページ送りした page を受け取る。
+type clientHello struct {
+	Type         string   `json:"type"`
+	SignID       string   `json:"sign_id"`
+	Language     string   `json:"language"`
+	Capabilities []string `json:"capabilities"`
+	// 再接続時、最後に受信した board の seq
+	LastSeq uint64 `json:"last_seq"`
+}
+
+var hub = newHub()
+
+func newHub() *Hub {
+	return &Hub{
+		clients:    make(map[*hubClient]bool),
+		register:   make(chan *hubClient),
+		unregister: make(chan *hubClient),
+		broadcast:  make(chan hubMessage),
+		resume:     make(chan *hubClient),
+		paging:     make(chan pagingRequest),
+	}
+}
+
+func (h *Hub) run() {
+	heartbeat := time.NewTicker(wsHeartbeatPeriod)
+	defer heartbeat.Stop()
+	pageTicker := time.NewTicker(pageTickPeriod)
+	defer pageTicker.Stop()
+
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+			// 次の配信を待たずに現在の運行情報を表示できるようにする
+			if latest := h.latest.Load(); latest != nil {
+				c.send <- latest.data
+			}
+
+		case c := <-h.unregister:
+			h.remove(c)
+
+		case c := <-h.resume:
+			if latest := h.latest.Load(); h.clients[c] && latest != nil {
+				h.deliver(c, h.messageFor(c, latest, time.Now()))
+			}
+
+		case req := <-h.paging:
+			if !h.clients[req.client] {
+				continue
+			}
+			req.client.pager = req.pager
+			// 接続直後に送った board をページ送りした表示に置き換える
+			if latest := h.latest.Load(); latest != nil {
+				h.deliver(req.client, h.messageFor(req.client, latest, time.Now()))
+			}
+
+		case message := <-h.broadcast:
+			h.latest.Store(&message)
+			now := time.Now()
+			for c := range h.clients {
+				h.deliver(c, h.messageFor(c, &message, now))
+			}
+
+		case now := <-pageTicker.C:
+			latest := h.latest.Load()
+			if latest == nil {
+				continue
+			}
+			for c := range h.clients {
+				if c.pager == nil || now.Sub(c.pager.flippedAt) < c.pager.interval {
+					continue
+				}
+				c.pager.flippedAt = now
+				if c.pager.pages <= 1 {
+					continue
+				}
+				c.pager.page++
+				h.deliver(c, h.messageFor(c, latest, now))
+			}
+
+		case now := <-heartbeat.C:
+			var seq uint64
+			if latest := h.latest.Load(); latest != nil {
+				seq = latest.seq
+			}
+			data, err := json.Marshal(wsEnvelope{
+				Version:     wsProtocolVersion,
+				Type:        "heartbeat",
+				Seq:         seq,
+				GeneratedAt: now,
+				Payload:     heartbeatPayload{Interval: int(wsHeartbeatPeriod / time.Second)},
+			})
+			if err != nil {
+				log.Println("Error marshalling JSON:", err)
+				continue
+			}
+			for c := range h.clients {
+				// 送信待ちがある場合はそのメッセージが heartbeat の代わりになるため、board を押し出さない
+				select {
+				case c.send <- data:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// deliver はクライアントの送信キューにメッセージを入れる。
+// キューが一杯の場合は最も古いメッセージを捨て (運行情報は毎回全体を送るため最新があれば足りる)、
+// それが続くクライアントは遅すぎるものとして切断する。
+func (h *Hub) deliver(c *hubClient, message []byte) {
+	select {
+	case c.send <- message:
+		c.dropped = 0
+		return
+	default:
+	}
+
+	c.dropped++
+	if c.dropped > wsMaxDropped {
+		log.Printf("送信が追いつかないクライアントを切断します (%s)", c.ip)
+		h.remove(c)
+		return
+	}
+	select {
+	case <-c.send:
+	default:
+	}
+	select {
+	case c.send <- message:
+	default:
+	}
+}
+
+// messageFor はクライアントに送る運行情報を返す。ページ送りするクライアントには現在のページを返す
+func (h *Hub) messageFor(c *hubClient, latest *hubMessage, now time.Time) []byte {
+	if c.pager == nil {
+		return latest.data
+	}
+	data, err := c.pager.pageMessage(latest, now)
+	if err != nil {
+		log.Println("Error marshalling JSON:", err)
+		return latest.data
+	}
+	return data
+}
+
+// Latest は最後に配信した board を返す。まだ作成されていなければ nil
+func (h *Hub) Latest() *hubMessage {
+	return h.latest.Load()
+}
+
+// remove はクライアントの登録を解除し、送信側 (writePump など) を終了させる
+func (h *Hub) remove(c *hubClient) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// readPump はクライアントからのメッセージを読み込む。接続が切れたら登録を解除する
+func (c *hubClient) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(wsReadLimit)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			return
+		}
+		c.handleMessage(message)
+	}
+}
+
+// handleMessage はクライアントからのメッセージを処理する。不正なメッセージは記録して無視する
+func (c *hubClient) handleMessage(message []byte) {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		log.Printf("クライアントからのメッセージを解釈できません (%s): %v", c.ip, err)
+		return
+	}
+
+	switch msg.Type {
+	case "hello":
+		var hello clientHello
+		if err := json.Unmarshal(message, &hello); err != nil {
+			log.Printf("hello メッセージを解釈できません (%s): %v", c.ip, err)
+			return
+		}
+		if hello.SignID != "" && !knownSign(hello.SignID) {
+			log.Printf("設定にない発車標ID %q からの接続です (%s)", hello.SignID, c.ip)
+		}
+		c.hello = hello
+		log.Printf("発車標が接続しました: id=%q language=%q capabilities=%v last_seq=%d (%s)", hello.SignID, hello.Language, hello.Capabilities, hello.LastSeq, c.ip)
+		if contains(hello.Capabilities, "pages") {
+			// レイアウトの rows が 0 の場合も nil を渡して、以前の hello のページ送りを解除する
+			c.hub.paging <- pagingRequest{client: c, pager: newBoardPager(appConfig.Get().signLayout(hello.SignID), time.Now())}
+		}
+	case "resume":
+		// 接続直後には最新の board を送っているため、接続中に取りこぼした場合のみ届く
+		c.hub.resume <- c
+	default:
+		log.Printf("未対応のメッセージ %q を無視します (%s)", msg.Type, c.ip)
+	}
+}
+
+// knownSign は発車標IDが設定の signs に含まれるかを返す
+func knownSign(id string) bool {
+	for _, s := range appConfig.Get().Signs {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// writePump は送信キューのメッセージと ping を書き込む
+func (c *hubClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				// hub が登録を解除した
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("error: %v", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ハンドシェイク中を含む接続数 (全体・IPごと)
+var connectionCount int
+var connectionsPerIP = make(map[string]int)
+var connectionMutex sync.Mutex
+
+// checkWebsocketOrigin は同一ホスト、または security.allowedOrigins に含まれるオリジンからの接続のみ許可する
+func checkWebsocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// ブラウザ以外のクライアント
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range appConfig.Get().Security.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireConnection は接続数の上限を確認し、空きがあれば枠を確保する
+func acquireConnection(ip string) error {
+	security := appConfig.Get().Security
+
+	connectionMutex.Lock()
+	defer connectionMutex.Unlock()
+
+	if connectionCount >= security.MaxConnections {
+		return fmt.Errorf("接続数が上限 (%d) に達しています", security.MaxConnections)
+	}
+	if connectionsPerIP[ip] >= security.MaxConnectionsPerIP {
+		return fmt.Errorf("%s からの接続数が上限 (%d) に達しています", ip, security.MaxConnectionsPerIP)
+	}
+	connectionCount++
+	connectionsPerIP[ip]++
+	return nil
+}
+
+// releaseConnection は acquireConnection で確保した枠を解放する
+func releaseConnection(ip string) {
+	connectionMutex.Lock()
+	defer connectionMutex.Unlock()
+
+	connectionCount--
+	if connectionsPerIP[ip]--; connectionsPerIP[ip] <= 0 {
+		delete(connectionsPerIP, ip)
+	}
+}
+
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	hub.serveWebsocket(w, r)
+}
+
+// serveWebsocket は接続数の上限を確認してから websocket に切り替え、クライアントを h に登録する
+func (h *Hub) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	if err := acquireConnection(ip); err != nil {
+		log.Printf("websocket接続を拒否しました: %v", err)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade がエラー応答を返しているため、この接続だけを終了する
+		log.Printf("websocketのハンドシェイクに失敗しました (%s): %v", ip, err)
+		releaseConnection(ip)
+		return
+	}
+	defer releaseConnection(ip)
+
+	client := &hubClient{hub: h, conn: ws, ip: ip, send: make(chan []byte, wsSendBuffer)}
+	h.register <- client
+
+	fmt.Println("Client connected")
+
+	go client.writePump()
+	client.readPump()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTestHub は接続数の上限を設定した hub と websocket のテスト用サーバを起動し、/ws のURLを返す
+func startTestHub(t *testing.T, maxConnections, maxConnectionsPerIP int) (*Hub, string) {
+	t.Helper()
+
+	c := &Config{}
+	c.Security.MaxConnections = maxConnections
+	c.Security.MaxConnectionsPerIP = maxConnectionsPerIP
+	applyConfigDefaults(c)
+	appConfig = &ConfigManager{}
+	appConfig.current.Store(c)
+
+	h := newHub()
+	go h.run()
+	server := httptest.NewServer(http.HandlerFunc(h.serveWebsocket))
+	t.Cleanup(func() {
+		server.Close()
+		// 次のテストが設定を差し替える前に、すべての接続の終了を待つ
+		waitForConnections(t, 0)
+	})
+	return h, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialTestHub(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("websocketの接続に失敗: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readTestMessage は heartbeat を読み飛ばして次のメッセージを返す
+func readTestMessage(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("メッセージの受信に失敗: %v", err)
+		}
+		if !strings.Contains(string(message), `"type":"heartbeat"`) {
+			return string(message)
+		}
+	}
+}
+
+// waitForConnections は接続数が want になるまで待つ
+func waitForConnections(t *testing.T, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		connectionMutex.Lock()
+		count := connectionCount
+		connectionMutex.Unlock()
+		if count == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("接続数 = %d, want %d", count, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testHubMessage(seq uint64) hubMessage {
+	return hubMessage{seq: seq, data: []byte(fmt.Sprintf(`{"type":"board","seq":%d}`, seq))}
+}
+
+// syncHub は hub.run がそれまでに送ったメッセージの処理を終えるまで待つ
+func syncHub(h *Hub) {
+	h.unregister <- &hubClient{}
+}
+
+func TestHubRegisterAndBroadcast(t *testing.T) {
+	h, url := startTestHub(t, 10, 10)
+	h.broadcast <- testHubMessage(1)
+
+	// 接続直後に最新の board を受け取る (受け取れば登録済み)
+	conns := make([]*websocket.Conn, 3)
+	for i := range conns {
+		conns[i] = dialTestHub(t, url)
+		if got := readTestMessage(t, conns[i]); got != string(testHubMessage(1).data) {
+			t.Fatalf("接続直後のメッセージ = %s", got)
+		}
+	}
+	waitForConnections(t, 3)
+
+	// すべてのクライアントに配信する
+	h.broadcast <- testHubMessage(2)
+	for i, conn := range conns {
+		if got := readTestMessage(t, conn); got != string(testHubMessage(2).data) {
+			t.Errorf("クライアント %d のメッセージ = %s", i, got)
+		}
+	}
+
+	// 切断したクライアントは登録を解除し、残りのクライアントには配信を続ける
+	conns[0].Close()
+	waitForConnections(t, 2)
+	h.broadcast <- testHubMessage(3)
+	for _, conn := range conns[1:] {
+		if got := readTestMessage(t, conn); got != string(testHubMessage(3).data) {
+			t.Errorf("メッセージ = %s", got)
+		}
+	}
+}
+
+func TestHubDropsSlowClient(t *testing.T) {
+	h := newHub()
+	go h.run()
+
+	// 受信しないクライアント (websocket は OS のバッファに溜まるため、送信キューを直接登録する)
+	c := &hubClient{hub: h, ip: "192.0.2.1", send: make(chan []byte, wsSendBuffer)}
+	h.register <- c
+
+	// キューが一杯になった後も wsMaxDropped 回までは古いメッセージを捨てて登録を続ける
+	for seq := 1; seq <= wsSendBuffer+wsMaxDropped; seq++ {
+		h.broadcast <- testHubMessage(uint64(seq))
+	}
+	syncHub(h)
+	if len(c.send) != wsSendBuffer {
+		t.Fatalf("送信キュー = %d 件", len(c.send))
+	}
+
+	// それを超えると切断して送信キューを閉じる
+	h.broadcast <- testHubMessage(uint64(wsSendBuffer + wsMaxDropped + 1))
+	syncHub(h)
+
+	got := make([]string, 0)
+	for message := range c.send {
+		got = append(got, string(message))
+	}
+	want := make([]string, 0)
+	for seq := wsMaxDropped + 1; seq <= wsSendBuffer+wsMaxDropped; seq++ {
+		want = append(want, string(testHubMessage(uint64(seq)).data))
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("残ったメッセージ = %v, want %v", got, want)
+	}
+}
+
+func TestHubSlowClientRecovers(t *testing.T) {
+	h := newHub()
+	go h.run()
+
+	c := &hubClient{hub: h, ip: "192.0.2.1", send: make(chan []byte, wsSendBuffer)}
+	h.register <- c
+	for seq := 1; seq <= wsSendBuffer+wsMaxDropped; seq++ {
+		h.broadcast <- testHubMessage(uint64(seq))
+	}
+	syncHub(h)
+
+	// 受信が追いついた場合は捨てた回数を数え直す
+	for range wsSendBuffer {
+		<-c.send
+	}
+	for seq := 1; seq <= wsSendBuffer+wsMaxDropped; seq++ {
+		h.broadcast <- testHubMessage(uint64(100 + seq))
+	}
+	syncHub(h)
+	if len(c.send) != wsSendBuffer {
+		t.Errorf("送信キュー = %d 件 (切断されました)", len(c.send))
+	}
+}
+
+func TestHubConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name                string
+		maxConnections      int
+		maxConnectionsPerIP int
+	}{
+		{"全体の上限", 2, 10},
+		{"IPごとの上限", 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, url := startTestHub(t, tt.maxConnections, tt.maxConnectionsPerIP)
+			h.broadcast <- testHubMessage(1)
+
+			first := dialTestHub(t, url)
+			readTestMessage(t, first)
+			second := dialTestHub(t, url)
+			readTestMessage(t, second)
+
+			// 上限を超えた接続はハンドシェイクの前に拒否する
+			_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+			if err == nil {
+				t.Fatal("上限を超えた接続が受け付けられました")
+			}
+			if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("上限を超えた接続の応答 = %v", resp)
+			}
+			waitForConnections(t, 2)
+
+			// 切断すると枠が空く
+			first.Close()
+			waitForConnections(t, 1)
+			third := dialTestHub(t, url)
+			if got := readTestMessage(t, third); got != string(testHubMessage(1).data) {
+				t.Errorf("メッセージ = %s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 発車標のレイアウト
+//
+// 列の並び・幅、文字の大きさや色、1画面の行数、ページの切り替え間隔、時計の位置を設定の layouts に定義し、
+// signs[].layout (未設定の場合は display.layout) で発車標ごとに選ぶ。
+// 画面の種類を増やす場合も HTML を編集する必要はない。
+
+// LayoutConfig は発車標の画面構成
+type LayoutConfig struct {
+	// レイアウトID (英数字と_)。signs[].layout と display.layout で指定する
+	ID string `json:"id"`
+	// 画面左上に表示する見出し (空の場合は表示しない)
+	Title   string         `json:"title,omitempty"`
+	Columns []LayoutColumn `json:"columns,omitempty"`
+	// 1画面に表示する行数 (0 の場合はすべて)。超えた分は pageInterval 秒ごとに切り替えて表示する
+	Rows         int `json:"rows,omitempty"`
+	PageInterval int `json:"pageInterval,omitempty"`
+	// ページを切り替えても先頭に固定する、まもなく出発する便の範囲 (分)。0 の場合は5分、-1 の場合は固定しない
+	PinMinutes int `json:"pinMinutes,omitempty"`
+	// 時計の位置 (layoutClockPositions のいずれか。空の場合は右上)
+	Clock string      `json:"clock,omitempty"`
+	Theme LayoutTheme `json:"theme"`
+}
+
+// LayoutColumn は時刻表の1列
+type LayoutColumn struct {
+	// 表示する項目 (layoutFields のいずれか)
+	Field string `json:"field"`
+	// 見出し (空の場合は項目ごとの既定の見出し)
+	Label string `json:"label,omitempty"`
+	// 列の幅 (CSS の長さ。例: "20%")
+	Width string `json:"width,omitempty"`
+	// 文字の配置 (left, center, right。空の場合は center)
+	Align string `json:"align,omitempty"`
+}
+
+// LayoutTheme は文字と色の設定。空の項目は既定のスタイルのまま
+type LayoutTheme struct {
+	FontFamily       string `json:"fontFamily,omitempty"`
+	FontSize         string `json:"fontSize,omitempty"` // 時刻表の文字の大きさ (CSS の長さ)
+	Background       string `json:"background,omitempty"`
+	Foreground       string `json:"foreground,omitempty"`
+	HeaderBackground string `json:"headerBackground,omitempty"`
+	HeaderForeground string `json:"headerForeground,omitempty"`
+	// 時計の文字色
+	Accent string `json:"accent,omitempty"`
+}
+
+// layoutFields は列に表示できる項目と既定の見出し
+var layoutFields = map[string]string{
+	// 定刻以外の場合は運行状況 (遅延など) と交互に表示する
+	"departure_time": "出発時刻",
+	// 系統の色のバッジと路線名。路線名の下に事業者名を小さく表示する
+	"route":       "路線名",
+	"destination": "行先",
+	"operator":    "事業者",
+	"delay":       "遅延",
+	"remark":      "備考",
+	// 運行状況 (定刻、遅延、まもなく、発車済、運休、始発待ち、臨時便)
+	"status": "運行状況",
+}
+
+var layoutClockPositions = []string{"top-right", "top-left", "bottom", "none"}
+
+var layoutAlignments = []string{"left", "center", "right"}
+
+// 既定のレイアウト (layouts が未設定の場合や、指定されたレイアウトがない場合に使う)
+const defaultLayoutID string = "default"
+
+// ページの切り替え間隔の既定値 (秒)
+const defaultPageInterval int = 10
+
+func defaultLayout() LayoutConfig {
+	return LayoutConfig{
+		ID:    defaultLayoutID,
+		Title: "サイネージ(仮)",
+		Columns: []LayoutColumn{
+			{Field: "departure_time", Width: "20%"},
+			{Field: "route", Width: "50%"},
+			{Field: "destination", Width: "30%"},
+		},
+		// 以前からの発車標の表示を変えないよう、既定ではページ送りしない (rows を設定したレイアウトのみ)
+		Rows:  0,
+		Clock: "top-right",
+		// Bootstrap の fs-1 と同じ大きさ
+		Theme: LayoutTheme{FontSize: "calc(1.375rem + 1.5vw)"},
+	}
+}
+
+var (
+	cssLengthPattern = regexp.MustCompile(`^(\d+(\.\d+)?(px|rem|em|vh|vw|vmin|vmax|%|pt)|calc\([0-9a-z.%+\-*/ ]+\))$`)
+	cssColorPattern  = regexp.MustCompile(`^(#[0-9A-Fa-f]{3,8}|[A-Za-z]+|rgba?\([0-9., %]+\))$`)
+	cssFontPattern   = regexp.MustCompile(`^[\p{L}\p{N} ,'\-]+$`)
+)
+
+// clone は列も含めてレイアウトを複製する
+func (l LayoutConfig) clone() LayoutConfig {
+	l.Columns = append([]LayoutColumn(nil), l.Columns...)
+	return l
+}
+
+// layout は ID のレイアウトを返す。見つからなければ既定のレイアウトを返す
+func (c *Config) layout(id string) LayoutConfig {
+	for _, l := range c.Layouts {
+		if l.ID == id {
+			return l.clone()
+		}
+	}
+	return defaultLayout()
+}
+
+// signLayout は発車標のレイアウトを返す。発車標が未設定の場合は display.layout を使う
+func (c *Config) signLayout(signID string) LayoutConfig {
+	for _, s := range c.Signs {
+		if s.ID == signID && s.Layout != "" {
+			return c.layout(s.Layout)
+		}
+	}
+	return c.layout(c.Display.Layout)
+}
+
+// validateLayouts はレイアウトの定義と、発車標から参照しているレイアウトIDを検証する
+func validateLayouts(config *Config) error {
+	errs := make([]error, 0)
+
+	// 既定のレイアウトは同じIDで定義して置き換えられる
+	seen := make(map[string]bool)
+	for _, l := range config.Layouts {
+		if !feedIDPattern.MatchString(l.ID) {
+			errs = append(errs, fmt.Errorf("レイアウトID %q は英数字と_のみ使用できます", l.ID))
+		}
+		if seen[l.ID] {
+			errs = append(errs, fmt.Errorf("レイアウトID %q が重複しています", l.ID))
+		}
+		seen[l.ID] = true
+
+		if len(l.Columns) == 0 {
+			errs = append(errs, fmt.Errorf("レイアウト %s の columns が空です", l.ID))
+		}
+		for _, col := range l.Columns {
+			if _, ok := layoutFields[col.Field]; !ok {
+				errs = append(errs, fmt.Errorf("レイアウト %s の列 %q は表示できません (%s)", l.ID, col.Field, strings.Join(layoutFieldNames(), ", ")))
+			}
+			if col.Width != "" && !cssLengthPattern.MatchString(col.Width) {
+				errs = append(errs, fmt.Errorf("レイアウト %s の列 %s の width %q はCSSの長さで指定してください", l.ID, col.Field, col.Width))
+			}
+			if col.Align != "" && !contains(layoutAlignments, col.Align) {
+				errs = append(errs, fmt.Errorf("レイアウト %s の列 %s の align は %s のいずれかで指定してください", l.ID, col.Field, strings.Join(layoutAlignments, ", ")))
+			}
+		}
+		if l.Rows < 0 || l.Rows > 1000 {
+			errs = append(errs, fmt.Errorf("レイアウト %s の rows は0から1000で指定してください: %d", l.ID, l.Rows))
+		}
+		if l.PageInterval != 0 && (l.PageInterval < 2 || l.PageInterval > 3600) {
+			errs = append(errs, fmt.Errorf("レイアウト %s の pageInterval は2から3600秒で指定してください: %d", l.ID, l.PageInterval))
+		}
+		if l.PinMinutes < -1 || l.PinMinutes > 120 {
+			errs = append(errs, fmt.Errorf("レイアウト %s の pinMinutes は-1から120分で指定してください: %d", l.ID, l.PinMinutes))
+		}
+		if l.Clock != "" && !contains(layoutClockPositions, l.Clock) {
+			errs = append(errs, fmt.Errorf("レイアウト %s の clock は %s のいずれかで指定してください", l.ID, strings.Join(layoutClockPositions, ", ")))
+		}
+
+		theme := l.Theme
+		if theme.FontSize != "" && !cssLengthPattern.MatchString(theme.FontSize) {
+			errs = append(errs, fmt.Errorf("レイアウト %s の theme.fontSize %q はCSSの長さで指定してください", l.ID, theme.FontSize))
+		}
+		if theme.FontFamily != "" && !cssFontPattern.MatchString(theme.FontFamily) {
+			errs = append(errs, fmt.Errorf("レイアウト %s の theme.fontFamily %q に使用できない文字が含まれています", l.ID, theme.FontFamily))
+		}
+		for _, color := range []struct{ name, value string }{
+			{"background", theme.Background},
+			{"foreground", theme.Foreground},
+			{"headerBackground", theme.HeaderBackground},
+			{"headerForeground", theme.HeaderForeground},
+			{"accent", theme.Accent},
+		} {
+			if color.value != "" && !cssColorPattern.MatchString(color.value) {
+				errs = append(errs, fmt.Errorf("レイアウト %s の theme.%s %q はCSSの色で指定してください", l.ID, color.name, color.value))
+			}
+		}
+	}
+
+	seen[defaultLayoutID] = true
+	if config.Display.Layout != "" && !seen[config.Display.Layout] {
+		errs = append(errs, fmt.Errorf("display.layout のレイアウト %q がありません", config.Display.Layout))
+	}
+	for _, s := range config.Signs {
+		if s.Layout != "" && !seen[s.Layout] {
+			errs = append(errs, fmt.Errorf("発車標 %s のレイアウト %q がありません", s.ID, s.Layout))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func layoutFieldNames() []string {
+	names := make([]string, 0, len(layoutFields))
+	for name := range layoutFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// layoutView は time-table.html に渡すレイアウト
+type layoutView struct {
+	LayoutConfig
+	SignID  string
+	Columns []layoutColumnView
+	// テーマを CSS 変数にしたもの (検証済みの値のみ)
+	Style template.CSS
+}
+
+type layoutColumnView struct {
+	LayoutColumn
+	Style template.CSS
+}
+
+func newLayoutView(layout LayoutConfig, signID string) layoutView {
+	if layout.Clock == "" {
+		layout.Clock = "top-right"
+	}
+	view := layoutView{LayoutConfig: layout, SignID: signID}
+	for _, col := range layout.Columns {
+		if col.Label == "" {
+			col.Label = layoutFields[col.Field]
+		}
+		if col.Align == "" {
+			col.Align = "center"
+		}
+		style := "text-align: " + col.Align + ";"
+		if col.Width != "" {
+			style += " width: " + col.Width + ";"
+		}
+		view.Columns = append(view.Columns, layoutColumnView{LayoutColumn: col, Style: template.CSS(style)})
+	}
+
+	vars := make([]string, 0)
+	for _, v := range []struct{ name, value string }{
+		{"--sign-font-family", layout.Theme.FontFamily},
+		{"--sign-font-size", layout.Theme.FontSize},
+		{"--sign-bg", layout.Theme.Background},
+		{"--sign-fg", layout.Theme.Foreground},
+		{"--sign-header-bg", layout.Theme.HeaderBackground},
+		{"--sign-header-fg", layout.Theme.HeaderForeground},
+		{"--sign-accent", layout.Theme.Accent},
+	} {
+		if v.value != "" {
+			vars = append(vars, v.name+": "+v.value+";")
+		}
+	}
+	view.Style = template.CSS(strings.Join(vars, " "))
+	return view
+}
+
+// timetableHandler は発車標を表示する。?sign=<発車標ID> の設定のレイアウトで描画する
+func timetableHandler(w http.ResponseWriter, r *http.Request) {
+	signID := r.URL.Query().Get("sign")
+	renderTemplate(w, "time-table", newLayoutView(appConfig.Get().signLayout(signID), signID))
+}
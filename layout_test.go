@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testLayoutConfig は検証を通るレイアウトを1つ持つ設定を返す
+func testLayoutConfig() *Config {
+	c := &Config{
+		Layouts: []LayoutConfig{{
+			ID:      "lobby",
+			Columns: []LayoutColumn{{Field: "departure_time", Width: "20%"}, {Field: "destination", Width: "calc(100% - 4rem)", Align: "left"}},
+			Theme: LayoutTheme{
+				FontFamily: "'Noto Sans JP', sans-serif",
+				FontSize:   "2.5rem",
+				Background: "#000",
+				Foreground: "rgba(255, 255, 255, 0.9)",
+				Accent:     "orange",
+			},
+		}},
+		Display: DisplayConfig{Layout: "lobby"},
+		Signs:   []SignConfig{{ID: "east", Layout: "lobby"}, {ID: "west", Layout: defaultLayoutID}, {ID: "north"}},
+	}
+	applyConfigDefaults(c)
+	return c
+}
+
+func TestValidateLayouts(t *testing.T) {
+	if err := validateLayouts(testLayoutConfig()); err != nil {
+		t.Fatalf("有効な設定: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{"width の ;", func(c *Config) { c.Layouts[0].Columns[0].Width = "20%; color: red" }, "width"},
+		{"width の }", func(c *Config) { c.Layouts[0].Columns[0].Width = "20%} body {display: none" }, "width"},
+		{"width の url(", func(c *Config) { c.Layouts[0].Columns[0].Width = "url(https://evil.example/)" }, "width"},
+		{"calc の中の url(", func(c *Config) { c.Layouts[0].Columns[0].Width = "calc(url(x))" }, "width"},
+		{"fontSize の expression(", func(c *Config) { c.Layouts[0].Theme.FontSize = "expression(alert(1))" }, "fontSize"},
+		{"fontFamily の ;", func(c *Config) { c.Layouts[0].Theme.FontFamily = "serif; background: red" }, "fontFamily"},
+		{"fontFamily の url(", func(c *Config) { c.Layouts[0].Theme.FontFamily = "url(https://evil.example/font)" }, "fontFamily"},
+		{"background の url(", func(c *Config) { c.Layouts[0].Theme.Background = "url(https://evil.example/x.png)" }, "background"},
+		{"foreground の expression(", func(c *Config) { c.Layouts[0].Theme.Foreground = "expression(alert(1))" }, "foreground"},
+		{"headerBackground の }", func(c *Config) { c.Layouts[0].Theme.HeaderBackground = "red}" }, "headerBackground"},
+		{"accent の ;", func(c *Config) { c.Layouts[0].Theme.Accent = "red; --x: y" }, "accent"},
+		{"rgba の中の ;", func(c *Config) { c.Layouts[0].Theme.Background = "rgb(0;0;0)" }, "background"},
+		{"align の値", func(c *Config) { c.Layouts[0].Columns[0].Align = "justify" }, "align"},
+		{"未知の列", func(c *Config) { c.Layouts[0].Columns[0].Field = "price" }, "price"},
+		{"レイアウトIDの文字", func(c *Config) { c.Layouts[0].ID = "lobby-1" }, "英数字と_"},
+		{"レイアウトIDの重複", func(c *Config) { c.Layouts = append(c.Layouts, c.Layouts[0].clone()) }, "重複"},
+		{"発車標の未知のレイアウト", func(c *Config) { c.Signs[0].Layout = "platform" }, `発車標 east のレイアウト "platform"`},
+		{"display の未知のレイアウト", func(c *Config) { c.Display.Layout = "platform" }, `display.layout のレイアウト "platform"`},
+		{"pinMinutes の範囲", func(c *Config) { c.Layouts[0].PinMinutes = -2 }, "pinMinutes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testLayoutConfig()
+			tt.modify(c)
+			err := validateLayouts(c)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateLayouts = %v, want %q を含むエラー", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewLayoutView(t *testing.T) {
+	c := testLayoutConfig()
+
+	view := newLayoutView(c.signLayout("east"), "east")
+	if view.Clock != "top-right" {
+		t.Errorf("Clock = %q", view.Clock)
+	}
+	wantColumns := []struct {
+		label, style string
+	}{
+		{"出発時刻", "text-align: center; width: 20%;"},
+		{"行先", "text-align: left; width: calc(100% - 4rem);"},
+	}
+	if len(view.Columns) != len(wantColumns) {
+		t.Fatalf("列 = %+v", view.Columns)
+	}
+	for i, want := range wantColumns {
+		if view.Columns[i].Label != want.label || string(view.Columns[i].Style) != want.style {
+			t.Errorf("列 %d = %q %q, want %q %q", i, view.Columns[i].Label, view.Columns[i].Style, want.label, want.style)
+		}
+	}
+	wantStyle := "--sign-font-family: 'Noto Sans JP', sans-serif; --sign-font-size: 2.5rem; --sign-bg: #000; " +
+		"--sign-fg: rgba(255, 255, 255, 0.9); --sign-accent: orange;"
+	if string(view.Style) != wantStyle {
+		t.Errorf("Style = %q, want %q", view.Style, wantStyle)
+	}
+
+	// 既定のレイアウトを指定した発車標と、レイアウト未設定の発車標 (display.layout を使う)
+	if got := c.signLayout("west").ID; got != defaultLayoutID {
+		t.Errorf("west のレイアウト = %q", got)
+	}
+	if got := c.signLayout("north").ID; got != "lobby" {
+		t.Errorf("north のレイアウト = %q", got)
+	}
+	// 設定にない発車標は display.layout を使う
+	if got := c.signLayout("unknown").ID; got != "lobby" {
+		t.Errorf("未設定の発車標のレイアウト = %q", got)
+	}
+}
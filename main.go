@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 )
 
 // 設定ファイル
@@ -15,22 +17,65 @@ const staticDbFile string = "static.sql"
 const dynamicDbFile string = "dynamic.sql"
 
 func main() {
-	config, configErr := readOrCreateConfig(configPath)
+	// ログにAPIキーが残らないようにする
+	log.SetOutput(redactingWriter{os.Stderr})
+
+	diffOld := flag.String("diff-old", "", "比較元の静的DBファイルまたはGTFSディレクトリ")
+	diffNew := flag.String("diff-new", "", "比較先の静的DBファイルまたはGTFSディレクトリ")
+	diffStop := flag.String("diff-stop", "", "差分の対象とする停留所名")
+	importSource := flag.String("import", "", "取り込む静的GTFSのZIPファイルまたはディレクトリ")
+	importFeed := flag.String("import-feed", "", "取り込み先のフィードID (複数事業者の場合)")
+	registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	// フィード差分を表示して終了
+	if *diffOld != "" || *diffNew != "" {
+		var stopNames []string
+		if *diffStop != "" {
+			stopNames = []string{*diffStop}
+		}
+		diff, err := diffFeeds(*diffOld, *diffNew, stopNames)
+		if err != nil {
+			fmt.Printf("Failed to compare feeds: %v\n", err)
+			os.Exit(1)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(diff)
+		return
+	}
+
+	var configErr error
+	appConfig, configErr = newConfigManager(configPath)
 	if configErr != nil {
-		fmt.Printf("Failed to open config file: %v\n", configErr)
+		fmt.Printf("Invalid configuration:\n%v\n", configErr)
+		os.Exit(1)
 	}
+	go appConfig.watch()
 
-	var port string = "8888"
-	var errorMessage, errorTitle string
+	config := appConfig.Get()
+	databaseDir = config.Server.DatabaseDir
+	var port string = config.Server.Port
+
+	// ローカルの静的フィードを取り込む (インターネットに接続できない環境向け)
+	if *importSource != "" {
+		if err := importStaticFeed(staticDbFile, *importSource, *importFeed); err != nil {
+			fmt.Printf("Failed to import GTFS: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	// DBが存在しなければ初期化
-	staticDbFilePath := filepath.Join("./databases", staticDbFile)
-	dynamicDbFilePath := filepath.Join("./databases", dynamicDbFile)
+	staticDbFilePath := databasePath(staticDbFile)
+	dynamicDbFilePath := databasePath(dynamicDbFile)
 
 	if _, err := os.Stat(staticDbFilePath); os.IsNotExist(err) {
 		initStaticDb(staticDbFile)
 	} else if err == nil {
 		fmt.Println(staticDbFilePath, "は存在します。")
+		if err := ensureStaticSchema(staticDbFile); err != nil {
+			fmt.Println("静的DBのスキーマ更新に失敗しました:", err)
+		}
 	} else {
 		fmt.Println("ファイル", staticDbFilePath, "の状態を確認中にエラーが発生しました:", err)
 	}
@@ -43,22 +88,19 @@ func main() {
 		fmt.Println("ファイル", dynamicDbFilePath, "の状態を確認中にエラーが発生しました:", err)
 	}
 
-	// feedの期限を確認
-	checkFeedEndDate(staticDbFile, updateStatic)
-
-	if config.UID == "" {
-		errorMessage = "API key is empty."
-		errorTitle = "API key error"
-	}
+	// 新しいフィードの有無を定期的に確認 (起動時に期限が切れていればすぐに更新する)
+	go startFeedScheduler(staticDbFile)
 
 	// Bootstrap読み込み
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	// トップページ
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Query().Get("settings_saved") == "true" {
-			errorMessage = "Please restart the server to apply the new settings."
-			errorTitle = "Restart required"
+		// 設定は再読み込みされるため、表示のたびに確認する
+		var errorMessage, errorTitle string
+		if appConfig.Get().UID == "" {
+			errorMessage = "API key is empty."
+			errorTitle = "API key error"
 		}
 
 		data := struct {
@@ -77,15 +119,19 @@ func main() {
 	})
 
 	// 設定ページ
-	http.HandleFunc("/settings", func(w http.ResponseWriter, r *http.Request) {
-		renderTemplate(w, "settings", nil)
-	})
+	http.HandleFunc("/settings", requireRole(roleAdmin, settingsPageHandler))
+
+	// 設定の取得・保存
+	http.HandleFunc("/api/settings", requireRole(roleAdmin, settingsAPIHandler))
 
-	// 設定保存用
-	http.HandleFunc("/save_settings", submitHandler)
+	// 認証 (発車標の表示には不要。設定と更新は管理者、DBとフィード差分の閲覧は閲覧者以上)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/api/password", requireRole(roleAdmin, passwordHandler))
+	http.HandleFunc("/api/token", requireRole(roleAdmin, tokenHandler))
 
 	// DB更新用
-	http.HandleFunc("/update", updateHandler)
+	http.HandleFunc("/update", requireRole(roleAdmin, updateHandler))
 
 	// ヘルプページ
 	http.HandleFunc("/help", func(w http.ResponseWriter, r *http.Request) {
@@ -93,9 +139,20 @@ func main() {
 	})
 
 	// ダウンローダ
-	http.HandleFunc("/dl", downloadHandler)
+	http.HandleFunc("/dl", requireRole(roleAdmin, downloadHandler))
+
+	// 静的フィードの取り込み
+	http.HandleFunc("/import", requireRole(roleAdmin, importHandler))
+
+	// フィード差分
+	http.HandleFunc("/feed-diff", requireRole(roleViewer, feedDiffHandler))
+	http.HandleFunc("/api/feed-diff", requireRole(roleViewer, feedDiffAPIHandler))
+
+	// DBブラウザ
+	http.HandleFunc("/db", requireRole(roleViewer, dbBrowserHandler))
 
 	go broadcastTimetable()
+	go hub.run()
 	go handleBroadcasts()
 
 	// websocket
@@ -104,6 +161,30 @@ func main() {
 	// 時刻表
 	http.HandleFunc("/time-table", timetableHandler)
 
+	// 乗換案内
+	http.HandleFunc("/journey", journeyHandler)
+
+	// 路線図
+	http.HandleFunc("/route-diagram", routeDiagramHandler)
+
+	// 公開API (読み取り専用。定義は /api/v1/openapi.json)
+	http.HandleFunc("/api/v1/", apiNotFoundHandler)
+	http.HandleFunc("GET /api/v1/openapi.json", openAPIHandler)
+	http.HandleFunc("GET /api/v1/stops", apiHandler(apiStopsHandler))
+	http.HandleFunc("GET /api/v1/stops/nearby", apiNearbyStopsHandler)
+	http.HandleFunc("GET /api/v1/stops/{stop_id}", apiHandler(apiStopHandler))
+	http.HandleFunc("GET /api/v1/stops/{stop_id}/departures", apiHandler(apiDeparturesHandler))
+	http.HandleFunc("GET /api/v1/routes", apiHandler(apiRoutesHandler))
+	http.HandleFunc("GET /api/v1/routes/{route_id}", apiHandler(apiRouteHandler))
+	http.HandleFunc("GET /api/v1/routes/{route_id}/diagram", apiHandler(apiRouteDiagramHandler))
+	http.HandleFunc("GET /api/v1/trips/{trip_id}", apiHandler(apiTripHandler))
+	http.HandleFunc("GET /api/v1/vehicles", apiVehiclesHandler)
+	http.HandleFunc("GET /api/v1/journeys", apiJourneysHandler)
+
+	// websocket を使えないクライアント向けの運行情報 (JSON のポーリングと Server-Sent Events)
+	http.HandleFunc("/api/board", boardAPIHandler)
+	http.HandleFunc("/events", eventsHandler)
+
 	fmt.Printf("Listening on localhost:%s...\n", port)
 	err := http.ListenAndServe(":"+port, nil)
 	if err != nil {
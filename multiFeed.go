@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FeedConfig は取り込む事業者ごとのフィード設定
+type FeedConfig struct {
+	// IDの名前空間 (英数字と_)。複数の事業者のIDが衝突しないよう、各IDの先頭に "<ID>:" を付ける
+	ID       string `json:"id"`
+	AgencyID string `json:"agencyID"`
+	// 事業者名 (空の場合は agency.txt の agency_name を使用)
+	Name string `json:"name,omitempty"`
+}
+
+var feedIDPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// feeds は設定されたフィードの一覧を返す。
+// feeds が未設定の場合は従来通り agencyID の1事業者のみを名前空間なしで扱う。
+func (c *Config) feeds() []FeedConfig {
+	if len(c.Feeds) == 0 {
+		return []FeedConfig{{AgencyID: c.AgencyID}}
+	}
+
+	feeds := make([]FeedConfig, 0, len(c.Feeds))
+	seen := make(map[string]bool)
+	for _, f := range c.Feeds {
+		if !feedIDPattern.MatchString(f.ID) {
+			log.Printf("フィードID %q は英数字と_のみ使用できます。このフィードはスキップします。", f.ID)
+			continue
+		}
+		if seen[f.ID] {
+			log.Printf("フィードID %q が重複しています。このフィードはスキップします。", f.ID)
+			continue
+		}
+		seen[f.ID] = true
+		feeds = append(feeds, f)
+	}
+	return feeds
+}
+
+// isMultiFeed は名前空間付きの複数フィード構成かどうかを返す
+func isMultiFeed(feeds []FeedConfig) bool {
+	return len(feeds) > 1 || (len(feeds) == 1 && feeds[0].ID != "")
+}
+
+// namespacedID はフィードIDを接頭辞としてIDに付ける
+func namespacedID(feedID, id string) string {
+	if feedID == "" || id == "" {
+		return id
+	}
+	return feedID + ":" + id
+}
+
+// feedDir は root 以下のフィードごとのGTFSディレクトリを返す
+func feedDir(root string, feed FeedConfig) string {
+	if feed.ID == "" {
+		return root
+	}
+	return filepath.Join(root, feed.ID)
+}
+
+// 名前空間を付けるカラム (テーブル名 -> カラム名)
+var namespacedColumns = map[string][]string{
+	"agency":          {"agency_id"},
+	"calendar_dates":  {"service_id"},
+	"calendar":        {"service_id"},
+	"fare_attributes": {"fare_id", "agency_id"},
+	"fare_rules":      {"fare_id", "route_id", "origin_id", "destination_id", "contains_id"},
+	"feed_info":       {},
+	"office_jp":       {},
+	"routes":          {"route_id", "agency_id", "jp_parent_route_id"},
+	"shapes":          {"shape_id"},
+	"stops":           {"stop_id", "zone_id", "parent_station"},
+	"stop_times":      {"trip_id", "stop_id"},
+	"translations":    {"record_id"},
+	"trips":           {"route_id", "service_id", "trip_id", "block_id", "shape_id"},
+}
+
+// office_id は INTEGER PRIMARY KEY のため接頭辞ではなく、フィードごとのオフセットを加える
+var offsetColumns = map[string]bool{
+	"office_id":    true,
+	"jp_office_id": true,
+}
+
+// フィードごとの office_id のオフセット幅
+const officeIDOffset int = 1000000
+
+// buildMultiFeedStaticDb はフィードごとに静的DBを作成し、名前空間付きのIDで dbFile に統合する
+func buildMultiFeedStaticDb(dbFile string, gtfsRoot string, feeds []FeedConfig) error {
+	db, err := setupDb(dbFile)
+	if err != nil {
+		return fmt.Errorf("データベース接続に失敗: %w", err)
+	}
+	defer db.Close()
+
+	if err := createStaticTables(db); err != nil {
+		return fmt.Errorf("静的テーブルの作成に失敗: %w", err)
+	}
+
+	for i, feed := range feeds {
+		partDbFile := "part-" + feed.ID + "-" + dbFile
+		partDbPath := databasePath(partDbFile)
+
+		if err := buildStaticDb(partDbFile, feedDir(gtfsRoot, feed)); err != nil {
+			os.Remove(partDbPath)
+			return fmt.Errorf("フィード %s の静的DB作成に失敗: %w", feed.ID, err)
+		}
+		err := mergeFeedDb(db, partDbPath, feed, (i+1)*officeIDOffset)
+		os.Remove(partDbPath)
+		if err != nil {
+			return fmt.Errorf("フィード %s の統合に失敗: %w", feed.ID, err)
+		}
+		fmt.Printf("フィード %s の統合が完了しました。\n", feed.ID)
+	}
+
+	return nil
+}
+
+// mergeFeedDb はフィード単体の静的DBを名前空間付きで db に取り込む
+func mergeFeedDb(db *sql.DB, partDbPath string, feed FeedConfig, idOffset int) error {
+	// ATTACH はコネクション単位のため、1本のコネクションで処理する
+	db.SetMaxOpenConns(1)
+	defer db.SetMaxOpenConns(0)
+
+	if _, err := db.Exec("ATTACH DATABASE ? AS part", partDbPath); err != nil {
+		return fmt.Errorf("データベースのアタッチに失敗: %w", err)
+	}
+	defer db.Exec("DETACH DATABASE part")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("トランザクション開始に失敗: %w", err)
+	}
+	defer tx.Rollback()
+
+	prefix := feed.ID + ":"
+	for table, nsColumns := range namespacedColumns {
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+
+		ns := make(map[string]bool)
+		for _, c := range nsColumns {
+			ns[c] = true
+		}
+
+		selects := make([]string, 0, len(columns))
+		args := make([]interface{}, 0)
+		for _, c := range columns {
+			switch {
+			case c == "feed_id":
+				selects = append(selects, "?")
+				args = append(args, feed.ID)
+			case offsetColumns[c]:
+				selects = append(selects, fmt.Sprintf("CASE WHEN %[1]s IS NULL THEN NULL ELSE %[1]s + ? END", c))
+				args = append(args, idOffset)
+			case ns[c]:
+				selects = append(selects, fmt.Sprintf("CASE WHEN %[1]s IS NULL OR %[1]s = '' THEN %[1]s ELSE ? || %[1]s END", c))
+				args = append(args, prefix)
+			default:
+				selects = append(selects, c)
+			}
+		}
+
+		query := fmt.Sprintf("INSERT OR IGNORE INTO main.%s (%s) SELECT %s FROM part.%s",
+			table, strings.Join(columns, ", "), strings.Join(selects, ", "), table)
+		if _, err := tx.Exec(query, args...); err != nil {
+			return fmt.Errorf("%sテーブルの統合に失敗: %w", table, err)
+		}
+	}
+
+	// 事業者名の上書き、または agency.txt がない場合の補完
+	if feed.Name != "" {
+		agencyID := namespacedID(feed.ID, feed.AgencyID)
+		_, err = tx.Exec(`UPDATE main.agency SET agency_name = ? WHERE feed_id = ?`, feed.Name, feed.ID)
+		if err != nil {
+			return fmt.Errorf("事業者名の更新に失敗: %w", err)
+		}
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO main.agency (agency_id, agency_name, feed_id)
+			SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM main.agency WHERE feed_id = ?)
+		`, agencyID, feed.Name, feed.ID, feed.ID)
+		if err != nil {
+			return fmt.Errorf("事業者情報の補完に失敗: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// tableColumns はテーブルのカラム名の一覧を返す
+func tableColumns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA main.table_info(%s)", table))
+	if err != nil {
+		return nil, fmt.Errorf("%sテーブルの情報取得に失敗: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// ensureStaticSchema は古い静的DBに事業者対応のテーブルとカラムを追加する
+func ensureStaticSchema(dbFile string) error {
+	db, err := setupDb(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := createStaticTables(db); err != nil {
+		return err
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('feed_info') WHERE name = 'feed_id'`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("feed_infoテーブルの確認に失敗: %w", err)
+	}
+	if count == 0 {
+		if _, err := db.Exec(`ALTER TABLE feed_info ADD COLUMN feed_id TEXT`); err != nil {
+			return fmt.Errorf("feed_infoテーブルの更新に失敗: %w", err)
+		}
+	}
+	return nil
+}
+
+// namespaceVehiclePosition は車両位置情報のIDにフィードIDを付ける
+func namespaceVehiclePosition(feedID string, data *VehiclePositionResponse) {
+	for i := range data.Entity {
+		e := &data.Entity[i]
+		e.ID = namespacedID(feedID, e.ID)
+		if e.Vehicle == nil {
+			continue
+		}
+		e.Vehicle.ID = namespacedID(feedID, e.Vehicle.ID)
+		e.Vehicle.StopID = namespacedID(feedID, e.Vehicle.StopID)
+		e.Vehicle.Trip.TripID = namespacedID(feedID, e.Vehicle.Trip.TripID)
+		e.Vehicle.Trip.RouteID = namespacedID(feedID, e.Vehicle.Trip.RouteID)
+	}
+}
+
+// namespaceTripUpdate は運行情報のIDにフィードIDを付ける
+func namespaceTripUpdate(feedID string, data *TripUpdateResponse) {
+	for i := range data.Entity {
+		e := &data.Entity[i]
+		e.ID = namespacedID(feedID, e.ID)
+		if e.TripUpdate == nil {
+			continue
+		}
+		e.TripUpdate.Trip.TripID = namespacedID(feedID, e.TripUpdate.Trip.TripID)
+		e.TripUpdate.Trip.RouteID = namespacedID(feedID, e.TripUpdate.Trip.RouteID)
+		if e.TripUpdate.Vehicle != nil {
+			e.TripUpdate.Vehicle.ID = namespacedID(feedID, e.TripUpdate.Vehicle.ID)
+		}
+		for j := range e.TripUpdate.StopTimeUpdate {
+			stu := &e.TripUpdate.StopTimeUpdate[j]
+			stu.StopID = namespacedID(feedID, stu.StopID)
+		}
+	}
+}
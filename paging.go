@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 発車標のページ送り
+//
+// レイアウトの rows を超える運行情報はページに分け、hub が pageInterval 秒ごとに次のページを送る。
+// まもなく出発する便 (pinMinutes 分以内) は全ページの先頭に固定し、残りの行のみを切り替える。
+// hello の capabilities に "pages" を含めたクライアントには board の代わりに page メッセージを送る。
+
+// ページ送りを確認する間隔
+const pageTickPeriod time.Duration = time.Second
+
+// 先頭に固定する便の出発までの時間 (分) の既定値
+const defaultPinMinutes int = 5
+
+// boardPage は page メッセージの内容
+type boardPage struct {
+	Page   int         `json:"page"` // 1 から
+	Pages  int         `json:"pages"`
+	Pinned int         `json:"pinned"` // rows の先頭の、固定した行数
+	Rows   []TimeTable `json:"rows"`
+}
+
+// boardPager はクライアントごとのページ送りの状態 (hub.run のみが操作する)
+type boardPager struct {
+	rows       int
+	pinMinutes int
+	interval   time.Duration
+	page       int
+	pages      int
+	flippedAt  time.Time
+}
+
+// pagingRequest は hello を受け取ったクライアントのページ送りを hub に登録する
+type pagingRequest struct {
+	client *hubClient
+	pager  *boardPager
+}
+
+// newBoardPager はレイアウトのページ送りの設定を返す。1画面の行数が決まっていなければ nil
+func newBoardPager(layout LayoutConfig, now time.Time) *boardPager {
+	if layout.Rows <= 0 {
+		return nil
+	}
+	pager := &boardPager{
+		rows:       layout.Rows,
+		pinMinutes: layout.PinMinutes,
+		interval:   time.Duration(layout.PageInterval) * time.Second,
+		flippedAt:  now,
+	}
+	if pager.pinMinutes == 0 {
+		pager.pinMinutes = defaultPinMinutes
+	}
+	if pager.interval == 0 {
+		pager.interval = time.Duration(defaultPageInterval) * time.Second
+	}
+	return pager
+}
+
+// minutesUntil は出発時刻 (HH:MM、24時以降を含む) までの分数を返す
+func minutesUntil(departure string, now time.Time) (int, bool) {
+	parts := strings.Split(departure, ":")
+	if len(parts) < 2 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	minutes := h*60 + m - (now.Hour()*60 + now.Minute())
+	// 深夜0時をまたいだ場合 (24時以降の表記と翌日の時刻)
+	if minutes < -12*60 {
+		minutes += 24 * 60
+	} else if h >= 24 && minutes > 12*60 {
+		minutes -= 24 * 60
+	}
+	return minutes, true
+}
+
+// paginateBoard は運行情報の page ページ目 (0 から。範囲外はページ数で割った余り) を返す。
+// 全体が1画面に収まらない場合、pinMinutes 分以内に出発する便を rows-1 行まで先頭に固定する (pinMinutes が負なら固定しない)
+func paginateBoard(board []TimeTable, rows int, pinMinutes int, page int, now time.Time) boardPage {
+	if len(board) <= rows {
+		return boardPage{Page: 1, Pages: 1, Rows: board}
+	}
+
+	pinned := make([]TimeTable, 0)
+	rest := make([]TimeTable, 0, len(board))
+	for _, t := range board {
+		// 発車済・運休の便は固定しない
+		imminent := t.Status != departureDeparted && t.Status != departureCancelled
+		if minutes, ok := minutesUntil(t.DepartureTime, now); ok && imminent && minutes >= 0 && minutes <= pinMinutes && len(pinned) < rows-1 {
+			pinned = append(pinned, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+
+	perPage := rows - len(pinned)
+	pages := max((len(rest)+perPage-1)/perPage, 1)
+	page %= pages
+	end := min((page+1)*perPage, len(rest))
+	return boardPage{
+		Page:   page + 1,
+		Pages:  pages,
+		Pinned: len(pinned),
+		Rows:   append(pinned, rest[page*perPage:end]...),
+	}
+}
+
+// pageMessage はクライアントの現在のページを page メッセージにする
+func (p *boardPager) pageMessage(latest *hubMessage, now time.Time) ([]byte, error) {
+	page := paginateBoard(latest.board, p.rows, p.pinMinutes, p.page, now)
+	// 運行情報が減ってページが範囲外になった場合は最初に戻る
+	p.page, p.pages = page.Page-1, page.Pages
+	return json.Marshal(wsEnvelope{
+		Version:     wsProtocolVersion,
+		Type:        "page",
+		Seq:         latest.seq,
+		GeneratedAt: now,
+		Payload:     page,
+	})
+}
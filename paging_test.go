@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewBoardPager(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+	// 既定のレイアウトはページ送りしない
+	if pager := newBoardPager(defaultLayout(), now); pager != nil {
+		t.Errorf("既定のレイアウトの pager = %+v", pager)
+	}
+
+	pager := newBoardPager(LayoutConfig{Rows: 4}, now)
+	if pager == nil || pager.rows != 4 || pager.pinMinutes != defaultPinMinutes || pager.interval != time.Duration(defaultPageInterval)*time.Second {
+		t.Errorf("rows を設定したレイアウトの pager = %+v", pager)
+	}
+}
+
+func TestMinutesUntil(t *testing.T) {
+	at := func(h, m, s int) time.Time {
+		return time.Date(2026, 10, 19, h, m, s, 0, time.UTC)
+	}
+	tests := []struct {
+		name      string
+		now       time.Time
+		departure string
+		want      int
+		wantOK    bool
+	}{
+		{"同じ日", at(8, 0, 0), "08:15", 15, true},
+		{"出発済", at(8, 0, 0), "07:58", -2, true},
+		{"秒は切り捨て", at(8, 0, 59), "08:01", 1, true},
+		// 深夜0時をまたぐ場合
+		{"翌日の時刻", at(23, 50, 0), "00:05", 15, true},
+		{"24時以降の表記", at(23, 50, 0), "24:05", 15, true},
+		{"0時以降に24時以降の表記", at(0, 10, 0), "24:30", 20, true},
+		{"0時以降に出発済の24時以降の表記", at(0, 10, 0), "24:05", -5, true},
+		{"12時間以上先の当日の時刻", at(6, 0, 0), "20:00", 840, true},
+		{"時刻でない", at(8, 0, 0), "--:--", 0, false},
+		{"区切りがない", at(8, 0, 0), "0815", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := minutesUntil(tt.departure, tt.now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("minutesUntil(%q) = %d %v, want %d %v", tt.departure, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// testBoard は "行先@HH:MM" または "行先@HH:MM@状況" の並びから運行情報を作る
+func testBoard(entries ...string) []TimeTable {
+	board := make([]TimeTable, 0, len(entries))
+	for _, e := range entries {
+		parts := strings.Split(e, "@")
+		row := TimeTable{Destination: parts[0], DepartureTime: parts[1], Status: departureOnTime}
+		if len(parts) > 2 {
+			row.Status = DepartureStatus(parts[2])
+		}
+		board = append(board, row)
+	}
+	return board
+}
+
+func TestPaginateBoard(t *testing.T) {
+	morning := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	midnight := time.Date(2026, 10, 19, 23, 58, 0, 0, time.UTC)
+	board := testBoard("A@08:02", "B@08:03", "C@08:04", "D@08:10", "E@08:20", "F@08:30", "G@08:40")
+
+	tests := []struct {
+		name       string
+		board      []TimeTable
+		rows       int
+		pinMinutes int
+		page       int
+		now        time.Time
+		wantPage   int
+		wantPages  int
+		wantPinned int
+		wantRows   string
+	}{
+		{"1画面に収まる", board[:3], 3, 5, 0, morning, 1, 1, 0, "A,B,C"},
+		{"1画面に収まればページ番号は無視", board[:3], 3, 5, 2, morning, 1, 1, 0, "A,B,C"},
+		// 5分以内の A-C のうち rows-1 の2件を固定し、残り5件を1行ずつ送る
+		{"固定は rows-1 行まで", board, 3, 5, 0, morning, 1, 5, 2, "A,B,C"},
+		{"2ページ目", board, 3, 5, 1, morning, 2, 5, 2, "A,B,D"},
+		{"最後のページ", board, 3, 5, 4, morning, 5, 5, 2, "A,B,G"},
+		{"ページ数を超えると最初に戻る", board, 3, 5, 5, morning, 1, 5, 2, "A,B,C"},
+		{"ページ数の2倍を超える", board, 3, 5, 12, morning, 3, 5, 2, "A,B,E"},
+		{"固定する時間が短い", board, 3, 2, 1, morning, 2, 3, 1, "A,D,E"},
+		{"pinMinutes -1 は固定しない", board, 3, -1, 0, morning, 1, 3, 0, "A,B,C"},
+		{"pinMinutes -1 の最後のページ", board, 3, -1, 2, morning, 3, 3, 0, "G"},
+		{"1行なら固定しない", board, 1, 5, 3, morning, 4, 7, 0, "D"},
+		{"発車済・運休・出発済の便は固定しない",
+			testBoard("A@08:01@departed", "B@08:02@cancelled", "C@07:59", "D@08:03@delayed", "E@08:30"),
+			3, 5, 0, morning, 1, 2, 1, "D,A,B"},
+		{"深夜0時をまたぐ便を固定する",
+			testBoard("X@24:01", "Y@00:03", "Z@00:30", "W@24:40"),
+			3, 5, 1, midnight, 2, 2, 2, "X,Y,W"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := paginateBoard(tt.board, tt.rows, tt.pinMinutes, tt.page, tt.now)
+			destinations := make([]string, 0, len(got.Rows))
+			for _, r := range got.Rows {
+				destinations = append(destinations, r.Destination)
+			}
+			if got.Page != tt.wantPage || got.Pages != tt.wantPages || got.Pinned != tt.wantPinned {
+				t.Errorf("page %d/%d pinned %d, want %d/%d pinned %d", got.Page, got.Pages, got.Pinned, tt.wantPage, tt.wantPages, tt.wantPinned)
+			}
+			if rows := strings.Join(destinations, ","); rows != tt.wantRows {
+				t.Errorf("rows = %s, want %s", rows, tt.wantRows)
+			}
+		})
+	}
+}
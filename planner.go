@@ -0,0 +1,665 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 乗換案内 (RAPTOR)
+//
+// 運行日ごとに、その日に運行する便を停車順が同じもの (パターン) にまとめてメモリに読み込み、
+// 乗車回数ごとに各停留所への最早到着時刻を求める。
+// 運行日をまたぐ便は考慮しない (24時以降の時刻は同じ運行日の続きとして扱う)。
+// 今日の経路は stop_time_update の遅延を反映した時刻で求める (withDelays)。
+
+const (
+	// 乗換回数の既定値と上限
+	plannerDefaultTransfers int = 3
+	plannerMaxTransfers     int = 5
+	// 同じ停留所で乗り換える場合に確保する時間 (秒)
+	plannerTransferSlack int = 60
+	// 徒歩で乗り換えられる停留所間の距離 (メートル) と歩く速さ (メートル毎秒)
+	plannerWalkDistance float64 = 400
+	plannerWalkSpeed    float64 = 1.2
+	// 直線距離に対する実際の道のりの比率
+	plannerWalkDetour float64 = 1.3
+	// 保持する運行日の数
+	plannerCacheSize int = 2
+	// 遅れている便からの乗換で、余裕がこれより短いものを乗り継げない恐れありとする (秒)
+	plannerAtRiskMargin int = 180
+)
+
+const plannerUnreachable int = math.MaxInt32
+
+type raptorTrip struct {
+	id       string
+	routeID  string
+	headsign string
+	// パターンの停留所ごとの到着・発車時刻 (運行日の0時からの秒数)
+	arrivals   []int
+	departures []int
+	// stop_times の stop_sequence (遅延の参照に使う)
+	sequences []int
+	// 停留所ごとの到着・発車の遅延 (秒)。リアルタイム情報がなければ nil
+	arrivalDelays   []int
+	departureDelays []int
+}
+
+// raptorPattern は停車順が同じ便の集まり
+type raptorPattern struct {
+	stops []int
+	trips []raptorTrip
+}
+
+// raptorPatternStop はある停留所を通るパターンと、その停留所のパターン内の位置
+type raptorPatternStop struct {
+	pattern int
+	index   int
+}
+
+type raptorFootpath struct {
+	to       int
+	duration int // 秒
+	distance float64
+}
+
+// raptorTimetable は1運行日分の時刻表
+type raptorTimetable struct {
+	date         time.Time
+	modTime      time.Time
+	stops        []apiStop
+	stopIDs      map[string]int
+	patterns     []raptorPattern
+	stopPatterns [][]raptorPatternStop
+	footpaths    [][]raptorFootpath
+	routes       map[string]apiRoute
+}
+
+var plannerCache = make(map[string]*raptorTimetable)
+var plannerMutex sync.Mutex
+
+// plannerTimetable は運行日の時刻表を返す。静的DBが更新されていれば読み込み直す
+func plannerTimetable(date time.Time) (*raptorTimetable, error) {
+	index, err := currentStopIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	plannerMutex.Lock()
+	defer plannerMutex.Unlock()
+
+	day := date.Format("20060102")
+	if tt, ok := plannerCache[day]; ok && tt.modTime.Equal(index.modTime) {
+		return tt, nil
+	}
+
+	db, err := openReadOnlyDb(staticDbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tt, err := loadRaptorTimetable(db, index, date)
+	if err != nil {
+		return nil, err
+	}
+
+	// 静的DBの更新前に読み込んだものと、保持する数を超えた分を捨てる
+	for key, cached := range plannerCache {
+		if !cached.modTime.Equal(index.modTime) || len(plannerCache) >= plannerCacheSize {
+			delete(plannerCache, key)
+		}
+	}
+	plannerCache[day] = tt
+	return tt, nil
+}
+
+// parseGTFSSeconds は GTFS の時刻 (HH:MM:SS) を0時からの秒数に変換する
+func parseGTFSSeconds(value string) (int, bool) {
+	t, ok := gtfsTimeOn(time.Time{}, value)
+	if !ok {
+		return 0, false
+	}
+	return int(t.Sub(time.Time{}) / time.Second), true
+}
+
+func loadRaptorTimetable(db *sql.DB, index *stopIndex, date time.Time) (*raptorTimetable, error) {
+	tt := &raptorTimetable{
+		date:    date,
+		modTime: index.modTime,
+		stops:   make([]apiStop, len(index.entries)),
+		stopIDs: make(map[string]int, len(index.entries)),
+		routes:  make(map[string]apiRoute),
+	}
+	for i, entry := range index.entries {
+		tt.stops[i] = entry.stop
+		tt.stopIDs[entry.stop.ID] = i
+	}
+
+	routes, err := queryRoutes(db, `SELECT `+apiRouteColumns+` FROM routes AS r LEFT JOIN agency AS a ON a.agency_id = r.agency_id`)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		tt.routes[r.ID] = r
+	}
+
+	day := date.Format("20060102")
+	rows, err := db.Query(`
+		SELECT st.trip_id, t.route_id, COALESCE(t.trip_headsign, ''), st.stop_id,
+			COALESCE(st.arrival_time, ''), COALESCE(st.departure_time, ''), CAST(st.stop_sequence AS INTEGER)
+		FROM stop_times AS st
+		JOIN trips AS t ON t.trip_id = st.trip_id
+		WHERE st.departure_time GLOB '[0-9]*' AND t.service_id IN `+activeServicesSQL(date)+`
+		ORDER BY st.trip_id, CAST(st.stop_sequence AS INTEGER)`, day, day, day, day)
+	if err != nil {
+		return nil, fmt.Errorf("stop_timesの取得に失敗: %w", err)
+	}
+	defer rows.Close()
+
+	patternIDs := make(map[string]int)
+	var trip *raptorTrip
+	var tripStops []int
+	flush := func() {
+		if trip == nil || len(tripStops) < 2 {
+			return
+		}
+		key := fmt.Sprint(tripStops)
+		p, ok := patternIDs[key]
+		if !ok {
+			p = len(tt.patterns)
+			patternIDs[key] = p
+			tt.patterns = append(tt.patterns, raptorPattern{stops: tripStops})
+		}
+		tt.patterns[p].trips = append(tt.patterns[p].trips, *trip)
+	}
+
+	for rows.Next() {
+		var tripID, routeID, headsign, stopID, arrival, departure string
+		var sequence int
+		if err := rows.Scan(&tripID, &routeID, &headsign, &stopID, &arrival, &departure, &sequence); err != nil {
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		if trip == nil || trip.id != tripID {
+			flush()
+			trip = &raptorTrip{id: tripID, routeID: routeID, headsign: headsign}
+			tripStops = nil
+		}
+
+		s, ok := tt.stopIDs[stopID]
+		if !ok {
+			continue
+		}
+		dep, ok := parseGTFSSeconds(departure)
+		if !ok {
+			continue
+		}
+		arr, ok := parseGTFSSeconds(arrival)
+		if !ok {
+			arr = dep
+		}
+		tripStops = append(tripStops, s)
+		trip.arrivals = append(trip.arrivals, arr)
+		trip.departures = append(trip.departures, dep)
+		trip.sequences = append(trip.sequences, sequence)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	tt.indexPatterns()
+
+	tt.footpaths = make([][]raptorFootpath, len(tt.stops))
+	for s, stop := range tt.stops {
+		if stop.Lat == 0 && stop.Lon == 0 {
+			continue
+		}
+		for _, near := range index.Nearby(stop.Lat, stop.Lon, plannerWalkDistance) {
+			to := tt.stopIDs[near.ID]
+			if to == s {
+				continue
+			}
+			tt.footpaths[s] = append(tt.footpaths[s], raptorFootpath{
+				to:       to,
+				duration: int(math.Ceil(near.Distance * plannerWalkDetour / plannerWalkSpeed)),
+				distance: near.Distance,
+			})
+		}
+	}
+	return tt, nil
+}
+
+// indexPatterns はパターンの便を並べ替え、停留所ごとに通るパターンを求める
+func (tt *raptorTimetable) indexPatterns() {
+	tt.stopPatterns = make([][]raptorPatternStop, len(tt.stops))
+	for p := range tt.patterns {
+		pattern := &tt.patterns[p]
+		pattern.sortTrips()
+		for i, s := range pattern.stops {
+			tt.stopPatterns[s] = append(tt.stopPatterns[s], raptorPatternStop{pattern: p, index: i})
+		}
+	}
+}
+
+// sortTrips は便を始発の発車時刻順に並べる
+func (pattern *raptorPattern) sortTrips() {
+	sort.SliceStable(pattern.trips, func(a, b int) bool {
+		return pattern.trips[a].departures[0] < pattern.trips[b].departures[0]
+	})
+}
+
+// withDelays は遅延のある便の時刻を遅延分ずらした時刻表を返す。
+// 遅延のないパターンは元の時刻表と共有する
+func (tt *raptorTimetable) withDelays(delays map[string]realtimeTrip) *raptorTimetable {
+	if len(delays) == 0 {
+		return tt
+	}
+
+	adjusted := *tt
+	adjusted.patterns = make([]raptorPattern, len(tt.patterns))
+	for p, pattern := range tt.patterns {
+		adjusted.patterns[p] = pattern
+		copied := false
+		for t, trip := range pattern.trips {
+			updates, ok := delays[trip.id]
+			if !ok {
+				continue
+			}
+			if !copied {
+				adjusted.patterns[p].trips = append([]raptorTrip(nil), pattern.trips...)
+				copied = true
+			}
+
+			trip.arrivals = append([]int(nil), trip.arrivals...)
+			trip.departures = append([]int(nil), trip.departures...)
+			trip.arrivalDelays = make([]int, len(trip.sequences))
+			trip.departureDelays = make([]int, len(trip.sequences))
+			for i, sequence := range trip.sequences {
+				delay, ok := updates.delayAt(sequence)
+				if !ok {
+					continue
+				}
+				// 早着しても定刻より前には発車しない
+				trip.arrivalDelays[i] = delay
+				trip.departureDelays[i] = max(delay, 0)
+				trip.arrivals[i] += trip.arrivalDelays[i]
+				trip.departures[i] += trip.departureDelays[i]
+			}
+			adjusted.patterns[p].trips[t] = trip
+		}
+		if copied {
+			adjusted.patterns[p].sortTrips()
+		}
+	}
+	return &adjusted
+}
+
+const (
+	labelNone = iota
+	labelOrigin
+	labelRide
+	labelWalk
+)
+
+// raptorLabel は停留所への到着方法
+type raptorLabel struct {
+	arrival int
+	kind    int
+	// 乗車: 乗車した停留所 / 徒歩: 歩き始めた停留所
+	from int
+	// 乗車した便
+	pattern   int
+	trip      int
+	boardIdx  int
+	alightIdx int
+	walk      raptorFootpath
+}
+
+// stopGroup は停留所と、その子の停留所 (駅の場合) の番号を返す
+func (tt *raptorTimetable) stopGroup(stopID string) []int {
+	group := make([]int, 0)
+	for i, stop := range tt.stops {
+		if stop.ID == stopID || stop.ParentStation == stopID {
+			group = append(group, i)
+		}
+	}
+	return group
+}
+
+// route は乗車回数ごとの各停留所への到着方法を求める。labels[k] は k 回以内の乗車で到着する方法
+func (tt *raptorTimetable) route(origins []int, targets []int, departure int, maxRides int) [][]raptorLabel {
+	n := len(tt.stops)
+	labels := make([][]raptorLabel, maxRides+1)
+	labels[0] = make([]raptorLabel, n)
+	for i := range labels[0] {
+		labels[0][i].arrival = plannerUnreachable
+	}
+	best := make([]int, n)
+	for i := range best {
+		best[i] = plannerUnreachable
+	}
+	bestTarget := func() int {
+		b := plannerUnreachable
+		for _, t := range targets {
+			b = min(b, best[t])
+		}
+		return b
+	}
+
+	marked := make(map[int]bool)
+	for _, o := range origins {
+		labels[0][o] = raptorLabel{arrival: departure, kind: labelOrigin}
+		best[o] = departure
+		marked[o] = true
+	}
+	tt.relaxFootpaths(labels[0], best, marked)
+
+	for k := 1; k <= maxRides && len(marked) > 0; k++ {
+		prev := labels[k-1]
+		curr := make([]raptorLabel, n)
+		copy(curr, prev)
+		labels[k] = curr
+
+		// 前の回で到着時刻が改善した停留所を通るパターンを、最初に改善した位置から調べる
+		queue := make(map[int]int)
+		for s := range marked {
+			for _, ps := range tt.stopPatterns[s] {
+				if i, ok := queue[ps.pattern]; !ok || ps.index < i {
+					queue[ps.pattern] = ps.index
+				}
+			}
+		}
+		marked = make(map[int]bool)
+
+		for p, start := range queue {
+			pattern := &tt.patterns[p]
+			trip, boardIdx := -1, 0
+			for i := start; i < len(pattern.stops); i++ {
+				s := pattern.stops[i]
+
+				// 降車
+				if trip >= 0 {
+					arrival := pattern.trips[trip].arrivals[i]
+					if arrival < best[s] && arrival < bestTarget() {
+						curr[s] = raptorLabel{arrival: arrival, kind: labelRide, from: pattern.stops[boardIdx], pattern: p, trip: trip, boardIdx: boardIdx, alightIdx: i}
+						best[s] = arrival
+						marked[s] = true
+					}
+				}
+
+				// 乗車 (より早い便に乗れる場合は乗り換える)
+				if prev[s].arrival == plannerUnreachable {
+					continue
+				}
+				ready := prev[s].arrival
+				if prev[s].kind == labelRide {
+					ready += plannerTransferSlack
+				}
+				if trip >= 0 && pattern.trips[trip].departures[i] <= ready {
+					continue
+				}
+				for t := range pattern.trips {
+					dep := pattern.trips[t].departures[i]
+					if dep >= ready && (trip < 0 || dep < pattern.trips[trip].departures[i]) {
+						trip, boardIdx = t, i
+					}
+				}
+			}
+		}
+
+		tt.relaxFootpaths(curr, best, marked)
+	}
+	return labels
+}
+
+// relaxFootpaths は乗車で到着した停留所から徒歩で行ける停留所の到着時刻を更新する。
+// 徒歩を続けて使う経路は作らない
+func (tt *raptorTimetable) relaxFootpaths(labels []raptorLabel, best []int, marked map[int]bool) {
+	sources := make([]int, 0, len(marked))
+	for s := range marked {
+		if labels[s].kind != labelWalk {
+			sources = append(sources, s)
+		}
+	}
+	for _, s := range sources {
+		for _, f := range tt.footpaths[s] {
+			arrival := labels[s].arrival + f.duration
+			if arrival < best[f.to] && labels[f.to].kind != labelOrigin {
+				labels[f.to] = raptorLabel{arrival: arrival, kind: labelWalk, from: s, walk: f}
+				best[f.to] = arrival
+				marked[f.to] = true
+			}
+		}
+	}
+}
+
+type apiStopRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiJourneyLeg struct {
+	Mode        string     `json:"mode"` // "bus" または "walk"
+	From        apiStopRef `json:"from"`
+	To          apiStopRef `json:"to"`
+	DepartureAt time.Time  `json:"departure_at"`
+	ArrivalAt   time.Time  `json:"arrival_at"`
+	TripID      string     `json:"trip_id,omitempty"`
+	Route       *apiRoute  `json:"route,omitempty"`
+	Headsign    string     `json:"headsign,omitempty"`
+	Stops       int        `json:"stops,omitempty"`    // 乗車する区間の停留所数
+	Distance    float64    `json:"distance,omitempty"` // 徒歩の距離 (メートル)
+	// リアルタイム情報のある便では、departure_at と arrival_at は遅延を反映した時刻
+	Realtime             bool       `json:"realtime,omitempty"`
+	ScheduledDepartureAt *time.Time `json:"scheduled_departure_at,omitempty"`
+	ScheduledArrivalAt   *time.Time `json:"scheduled_arrival_at,omitempty"`
+	DepartureDelay       *int       `json:"departure_delay,omitempty"` // 秒
+	ArrivalDelay         *int       `json:"arrival_delay,omitempty"`   // 秒
+	// 乗換: 前の便を降りて (徒歩の場合は歩き終えて) から発車までの余裕 (秒)
+	TransferMargin *int `json:"transfer_margin,omitempty"`
+	// 前の便が遅れており、余裕が plannerAtRiskMargin より短い
+	AtRisk bool `json:"at_risk,omitempty"`
+}
+
+type apiJourney struct {
+	DepartureAt time.Time       `json:"departure_at"`
+	ArrivalAt   time.Time       `json:"arrival_at"`
+	Duration    int             `json:"duration"` // 秒
+	Transfers   int             `json:"transfers"`
+	Realtime    bool            `json:"realtime"` // 遅延を反映した時刻で求めた経路
+	AtRisk      bool            `json:"at_risk"`  // 乗り継げない恐れのある乗換を含む
+	Legs        []apiJourneyLeg `json:"legs"`
+}
+
+func (tt *raptorTimetable) stopRef(s int) apiStopRef {
+	return apiStopRef{ID: tt.stops[s].ID, Name: tt.stops[s].Name}
+}
+
+func (tt *raptorTimetable) at(seconds int) time.Time {
+	return tt.date.Add(time.Duration(seconds) * time.Second)
+}
+
+// journey は labels[k] の target への到着方法をたどって経路を組み立てる
+func (tt *raptorTimetable) journey(labels [][]raptorLabel, k int, target int) apiJourney {
+	legs := make([]apiJourneyLeg, 0)
+	s := target
+	for labels[k][s].kind != labelOrigin {
+		l := labels[k][s]
+		switch l.kind {
+		case labelWalk:
+			legs = append(legs, apiJourneyLeg{
+				Mode:        "walk",
+				From:        tt.stopRef(l.from),
+				To:          tt.stopRef(s),
+				DepartureAt: tt.at(l.arrival - l.walk.duration),
+				ArrivalAt:   tt.at(l.arrival),
+				Distance:    l.walk.distance,
+			})
+			s = l.from
+		case labelRide:
+			trip := tt.patterns[l.pattern].trips[l.trip]
+			route := tt.routes[trip.routeID]
+			leg := apiJourneyLeg{
+				Mode:        "bus",
+				From:        tt.stopRef(l.from),
+				To:          tt.stopRef(s),
+				DepartureAt: tt.at(trip.departures[l.boardIdx]),
+				ArrivalAt:   tt.at(trip.arrivals[l.alightIdx]),
+				TripID:      trip.id,
+				Route:       &route,
+				Headsign:    trip.headsign,
+				Stops:       l.alightIdx - l.boardIdx,
+			}
+			if trip.arrivalDelays != nil {
+				departureDelay, arrivalDelay := trip.departureDelays[l.boardIdx], trip.arrivalDelays[l.alightIdx]
+				scheduledDeparture := leg.DepartureAt.Add(-time.Duration(departureDelay) * time.Second)
+				scheduledArrival := leg.ArrivalAt.Add(-time.Duration(arrivalDelay) * time.Second)
+				leg.Realtime = true
+				leg.DepartureDelay, leg.ArrivalDelay = &departureDelay, &arrivalDelay
+				leg.ScheduledDepartureAt, leg.ScheduledArrivalAt = &scheduledDeparture, &scheduledArrival
+			}
+			legs = append(legs, leg)
+			s = l.from
+			k--
+		}
+	}
+
+	// 到着側からたどったため逆順にする
+	for i, j := 0, len(legs)-1; i < j; i, j = i+1, j-1 {
+		legs[i], legs[j] = legs[j], legs[i]
+	}
+
+	j := apiJourney{Legs: legs}
+	rides := 0
+	feeder := -1
+	for i := range legs {
+		leg := &legs[i]
+		if leg.Mode != "bus" {
+			continue
+		}
+		rides++
+		j.Realtime = j.Realtime || leg.Realtime
+
+		if feeder >= 0 {
+			margin := int(leg.DepartureAt.Sub(legs[i-1].ArrivalAt) / time.Second)
+			leg.TransferMargin = &margin
+			if delay := legs[feeder].ArrivalDelay; delay != nil && *delay > 0 && margin < plannerAtRiskMargin {
+				leg.AtRisk = true
+				j.AtRisk = true
+			}
+		}
+		feeder = i
+	}
+	if len(legs) > 0 {
+		j.DepartureAt = legs[0].DepartureAt
+		j.ArrivalAt = legs[len(legs)-1].ArrivalAt
+		j.Duration = int(j.ArrivalAt.Sub(j.DepartureAt) / time.Second)
+		j.Transfers = max(rides-1, 0)
+	}
+	return j
+}
+
+// plan は乗換回数の少ない順に、それまでより早く到着できる経路を返す (徒歩のみの経路を含む)
+func (tt *raptorTimetable) plan(origins []int, targets []int, departure int, maxTransfers int) []apiJourney {
+	labels := tt.route(origins, targets, departure, maxTransfers+1)
+
+	journeys := make([]apiJourney, 0)
+	previous := plannerUnreachable
+	// 到着時刻が改善しなくなった回以降は labels[k] が nil
+	for k := 0; k < len(labels) && labels[k] != nil; k++ {
+		target, arrival := -1, plannerUnreachable
+		for _, t := range targets {
+			if labels[k][t].kind != labelOrigin && labels[k][t].arrival < arrival {
+				target, arrival = t, labels[k][t].arrival
+			}
+		}
+		if target < 0 || arrival >= previous {
+			continue
+		}
+		previous = arrival
+		journeys = append(journeys, tt.journey(labels, k, target))
+	}
+	return journeys
+}
+
+// GET /api/v1/journeys?from=&to=&date=YYYYMMDD&time=HH:MM&max_transfers=&realtime=false
+// 今日の経路は、realtime=false を指定しない限り最新の遅延を反映して求める
+func apiJourneysHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now()
+	date, departure, err := parseServiceDate(r, now, "time")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	maxTransfers := plannerDefaultTransfers
+	if s := query.Get("max_transfers"); s != "" {
+		maxTransfers, err = strconv.Atoi(s)
+		if err != nil || maxTransfers < 0 || maxTransfers > plannerMaxTransfers {
+			writeAPIError(w, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("max_transfers は 0 から %d の整数で指定してください", plannerMaxTransfers))
+			return
+		}
+	}
+	if query.Get("from") == "" || query.Get("to") == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", "from と to に停留所IDを指定してください")
+		return
+	}
+	realtime := sameDay(date, now)
+	if s := query.Get("realtime"); s != "" {
+		useRealtime, err := strconv.ParseBool(s)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_parameter", "realtime は true または false で指定してください")
+			return
+		}
+		realtime = realtime && useRealtime
+	}
+
+	tt, err := plannerTimetable(date)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	origins := tt.stopGroup(query.Get("from"))
+	targets := tt.stopGroup(query.Get("to"))
+	if len(origins) == 0 || len(targets) == 0 {
+		writeAPIFailure(w, errAPINotFound)
+		return
+	}
+
+	if realtime {
+		tt = tt.withDelays(loadAllRealtimeDelays(now))
+	}
+
+	seconds, _ := parseGTFSSeconds(departure)
+	writeAPIJSON(w, http.StatusOK, apiItem{Data: tt.plan(origins, targets, seconds, maxTransfers)})
+}
+
+// journeyHandler は乗換案内のページを表示する。出発地は発車標の停留所とする
+func journeyHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		From apiStopRef
+	}{}
+
+	stopName := appConfig.Get().Display.StopName
+	index, err := currentStopIndex()
+	if err != nil {
+		log.Printf("停留所の索引を作成できません: %v", err)
+	} else {
+		for _, entry := range index.entries {
+			if entry.stop.Name == stopName {
+				data.From = apiStopRef{ID: entry.stop.ID, Name: entry.stop.Name}
+				break
+			}
+		}
+	}
+
+	renderTemplate(w, "journey", data)
+}
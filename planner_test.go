@@ -0,0 +1,196 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRaptorTrip はテスト用の便。stops と times (HH:MM、24時以降を含む) は同じ長さ
+type testRaptorTrip struct {
+	id    string
+	stops []string
+	times []string
+}
+
+// newTestTimetable は停留所 A から F の時刻表を作る。
+//
+//	r1: A 08:00 → B 08:10 → C 08:20 (t1), A 08:30 → B 08:40 → C 08:50 (t2)
+//	r2: B 08:15 → D 08:30 (t3), B 08:45 → D 09:00 (t4)
+//	r3: E 08:40 → F 09:00 (t5)
+//	r4: C 24:30 → A 24:50 (t6、運行日の翌日0時30分)
+//	D と E の間は徒歩2分
+func newTestTimetable(t *testing.T) *raptorTimetable {
+	t.Helper()
+
+	tt := &raptorTimetable{
+		date:    time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+		stopIDs: make(map[string]int),
+		routes:  make(map[string]apiRoute),
+	}
+	for i, id := range []string{"A", "B", "C", "D", "E", "F"} {
+		tt.stops = append(tt.stops, apiStop{ID: id, Name: id})
+		tt.stopIDs[id] = i
+	}
+
+	patterns := make(map[string]int)
+	for _, trip := range []testRaptorTrip{
+		{"t1", []string{"A", "B", "C"}, []string{"08:00", "08:10", "08:20"}},
+		{"t2", []string{"A", "B", "C"}, []string{"08:30", "08:40", "08:50"}},
+		{"t3", []string{"B", "D"}, []string{"08:15", "08:30"}},
+		{"t4", []string{"B", "D"}, []string{"08:45", "09:00"}},
+		{"t5", []string{"E", "F"}, []string{"08:40", "09:00"}},
+		{"t6", []string{"C", "A"}, []string{"24:30", "24:50"}},
+	} {
+		rt := raptorTrip{id: trip.id, routeID: "r" + trip.id}
+		stops := make([]int, len(trip.stops))
+		for i, id := range trip.stops {
+			stops[i] = tt.stopIDs[id]
+			seconds := testSeconds(t, trip.times[i])
+			rt.arrivals = append(rt.arrivals, seconds)
+			rt.departures = append(rt.departures, seconds)
+			rt.sequences = append(rt.sequences, i+1)
+		}
+		key := strings.Join(trip.stops, ",")
+		p, ok := patterns[key]
+		if !ok {
+			p = len(tt.patterns)
+			patterns[key] = p
+			tt.patterns = append(tt.patterns, raptorPattern{stops: stops})
+		}
+		tt.patterns[p].trips = append(tt.patterns[p].trips, rt)
+	}
+	tt.indexPatterns()
+
+	tt.footpaths = make([][]raptorFootpath, len(tt.stops))
+	tt.footpaths[tt.stopIDs["D"]] = []raptorFootpath{{to: tt.stopIDs["E"], duration: 120, distance: 130}}
+	tt.footpaths[tt.stopIDs["E"]] = []raptorFootpath{{to: tt.stopIDs["D"], duration: 120, distance: 130}}
+	return tt
+}
+
+func testSeconds(t *testing.T, hhmm string) int {
+	t.Helper()
+
+	seconds, ok := parseGTFSSeconds(hhmm + ":00")
+	if !ok {
+		t.Fatalf("時刻 %q を解釈できません", hhmm)
+	}
+	return seconds
+}
+
+// journeySummary は経路を "t1(A-B) walk(D-E)" のような文字列にする
+func journeySummary(j apiJourney) string {
+	legs := make([]string, len(j.Legs))
+	for i, leg := range j.Legs {
+		name := leg.TripID
+		if leg.Mode == "walk" {
+			name = "walk"
+		}
+		legs[i] = name + "(" + leg.From.ID + "-" + leg.To.ID + ")"
+	}
+	return strings.Join(legs, " ")
+}
+
+func TestRaptorPlan(t *testing.T) {
+	tt := newTestTimetable(t)
+
+	tests := []struct {
+		name         string
+		from, to     string
+		departure    string
+		maxTransfers int
+		// 乗換回数の少ない順の経路。空の場合は経路なし
+		want []string
+		// 最後の経路の到着日時と乗換回数
+		wantArrival   time.Time
+		wantTransfers int
+	}{
+		{
+			name: "直通", from: "A", to: "C", departure: "07:55", maxTransfers: 3,
+			want:        []string{"t1(A-C)"},
+			wantArrival: time.Date(2026, 10, 19, 8, 20, 0, 0, time.UTC),
+		},
+		{
+			name: "出発時刻より前の便には乗らない", from: "A", to: "C", departure: "08:01", maxTransfers: 3,
+			want:        []string{"t2(A-C)"},
+			wantArrival: time.Date(2026, 10, 19, 8, 50, 0, 0, time.UTC),
+		},
+		{
+			name: "1回乗換", from: "A", to: "D", departure: "07:55", maxTransfers: 3,
+			want:        []string{"t1(A-B) t3(B-D)"},
+			wantArrival: time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC), wantTransfers: 1,
+		},
+		{
+			name: "徒歩で乗換", from: "A", to: "F", departure: "07:55", maxTransfers: 3,
+			want:        []string{"t1(A-B) t3(B-D) walk(D-E) t5(E-F)"},
+			wantArrival: time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC), wantTransfers: 2,
+		},
+		{
+			name: "乗換回数の上限", from: "A", to: "F", departure: "07:55", maxTransfers: 1,
+			want: nil,
+		},
+		{
+			name: "運行日の24時以降の便", from: "C", to: "A", departure: "24:00", maxTransfers: 0,
+			want:        []string{"t6(C-A)"},
+			wantArrival: time.Date(2026, 10, 20, 0, 50, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			journeys := tt.plan(tt.stopGroup(tc.from), tt.stopGroup(tc.to), testSeconds(t, tc.departure), tc.maxTransfers)
+
+			got := make([]string, len(journeys))
+			for i, j := range journeys {
+				got[i] = journeySummary(j)
+			}
+			if strings.Join(got, " | ") != strings.Join(tc.want, " | ") {
+				t.Fatalf("経路 = %q, want %q", got, tc.want)
+			}
+			if len(journeys) == 0 {
+				return
+			}
+			last := journeys[len(journeys)-1]
+			if !last.ArrivalAt.Equal(tc.wantArrival) {
+				t.Errorf("到着 = %v, want %v", last.ArrivalAt, tc.wantArrival)
+			}
+			if last.Transfers != tc.wantTransfers {
+				t.Errorf("乗換回数 = %d, want %d", last.Transfers, tc.wantTransfers)
+			}
+		})
+	}
+}
+
+func TestRaptorWithDelaysAtRisk(t *testing.T) {
+	tt := newTestTimetable(t)
+	departure := testSeconds(t, "07:55")
+	origins, targets := tt.stopGroup("A"), tt.stopGroup("D")
+
+	// 定刻なら B での乗換に5分の余裕がある
+	journeys := tt.plan(origins, targets, departure, 3)
+	if len(journeys) != 1 || journeys[0].AtRisk || journeys[0].Realtime {
+		t.Fatalf("定刻の経路 = %+v", journeys)
+	}
+
+	// t1 が B に4分遅れて着くと、余裕は1分になる
+	delayed := tt.withDelays(map[string]realtimeTrip{"t1": {{stopSequence: 2, delay: 240}}})
+	journeys = delayed.plan(origins, targets, departure, 3)
+	if len(journeys) != 1 || journeySummary(journeys[0]) != "t1(A-B) t3(B-D)" {
+		t.Fatalf("遅延を反映した経路 = %+v", journeys)
+	}
+	j := journeys[0]
+	if !j.Realtime || !j.AtRisk {
+		t.Errorf("realtime = %v, at_risk = %v", j.Realtime, j.AtRisk)
+	}
+	feeder, transfer := j.Legs[0], j.Legs[1]
+	if feeder.ArrivalDelay == nil || *feeder.ArrivalDelay != 240 {
+		t.Errorf("arrival_delay = %v", feeder.ArrivalDelay)
+	}
+	if transfer.TransferMargin == nil || *transfer.TransferMargin != 60 || !transfer.AtRisk {
+		t.Errorf("transfer_margin = %v, at_risk = %v", transfer.TransferMargin, transfer.AtRisk)
+	}
+
+	// 元の時刻表は変わらない
+	if got := tt.patterns[0].trips[0].arrivals[1]; got != testSeconds(t, "08:10") {
+		t.Errorf("元の時刻表の到着 = %d", got)
+	}
+}
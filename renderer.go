@@ -1,9 +1,9 @@
 package main
 
 import (
+	"html/template"
 	"net/http"
 	"path/filepath"
-	"text/template"
 )
 
 func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RouteColorConfig は系統の色の設定。routes.route_color が空のフィードや、フィードの色を変えたい場合に使う
+type RouteColorConfig struct {
+	// 対象の系統。route_id、または route_short_name か route_long_name が一致するもの
+	RouteID   string `json:"routeID,omitempty"`
+	RouteName string `json:"routeName,omitempty"`
+	// 16進数6桁か3桁 (GTFS と同じく # は付けない)
+	Color     string `json:"color"`
+	TextColor string `json:"textColor,omitempty"`
+}
+
+var routeColorPattern = regexp.MustCompile(`^([0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$`)
+
+// normalizeRouteColor は16進数の色を6桁の大文字にする (3桁は各桁を重ねる)。色として不正なら空
+func normalizeRouteColor(color string) string {
+	if !routeColorPattern.MatchString(color) {
+		return ""
+	}
+	color = strings.ToUpper(color)
+	if len(color) == 3 {
+		color = string([]byte{color[0], color[0], color[1], color[1], color[2], color[2]})
+	}
+	return color
+}
+
+// routeColor は系統の背景色と文字色を返す (16進数6桁の大文字。色がなければ空)。
+// 設定の routeColors をフィードの色より優先し、文字色がなければ背景色から読みやすい方 (黒か白) を選ぶ。
+// routeColors は route_id の一致を系統名の一致より優先する
+func (c *Config) routeColor(routeID string, shortName string, longName string, color string, textColor string) (string, string) {
+	if rc, ok := c.findRouteColor(routeID, shortName, longName); ok {
+		color, textColor = rc.Color, rc.TextColor
+	}
+
+	color = normalizeRouteColor(color)
+	if color == "" {
+		return "", ""
+	}
+	if textColor = normalizeRouteColor(textColor); textColor != "" {
+		return color, textColor
+	}
+	return color, contrastTextColor(color)
+}
+
+// findRouteColor は系統に一致する routeColors の設定を返す。route_id、系統名の順に探す
+func (c *Config) findRouteColor(routeID string, shortName string, longName string) (RouteColorConfig, bool) {
+	for _, rc := range c.RouteColors {
+		if rc.RouteID != "" && rc.RouteID == routeID {
+			return rc, true
+		}
+	}
+	for _, rc := range c.RouteColors {
+		if rc.RouteName != "" && (rc.RouteName == shortName || rc.RouteName == longName) {
+			return rc, true
+		}
+	}
+	return RouteColorConfig{}, false
+}
+
+// contrastTextColor は背景色 (16進数6桁か3桁) の相対輝度から黒か白の文字色を返す
+func contrastTextColor(color string) string {
+	rgb, _ := strconv.ParseUint(normalizeRouteColor(color), 16, 32)
+	channel := func(shift uint) float64 {
+		return float64((rgb>>shift)&0xFF) / 255
+	}
+	luminance := 0.2126*channel(16) + 0.7152*channel(8) + 0.0722*channel(0)
+	if luminance > 0.5 {
+		return "000000"
+	}
+	return "FFFFFF"
+}
+
+// applyRouteColor は設定の routeColors を API などで返す系統に反映する
+func applyRouteColor(route *apiRoute) {
+	if appConfig == nil {
+		return
+	}
+	route.Color, route.TextColor = appConfig.Get().routeColor(route.ID, route.ShortName, route.LongName, route.Color, route.TextColor)
+}
+
+func validateRouteColors(config *Config) error {
+	errs := make([]error, 0)
+	for i, rc := range config.RouteColors {
+		if rc.RouteID == "" && rc.RouteName == "" {
+			errs = append(errs, fmt.Errorf("routeColors[%d] の routeID か routeName を指定してください", i))
+		}
+		if !routeColorPattern.MatchString(rc.Color) {
+			errs = append(errs, fmt.Errorf("routeColors[%d] の color %q は16進数6桁か3桁で指定してください", i, rc.Color))
+		}
+		if rc.TextColor != "" && !routeColorPattern.MatchString(rc.TextColor) {
+			errs = append(errs, fmt.Errorf("routeColors[%d] の textColor %q は16進数6桁か3桁で指定してください", i, rc.TextColor))
+		}
+	}
+	return errors.Join(errs...)
+}
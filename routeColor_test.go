@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContrastTextColor(t *testing.T) {
+	tests := []struct {
+		color, want string
+	}{
+		{"FFFFFF", "000000"},
+		{"000000", "FFFFFF"},
+		{"FFFF00", "000000"},
+		{"0000FF", "FFFFFF"},
+		// 相対輝度 0.5 付近。0.5 を超えると黒
+		{"808080", "000000"},
+		{"7F7F7F", "FFFFFF"},
+		{"00FF00", "000000"},
+		{"FF0000", "FFFFFF"},
+		// 3桁は各桁を重ねた6桁と同じ
+		{"fff", "000000"},
+		{"00f", "FFFFFF"},
+		{"ff0", "000000"},
+		// 不正な色は黒の背景として扱う
+		{"", "FFFFFF"},
+		{"GGGGGG", "FFFFFF"},
+	}
+	for _, tt := range tests {
+		if got := contrastTextColor(tt.color); got != tt.want {
+			t.Errorf("contrastTextColor(%q) = %q, want %q", tt.color, got, tt.want)
+		}
+	}
+}
+
+func TestRouteColor(t *testing.T) {
+	c := &Config{RouteColors: []RouteColorConfig{
+		{RouteName: "駅前線", Color: "00FF00"},
+		{RouteID: "r1", Color: "f00", TextColor: "fff"},
+		{RouteName: "病院線", Color: "0000ff"},
+	}}
+
+	tests := []struct {
+		name                     string
+		routeID, short, long     string
+		color, textColor         string
+		wantColor, wantTextColor string
+	}{
+		{"フィードの色", "r9", "", "", "123456", "ABCDEF", "123456", "ABCDEF"},
+		{"小文字", "r9", "", "", "abcdef", "", "ABCDEF", "000000"},
+		{"3桁", "r9", "", "", "fc0", "036", "FFCC00", "003366"},
+		{"文字色は背景色から選ぶ", "r9", "", "", "000080", "", "000080", "FFFFFF"},
+		{"不正な文字色は背景色から選ぶ", "r9", "", "", "FFFFFF", "12345", "FFFFFF", "000000"},
+		{"色がない", "r9", "", "", "", "FFFFFF", "", ""},
+		{"不正な色", "r9", "", "", "#FF0000", "", "", ""},
+		{"4桁", "r9", "", "", "F00F", "", "", ""},
+		// route_id の一致を、先に書かれた系統名の一致より優先する
+		{"route_id と系統名の両方に一致", "r1", "", "駅前線", "123456", "", "FF0000", "FFFFFF"},
+		{"route_short_name に一致", "r2", "病院線", "", "123456", "000000", "0000FF", "FFFFFF"},
+		{"route_long_name に一致", "r2", "", "駅前線", "", "", "00FF00", "000000"},
+		{"一致しない", "r2", "", "市役所線", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			color, textColor := c.routeColor(tt.routeID, tt.short, tt.long, tt.color, tt.textColor)
+			if color != tt.wantColor || textColor != tt.wantTextColor {
+				t.Errorf("routeColor = %q %q, want %q %q", color, textColor, tt.wantColor, tt.wantTextColor)
+			}
+		})
+	}
+}
+
+func TestValidateRouteColors(t *testing.T) {
+	tests := []struct {
+		name    string
+		rc      RouteColorConfig
+		wantErr string
+	}{
+		{"6桁", RouteColorConfig{RouteID: "r1", Color: "00ff00", TextColor: "000000"}, ""},
+		{"3桁", RouteColorConfig{RouteName: "駅前線", Color: "0f0", TextColor: "FFF"}, ""},
+		{"系統の指定がない", RouteColorConfig{Color: "00FF00"}, "routeID か routeName"},
+		{"色がない", RouteColorConfig{RouteID: "r1"}, "color"},
+		{"# 付き", RouteColorConfig{RouteID: "r1", Color: "#00FF00"}, "color"},
+		{"5桁", RouteColorConfig{RouteID: "r1", Color: "00FF0"}, "color"},
+		{"16進数以外", RouteColorConfig{RouteID: "r1", Color: "GREEN"}, "color"},
+		{"不正な文字色", RouteColorConfig{RouteID: "r1", Color: "00FF00", TextColor: "black"}, "textColor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRouteColors(&Config{RouteColors: []RouteColorConfig{tt.rc}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateRouteColors = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateRouteColors = %v, want %q を含むエラー", err, tt.wantErr)
+			}
+		})
+	}
+}
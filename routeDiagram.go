@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 路線図 (停留所を停車順に並べた帯状の図)
+//
+// 系統・方向ごとに停留所の最も多い便を代表として停留所の並びを決め、
+// vehicle_position の current_stop_sequence から走行中の車両の位置を求める。
+
+// 車両が停留所からこの距離 (メートル) 以内にいれば停車中とみなす
+const diagramAtStopDistance float64 = 50
+
+type diagramVehicle struct {
+	ID     string `json:"id"`
+	Label  string `json:"label,omitempty"`
+	TripID string `json:"trip_id"`
+	// 停留所の並び (stops の添字) での位置。停留所間を走行中の場合は前後の停留所の中間 (x.5)
+	Position  float64   `json:"position"`
+	AtStop    bool      `json:"at_stop"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type routeDiagram struct {
+	Route       apiRoute         `json:"route"`
+	DirectionID int              `json:"direction_id"`
+	Headsign    string           `json:"headsign,omitempty"`
+	TripID      string           `json:"trip_id"` // 停留所の並びに使った便
+	Stops       []apiStop        `json:"stops"`
+	CurrentStop int              `json:"current_stop"` // 発車標の停留所の添字。路線上になければ -1
+	Vehicles    []diagramVehicle `json:"vehicles"`
+}
+
+// parseDirectionID は direction_id (0 または 1、省略時は 0) を読み込む
+func parseDirectionID(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("direction_id")
+	if s == "" {
+		return 0, nil
+	}
+	direction, err := strconv.Atoi(s)
+	if err != nil || (direction != 0 && direction != 1) {
+		return 0, errors.New("direction_id は 0 または 1 で指定してください")
+	}
+	return direction, nil
+}
+
+// loadRouteDiagram は系統と方向の停留所の並びを静的DBから読み込む。
+// currentStopName と同じ名前の停留所を現在地とする
+func loadRouteDiagram(db *sql.DB, routeID string, direction int, currentStopName string) (*routeDiagram, error) {
+	routes, err := queryRoutes(db, `
+		SELECT `+apiRouteColumns+`
+		FROM routes AS r
+		LEFT JOIN agency AS a ON a.agency_id = r.agency_id
+		WHERE r.route_id = ?`, routeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, errAPINotFound
+	}
+
+	diagram := &routeDiagram{Route: routes[0], DirectionID: direction, CurrentStop: -1, Vehicles: make([]diagramVehicle, 0)}
+	err = db.QueryRow(`
+		SELECT t.trip_id, COALESCE(t.trip_headsign, '')
+		FROM trips AS t
+		JOIN stop_times AS st ON st.trip_id = t.trip_id
+		WHERE t.route_id = ? AND CAST(COALESCE(t.direction_id, 0) AS INTEGER) = ?
+		GROUP BY t.trip_id
+		ORDER BY COUNT(*) DESC, t.trip_id
+		LIMIT 1`, routeID, direction).Scan(&diagram.TripID, &diagram.Headsign)
+	if err == sql.ErrNoRows {
+		return nil, errAPINotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("代表の便の取得に失敗: %w", err)
+	}
+
+	diagram.Stops, err = queryStops(db, `
+		SELECT `+apiStopColumns+`
+		FROM stop_times AS st
+		JOIN stops AS s ON s.stop_id = st.stop_id
+		WHERE st.trip_id = ?
+		ORDER BY CAST(st.stop_sequence AS INTEGER)`, diagram.TripID)
+	if err != nil {
+		return nil, err
+	}
+	for i, stop := range diagram.Stops {
+		if stop.Name == currentStopName {
+			diagram.CurrentStop = i
+			break
+		}
+	}
+	return diagram, nil
+}
+
+// placeVehicles は系統を走行中の車両のうち、同じ方向のものを停留所の並びに配置する
+func (diagram *routeDiagram) placeVehicles(db *sql.DB, now time.Time) error {
+	vehicles, _, err := queryVehicles("tr.route_id = ?", []interface{}{diagram.Route.ID}, apiMaxLimit, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vehicles {
+		if !v.Timestamp.IsZero() && now.Sub(v.Timestamp) > realtimeMaxAge {
+			continue
+		}
+
+		// 車両の便の current_stop_sequence の停留所を求める。便が静的DBになければ stop_id を使う
+		var direction int
+		stopID := v.StopID
+		err := db.QueryRow(`
+			SELECT CAST(COALESCE(t.direction_id, 0) AS INTEGER), st.stop_id
+			FROM trips AS t
+			JOIN stop_times AS st ON st.trip_id = t.trip_id
+			WHERE t.trip_id = ? AND CAST(st.stop_sequence AS INTEGER) = ?`, v.TripID, v.CurrentStopSequence).Scan(&direction, &stopID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("車両の停留所の取得に失敗: %w", err)
+		}
+		if err == nil && direction != diagram.DirectionID {
+			continue
+		}
+
+		index := -1
+		for i, stop := range diagram.Stops {
+			if stop.ID == stopID {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			continue
+		}
+
+		// 位置が不明な場合や停留所の近くにいる場合は停車中、それ以外は直前の停留所との間を走行中とする
+		stop := diagram.Stops[index]
+		atStop := index == 0 || (v.Lat == 0 && v.Lon == 0) ||
+			haversine(v.Lat, v.Lon, stop.Lat, stop.Lon) <= diagramAtStopDistance
+		position := float64(index)
+		if !atStop {
+			position -= 0.5
+		}
+		diagram.Vehicles = append(diagram.Vehicles, diagramVehicle{
+			ID:        v.ID,
+			Label:     v.Label,
+			TripID:    v.TripID,
+			Position:  position,
+			AtStop:    atStop,
+			Timestamp: v.Timestamp,
+		})
+	}
+	return nil
+}
+
+// GET /api/v1/routes/{route_id}/diagram?direction_id=
+func apiRouteDiagramHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	direction, err := parseDirectionID(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	diagram, err := loadRouteDiagram(db, r.PathValue("route_id"), direction, appConfig.Get().Display.StopName)
+	if err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	if err := diagram.placeVehicles(db, time.Now()); err != nil {
+		writeAPIFailure(w, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiItem{Data: diagram})
+}
+
+// routeDiagramHandler は路線図のページを表示する。
+// 停留所の並びはサーバで描画し、車両の位置はページから /api/v1/routes/{route_id}/diagram を定期的に取得する
+func routeDiagramHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Routes       []apiRoute
+		RouteID      string
+		Diagram      *routeDiagram
+		ErrorMessage string
+	}{RouteID: r.URL.Query().Get("route_id")}
+
+	db, err := openReadOnlyDb(staticDbFile)
+	if err != nil {
+		log.Printf("路線図: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	data.Routes, err = queryRoutes(db, `
+		SELECT `+apiRouteColumns+`
+		FROM routes AS r
+		LEFT JOIN agency AS a ON a.agency_id = r.agency_id
+		WHERE r.route_id <> 'route_id'
+		ORDER BY r.route_short_name, r.route_long_name, r.route_id`)
+	if err != nil {
+		log.Printf("路線図: %v", err)
+		data.ErrorMessage = "路線の一覧を取得できません。静的データを取り込んでください。"
+		renderTemplate(w, "route-diagram", data)
+		return
+	}
+
+	if data.RouteID != "" {
+		direction, err := parseDirectionID(r)
+		if err != nil {
+			data.ErrorMessage = err.Error()
+		} else if data.Diagram, err = loadRouteDiagram(db, data.RouteID, direction, appConfig.Get().Display.StopName); err != nil {
+			if !errors.Is(err, errAPINotFound) {
+				log.Printf("路線図: %v", err)
+			}
+			data.ErrorMessage = "指定された系統・方向の便がありません。"
+		}
+	}
+
+	renderTemplate(w, "route-diagram", data)
+}
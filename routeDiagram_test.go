@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDiagramDbs は路線 r1 の静的DBと車両位置の動的DBを作る。
+// 停留所 A-D は北へ約110mおきに並び、上り (方向0) の代表の便は A-B-C-D を通る t_long
+func newTestDiagramDbs(t *testing.T, now time.Time) *sql.DB {
+	t.Helper()
+
+	prevDir := databaseDir
+	databaseDir = t.TempDir()
+	t.Cleanup(func() { databaseDir = prevDir })
+
+	static, err := sql.Open("sqlite3", databasePath(staticDbFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { static.Close() })
+	if err := createStaticTables(static); err != nil {
+		t.Fatal(err)
+	}
+	stopTimes := map[string]string{
+		"t_short": "A,B",
+		"t_long":  "A,B,C,D",
+		"t_back":  "D,C,B,A",
+	}
+	statements := []string{
+		`INSERT INTO routes (route_id, route_long_name) VALUES ('r1', '駅前線')`,
+		`INSERT INTO stops (stop_id, stop_name, stop_lat, stop_lon) VALUES
+			('A', '駅前', 37.700, 140.46), ('B', '市役所', 37.701, 140.46), ('C', '病院', 37.702, 140.46), ('D', '終点', 37.703, 140.46)`,
+		`INSERT INTO trips (route_id, trip_id, trip_headsign, direction_id) VALUES
+			('r1', 't_short', '市役所', 0), ('r1', 't_long', '終点', 0), ('r1', 't_back', '駅前', 1)`,
+	}
+	for tripID, stops := range stopTimes {
+		for i, stopID := range strings.Split(stops, ",") {
+			statements = append(statements, fmt.Sprintf(
+				`INSERT INTO stop_times (trip_id, stop_id, stop_sequence) VALUES ('%s', '%s', %d)`, tripID, stopID, i+1))
+		}
+	}
+	for _, q := range statements {
+		if _, err := static.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dynamic, err := sql.Open("sqlite3", databasePath(dynamicDbFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dynamic.Close()
+	if err := createDynamicTables(dynamic); err != nil {
+		t.Fatal(err)
+	}
+	fresh := fmt.Sprint(now.Add(-time.Minute).Unix())
+	stale := fmt.Sprint(now.Add(-realtimeMaxAge - time.Minute).Unix())
+	vehicles := []struct {
+		id, tripID, stopID string
+		sequence           int
+		lat, lon           float64
+		timestamp          string
+	}{
+		// C に停車中
+		{"v_at_c", "t_long", "", 3, 37.702, 140.46, fresh},
+		// A と B の中間を B に向かって走行中
+		{"v_to_b", "t_long", "", 2, 37.7005, 140.46, fresh},
+		// 始発の停留所は位置にかかわらず停車中
+		{"v_first", "t_short", "", 1, 37.690, 140.46, fresh},
+		// 反対方向の車両
+		{"v_back", "t_back", "", 2, 37.702, 140.46, fresh},
+		// 古い位置情報
+		{"v_stale", "t_long", "", 4, 37.703, 140.46, stale},
+		// 静的DBにない便は stop_id の停留所に置く。位置が不明な場合は停車中
+		{"v_unknown", "t_extra", "D", 9, 0, 0, fresh},
+	}
+	for _, v := range vehicles {
+		if _, err := dynamic.Exec(`INSERT OR IGNORE INTO trip (trip_id, route_id, start_date, start_time) VALUES (?, 'r1', '', '')`, v.tripID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dynamic.Exec(`
+			INSERT INTO vehicle_position (entity_id, vehicle_id, trip_id, stop_id, current_stop_sequence, latitude, longitude, position_timestamp)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, v.id, v.id, v.tripID, v.stopID, v.sequence, v.lat, v.lon, v.timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return static
+}
+
+func TestLoadRouteDiagram(t *testing.T) {
+	db := newTestDiagramDbs(t, time.Now())
+
+	tests := []struct {
+		name        string
+		direction   int
+		wantTrip    string
+		wantStops   string
+		wantCurrent int
+	}{
+		// 停留所の最も多い便を代表にする
+		{"方向0", 0, "t_long", "A,B,C,D", 2},
+		{"方向1", 1, "t_back", "D,C,B,A", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagram, err := loadRouteDiagram(db, "r1", tt.direction, "病院")
+			if err != nil {
+				t.Fatalf("loadRouteDiagram: %v", err)
+			}
+			ids := make([]string, 0, len(diagram.Stops))
+			for _, s := range diagram.Stops {
+				ids = append(ids, s.ID)
+			}
+			if diagram.TripID != tt.wantTrip || strings.Join(ids, ",") != tt.wantStops {
+				t.Errorf("代表の便 = %s (%v), want %s (%s)", diagram.TripID, ids, tt.wantTrip, tt.wantStops)
+			}
+			if diagram.CurrentStop != tt.wantCurrent {
+				t.Errorf("CurrentStop = %d, want %d", diagram.CurrentStop, tt.wantCurrent)
+			}
+		})
+	}
+
+	if _, err := loadRouteDiagram(db, "r9", 0, "病院"); !errors.Is(err, errAPINotFound) {
+		t.Errorf("存在しない系統: err = %v", err)
+	}
+	if diagram, err := loadRouteDiagram(db, "r1", 0, "存在しない停留所"); err != nil || diagram.CurrentStop != -1 {
+		t.Errorf("路線上にない停留所: CurrentStop = %v, err = %v", diagram, err)
+	}
+}
+
+func TestPlaceVehicles(t *testing.T) {
+	now := time.Now()
+	db := newTestDiagramDbs(t, now)
+
+	diagram, err := loadRouteDiagram(db, "r1", 0, "")
+	if err != nil {
+		t.Fatalf("loadRouteDiagram: %v", err)
+	}
+	if err := diagram.placeVehicles(db, now); err != nil {
+		t.Fatalf("placeVehicles: %v", err)
+	}
+
+	want := map[string]struct {
+		position float64
+		atStop   bool
+	}{
+		"v_at_c":    {2, true},
+		"v_to_b":    {0.5, false},
+		"v_first":   {0, true},
+		"v_unknown": {3, true},
+	}
+	got := make(map[string]diagramVehicle)
+	for _, v := range diagram.Vehicles {
+		got[v.ID] = v
+	}
+	if len(got) != len(want) {
+		t.Errorf("配置された車両 = %v", diagram.Vehicles)
+	}
+	for id, w := range want {
+		v, ok := got[id]
+		if !ok {
+			t.Errorf("車両 %s が配置されていません", id)
+			continue
+		}
+		if v.Position != w.position || v.AtStop != w.atStop {
+			t.Errorf("車両 %s = 位置 %v 停車中 %v, want %v %v", id, v.Position, v.AtStop, w.position, w.atStop)
+		}
+	}
+	for _, id := range []string{"v_back", "v_stale"} {
+		if _, ok := got[id]; ok {
+			t.Errorf("車両 %s は配置しない", id)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 設定でcron式が指定されていない場合は毎晩3時に確認する
+const defaultFeedCheckCron string = "0 3 * * *"
+
+// cronSchedule は5フィールド (分 時 日 月 曜日) のcron式を表す
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+// cron式の別名
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@nightly": defaultFeedCheckCron,
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron は "分 時 日 月 曜日" 形式のcron式を解析する
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if alias, ok := cronAliases[expr]; ok {
+		expr = alias
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron式のフィールド数が不正です (5個必要, 現在: %d): %q", len(fields), expr)
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("分の解析に失敗: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("時の解析に失敗: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("日の解析に失敗: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("月の解析に失敗: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("曜日の解析に失敗: %w", err)
+	}
+	// 日曜日は0と7のどちらでも指定できる
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+
+	return &s, nil
+}
+
+// parseCronField は "*", "1,2", "1-5", "*/15" などの1フィールドを解析する
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("ステップ値が不正です: %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("範囲が不正です: %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("値が不正です: %q", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("値が範囲外です (%d-%d): %q", min, max, part)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// matches は時刻 t がスケジュールに一致するかを返す
+func (s *cronSchedule) matches(t time.Time) bool {
+	return s.minute[t.Minute()] && s.hour[t.Hour()] && s.matchesDay(t)
+}
+
+// matchesDay は t の日付がスケジュールの月・日・曜日に一致するかを返す
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if !s.month[int(t.Month())] {
+		return false
+	}
+
+	// 日と曜日が両方指定されている場合はどちらかに一致すればよい (標準のcronと同じ)
+	domMatch := s.dom[t.Day()]
+	dowMatch := s.dow[int(t.Weekday())]
+	if s.domAny || s.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next は after より後で最初にスケジュールに一致する時刻を返す
+func (s *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+
+	// 最大で約5年先まで探索する (2月30日など一致しない式の場合はゼロ値を返す)。
+	// 一致しない日と時は分単位で調べずに読み飛ばす
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// feedSchedule は設定のcron式を解析する。不正な場合は既定値を使う。
+func feedSchedule(expr string) (*cronSchedule, string) {
+	if expr == "" {
+		expr = defaultFeedCheckCron
+	}
+
+	schedule, err := parseCron(expr)
+	if err != nil {
+		log.Printf("フィード更新スケジュールの解析に失敗したため、既定値 %q を使用します: %v", defaultFeedCheckCron, err)
+		expr = defaultFeedCheckCron
+		schedule, _ = parseCron(expr)
+	}
+	return schedule, expr
+}
+
+// startFeedScheduler はcron式に従って静的フィードの更新確認を定期実行する。
+// 起動時にフィードの期限 (feed_end_date) が切れていれば、次の予定を待たずに一度更新する。
+// 設定のcron式が変更された場合は次回の実行時刻を計算し直す。
+func startFeedScheduler(dbFile string) {
+	changes := appConfig.Subscribe()
+	schedule, expr := feedSchedule(appConfig.Get().FeedCheckCron)
+
+	if feedExpiresWithin(dbFile, 0) {
+		log.Println("静的フィードの期限が切れています。更新します。")
+		if _, err := refreshStaticFeed(dbFile, true); err != nil {
+			log.Printf("静的フィードの更新に失敗しました: %v", err)
+		}
+	}
+
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			log.Printf("cron式 %q に一致する時刻がありません。設定が変更されるまで待機します。", expr)
+			config := <-changes
+			schedule, expr = feedSchedule(config.FeedCheckCron)
+			continue
+		}
+		log.Printf("次回の静的フィード更新確認: %s", next.Format("2006-01-02 15:04"))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case config := <-changes:
+			timer.Stop()
+			schedule, expr = feedSchedule(config.FeedCheckCron)
+			continue
+		case <-timer.C:
+		}
+
+		if _, err := refreshStaticFeed(dbFile, false); err != nil {
+			log.Printf("静的フィードの更新確認に失敗しました: %v", err)
+		}
+	}
+}
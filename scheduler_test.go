@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"0 3 * *",
+		"0 3 * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) にエラーがありません", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2026-10-19 は月曜日
+	base := time.Date(2026, 10, 19, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{"毎分", "* * * * *", time.Date(2026, 10, 19, 10, 8, 0, 0, time.UTC)},
+		{"別名", "@nightly", time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC)},
+		{"範囲", "0 12-14 * * *", time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)},
+		{"ステップ", "*/15 * * * *", time.Date(2026, 10, 19, 10, 15, 0, 0, time.UTC)},
+		{"開始値つきのステップ", "5/20 * * * *", time.Date(2026, 10, 19, 10, 25, 0, 0, time.UTC)},
+		{"範囲のステップ", "0 0-12/6 * * *", time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)},
+		{"リスト", "0,30 9,18 * * *", time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC)},
+		{"月", "0 0 1 1 *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"曜日", "0 3 * * 5", time.Date(2026, 10, 23, 3, 0, 0, 0, time.UTC)},
+		{"日曜日は7でもよい", "0 3 * * 7", time.Date(2026, 10, 25, 3, 0, 0, 0, time.UTC)},
+		// 日と曜日が両方指定されている場合はどちらかに一致すればよい
+		{"日または曜日 (曜日が先)", "0 3 31 * 3", time.Date(2026, 10, 21, 3, 0, 0, 0, time.UTC)},
+		{"日または曜日 (日が先)", "0 3 20 * 6", time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC)},
+		{"日のみ", "0 3 31 * *", time.Date(2026, 10, 31, 3, 0, 0, 0, time.UTC)},
+		{"うるう日", "0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"一致しない日付", "0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			if got := s.next(base); !got.Equal(tt.want) {
+				t.Errorf("next(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeedScheduleFallback(t *testing.T) {
+	_, expr := feedSchedule("not a cron")
+	if expr != defaultFeedCheckCron {
+		t.Errorf("不正なcron式の場合は既定値を使うはずです: %q", expr)
+	}
+}
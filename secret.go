@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// 設定ファイルの秘密情報を暗号化する鍵 (この端末でのみ有効。設定ファイルと一緒に持ち出さないこと)
+const secretKeyPath string = "settings.key"
+
+// 暗号化された値の接頭辞
+const encryptedSecretPrefix string = "enc:v1:"
+
+var secretKey []byte
+var secretKeyMutex sync.Mutex
+
+// loadSecretKey は鍵ファイルを読み込む。存在しなければ作成する
+func loadSecretKey() ([]byte, error) {
+	secretKeyMutex.Lock()
+	defer secretKeyMutex.Unlock()
+
+	if secretKey != nil {
+		return secretKey, nil
+	}
+
+	b, err := os.ReadFile(secretKeyPath)
+	if os.IsNotExist(err) {
+		b = make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("鍵の生成に失敗: %w", err)
+		}
+		// O_EXCL で他のプロセスが作成した鍵を上書きしない
+		f, err := os.OpenFile(secretKeyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("鍵ファイルの作成に失敗: %w", err)
+		}
+		_, err = f.Write(b)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("鍵ファイルの書き込みに失敗: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("鍵ファイルの読み込みに失敗: %w", err)
+	}
+
+	if len(b) != 32 {
+		return nil, fmt.Errorf("鍵ファイル %s の長さが不正です", secretKeyPath)
+	}
+	secretKey = b
+	return secretKey, nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key, err := loadSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret は秘密情報をAES-GCMで暗号化する
+func encryptSecret(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret は encryptSecret で暗号化された値を復号する。
+// 暗号化されていない値 (古い設定ファイル) はそのまま返し、plaintext を true にする。
+func decryptSecret(value string) (plain string, plaintext bool, err error) {
+	if value == "" {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(value, encryptedSecretPrefix) {
+		return value, true, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedSecretPrefix))
+	if err != nil {
+		return "", false, fmt.Errorf("暗号化された値の形式が不正です: %w", err)
+	}
+	aead, err := secretCipher()
+	if err != nil {
+		return "", false, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", false, errors.New("暗号化された値が短すぎます")
+	}
+	b, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", false, fmt.Errorf("復号に失敗しました (%s が変更された可能性があります)", secretKeyPath)
+	}
+	return string(b), false, nil
+}
+
+var uidQueryPattern = regexp.MustCompile(`(?i)(uid=)[^&\s"'<>]+`)
+
+// redactSecrets はURLのクエリや文字列中のAPIキーを伏せ字にする
+func redactSecrets(s string) string {
+	s = uidQueryPattern.ReplaceAllString(s, "${1}"+redactedSecret)
+	if appConfig != nil {
+		if uid := appConfig.Get().UID; len(uid) >= 4 {
+			s = strings.ReplaceAll(s, uid, redactedSecret)
+			s = strings.ReplaceAll(s, url.QueryEscape(uid), redactedSecret)
+		}
+	}
+	return s
+}
+
+// redactURLError はHTTPクライアントのエラーに含まれるURLからAPIキーを除く
+func redactURLError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = redactSecrets(ue.URL)
+	}
+	return err
+}
+
+// redactingWriter はログ出力からAPIキーを除く
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(redactSecrets(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useSecretKey はテスト中に使う鍵を差し替える (鍵ファイルは作らない)
+func useSecretKey(t *testing.T, b byte) {
+	t.Helper()
+
+	prev := secretKey
+	secretKey = bytes.Repeat([]byte{b}, 32)
+	t.Cleanup(func() { secretKey = prev })
+}
+
+func storedUID(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored struct {
+		UID string `json:"uid"`
+	}
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored.UID
+}
+
+func TestUndecryptableSecretIsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	useSecretKey(t, 1)
+	if err := writeConfig(path, &Config{Version: configSchemaVersion, UID: "original-uid"}); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := storedUID(t, path)
+
+	// 鍵が変わって復号できない場合は未設定として読み込む
+	useSecretKey(t, 2)
+	file, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.UID != "" {
+		t.Fatalf("UID = %q", file.UID)
+	}
+
+	// APIキーを再入力せずに設定を保存しても暗号文は残る
+	m := &ConfigManager{path: path, file: file}
+	config, _ := resolveConfig(file)
+	m.current.Store(config)
+	appConfig = m
+
+	put := func(body string) SettingsResponse {
+		rec := httptest.NewRecorder()
+		settingsAPIHandler(rec, httptest.NewRequest(http.MethodPut, "/api/settings", strings.NewReader(body)))
+		var resp SettingsResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("PUT /api/settings = %d: %v", rec.Code, resp.Errors)
+		}
+		return resp
+	}
+
+	resp := put(`{"uid":"","display":{"stopName":"市役所"}}`)
+	if !resp.UIDUnreadable || resp.UIDSet {
+		t.Errorf("uidSet = %v, uidUnreadable = %v", resp.UIDSet, resp.UIDUnreadable)
+	}
+	if got := storedUID(t, path); got != ciphertext {
+		t.Errorf("復号できなかったAPIキーが上書きされました: %q", got)
+	}
+
+	// 元の鍵に戻せば読める
+	useSecretKey(t, 1)
+	if file, err := readConfig(path); err != nil || file.UID != "original-uid" {
+		t.Errorf("readConfig() = %q, %v", file.UID, err)
+	}
+
+	// 再入力した場合は新しいAPIキーで上書きする
+	useSecretKey(t, 2)
+	resp = put(`{"uid":"new-uid","display":{"stopName":"市役所"}}`)
+	if !resp.UIDSet || resp.UIDUnreadable {
+		t.Errorf("uidSet = %v, uidUnreadable = %v", resp.UIDSet, resp.UIDUnreadable)
+	}
+	if file, err := readConfig(path); err != nil || file.UID != "new-uid" {
+		t.Errorf("readConfig() = %q, %v", file.UID, err)
+	}
+}
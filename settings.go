@@ -2,69 +2,144 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"regexp"
+	"strings"
 )
 
-func saveSettings(w http.ResponseWriter, r *http.Request) {
+// 読み出し時にAPIキーの代わりに返す文字列
+const redactedSecret string = "********"
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// 設定APIで受け付けるリクエストボディの上限
+const maxSettingsBodySize int64 = 1 << 20
 
-	// フォームからAPIキーを取得
-	uid := r.FormValue("uidInput") // HTMLのinput要素のname属性と一致させる
-	agencyID := r.FormValue("agencyIdInput")
+var agencyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
 
-	// ファイルに保存
+// SettingsResponse は GET /api/settings の応答
+type SettingsResponse struct {
+	// 設定ファイルの内容。PUT /api/settings にはこの形式で送る
+	Settings *Config `json:"settings,omitempty"`
+	// 環境変数・フラグ・既定値を適用した、実際に使われている設定
+	Effective *Config `json:"effective,omitempty"`
+	UIDSet    bool    `json:"uidSet"`
+	// 設定ファイルのAPIキーを復号できなかった (再入力が必要)
+	UIDUnreadable bool     `json:"uidUnreadable"`
+	Errors        []string `json:"errors,omitempty"`
+}
 
-	file, err := os.OpenFile(configPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600) // 読み書き専用、存在しない場合は作成、存在する場合は内容をtruncate
-	if err != nil {
-		http.Error(w, "Failed to open file", http.StatusInternalServerError)
-		fmt.Println("Error opening file:", err)
-		return
+// redactConfig は秘密情報を伏せた設定の複製を返す
+func redactConfig(config *Config) *Config {
+	c := config.clone()
+	for _, secret := range []*string{&c.UID, &c.Security.AdminPasswordHash, &c.Security.ViewerPasswordHash, &c.Security.AdminTokenHash} {
+		if *secret != "" {
+			*secret = redactedSecret
+		}
 	}
-	defer file.Close()
+	return c
+}
 
-	_, err = file.WriteString("uid: " + uid + "\n" + "agency_id: " + agencyID)
-	if err != nil {
-		http.Error(w, "Failed to write to file", http.StatusInternalServerError)
-		fmt.Println("Error writing to file:", err)
-		return
+// errorList は errors.Join でまとめたエラーを1件ずつの文字列にする
+func errorList(err error) []string {
+	if err == nil {
+		return nil
 	}
-
-	renderTemplate(w, "save", nil)
+	list := make([]string, 0)
+	for _, line := range strings.Split(err.Error(), "\n") {
+		if line != "" {
+			list = append(list, line)
+		}
+	}
+	return list
 }
 
-func submitHandler(w http.ResponseWriter, r *http.Request) {
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
+func currentSettings() SettingsResponse {
+	file := appConfig.File()
+	return SettingsResponse{
+		Settings:      redactConfig(file),
+		Effective:     redactConfig(appConfig.Get()),
+		UIDSet:        appConfig.Get().UID != "",
+		UIDUnreadable: file.UID == "" && file.undecryptableSecret != "",
+		Errors:        errorList(appConfig.Err()),
 	}
+}
 
-	err := r.ParseMultipartForm(32 << 20) // 32MBのメモリ制限
-	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
-		return
+// validateSettingsFields はフォームから入力される項目の書式を検証する
+func validateSettingsFields(config *Config) error {
+	errs := make([]error, 0)
+	if strings.ContainsAny(config.UID, " \t\r\n") {
+		errs = append(errs, fmt.Errorf("uid に空白は使用できません"))
 	}
+	if !agencyIDPattern.MatchString(config.AgencyID) {
+		errs = append(errs, fmt.Errorf("agencyID は英数字、-、_ のみ使用できます: %q", config.AgencyID))
+	}
+	for _, f := range config.Feeds {
+		if !agencyIDPattern.MatchString(f.AgencyID) {
+			errs = append(errs, fmt.Errorf("フィード %s の agencyID は英数字、-、_ のみ使用できます: %q", f.ID, f.AgencyID))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	uid := r.FormValue("uid")
-	agencyID := r.FormValue("agency_id")
-
-	formData := Config{
-		UID:      uid,
-		AgencyID: agencyID,
+// settingsAPIHandler は設定の取得 (GET) と保存 (PUT) を行う
+func settingsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeSettingsJSON(w, http.StatusOK, currentSettings())
+
+	case http.MethodPut:
+		r.Body = http.MaxBytesReader(w, r.Body, maxSettingsBodySize)
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+
+		var config Config
+		if err := decoder.Decode(&config); err != nil {
+			writeSettingsJSON(w, http.StatusBadRequest, SettingsResponse{Errors: []string{"JSONの解析に失敗しました: " + err.Error()}})
+			return
+		}
+
+		// APIキーは伏せた値または空で送られてきた場合は変更しない
+		current := appConfig.File()
+		config.UID = strings.TrimSpace(config.UID)
+		if config.UID == "" || config.UID == redactedSecret {
+			config.UID = current.UID
+			config.undecryptableSecret = current.undecryptableSecret
+		}
+		// パスワードとトークンは /api/password と /api/token でのみ変更できる
+		config.Security.AdminPasswordHash = current.Security.AdminPasswordHash
+		config.Security.ViewerPasswordHash = current.Security.ViewerPasswordHash
+		config.Security.AdminTokenHash = current.Security.AdminTokenHash
+
+		if err := validateSettingsFields(&config); err != nil {
+			writeSettingsJSON(w, http.StatusBadRequest, SettingsResponse{Errors: errorList(err)})
+			return
+		}
+		if err := appConfig.Update(&config); err != nil {
+			writeSettingsJSON(w, http.StatusBadRequest, SettingsResponse{Errors: errorList(err)})
+			return
+		}
+
+		fmt.Println("設定を保存しました。")
+		writeSettingsJSON(w, http.StatusOK, currentSettings())
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
+}
 
+func writeSettingsJSON(w http.ResponseWriter, status int, body SettingsResponse) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(formData)
-
-	fmt.Printf("受信データ: UID=%s, Agency_ID=%s\n", uid, agencyID)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
 
-	writeConfig("settings.json", &formData)
+// settingsPageHandler は現在の設定を入力済みの設定ページを表示する
+func settingsPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderTemplate(w, "settings", currentSettings())
 }
 
 func updateHandler(w http.ResponseWriter, r *http.Request) {
@@ -74,5 +149,20 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	checkFeedEndDate(staticDbFile, updateStatic)
+	// 取得と再作成には時間がかかるため、受け付けたらバックグラウンドで実行する。実行中の場合は受け付けない
+	if !feedUpdateMutex.TryLock() {
+		http.Error(w, "静的フィードの更新は既に実行中です", http.StatusConflict)
+		return
+	}
+	go func() {
+		defer feedUpdateMutex.Unlock()
+		checkFeedEndDate(staticDbFile, func(dbFile string) {
+			if _, err := refreshStaticFeedLocked(dbFile, true); err != nil {
+				log.Printf("静的フィードの更新に失敗しました: %v", err)
+			}
+		})
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Update started.")
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testUID                = "test-uid-0123456789"
+	testAdminPasswordHash  = "$2a$10$adminadminadminadminadminadminadminadminadminadminadm"
+	testViewerPasswordHash = "$2a$10$viewerviewerviewerviewerviewerviewerviewerviewerviewe"
+	testAdminTokenHash     = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+// useTestSettings はAPIキーとパスワード・トークンを設定した設定ファイルを作り、appConfig に読み込む
+func useTestSettings(t *testing.T) string {
+	t.Helper()
+
+	useSecretKey(t, 1)
+	path := filepath.Join(t.TempDir(), "settings.json")
+	file := &Config{Version: configSchemaVersion, UID: testUID, AgencyID: "agency"}
+	file.Security.AdminPasswordHash = testAdminPasswordHash
+	file.Security.ViewerPasswordHash = testViewerPasswordHash
+	file.Security.AdminTokenHash = testAdminTokenHash
+	if err := writeConfig(path, file); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newConfigManager(path)
+	if err != nil {
+		t.Fatalf("newConfigManager: %v", err)
+	}
+	prev := appConfig
+	appConfig = m
+	t.Cleanup(func() { appConfig = prev })
+	return path
+}
+
+func TestSettingsAPIGetRedactsSecrets(t *testing.T) {
+	useTestSettings(t)
+
+	rec := httptest.NewRecorder()
+	settingsAPIHandler(rec, httptest.NewRequest(http.MethodGet, "/api/settings", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	body := rec.Body.String()
+	for _, secret := range []string{testUID, testAdminPasswordHash, testViewerPasswordHash, testAdminTokenHash} {
+		if strings.Contains(body, secret) {
+			t.Errorf("応答に秘密情報 %q が含まれています", secret)
+		}
+	}
+
+	var resp SettingsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.UIDSet {
+		t.Error("uidSet = false")
+	}
+	for _, c := range []*Config{resp.Settings, resp.Effective} {
+		if c.UID != redactedSecret || c.Security.AdminPasswordHash != redactedSecret ||
+			c.Security.ViewerPasswordHash != redactedSecret || c.Security.AdminTokenHash != redactedSecret {
+			t.Errorf("伏せられていない項目があります: uid=%q security=%+v", c.UID, c.Security)
+		}
+	}
+}
+
+func TestSettingsAPIPut(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantUID    string
+		wantAgency string
+	}{
+		{"未知の項目", `{"version": 2, "agencyID": "changed", "unknown": true}`, http.StatusBadRequest, testUID, "agency"},
+		{"APIキーが空", `{"version": 2, "agencyID": "changed"}`, http.StatusOK, testUID, "changed"},
+		{"APIキーが伏せた値", `{"version": 2, "uid": "********", "agencyID": "changed"}`, http.StatusOK, testUID, "changed"},
+		{"APIキーが空白のみ", `{"version": 2, "uid": "  ", "agencyID": "changed"}`, http.StatusOK, testUID, "changed"},
+		{"APIキーを変更", `{"version": 2, "uid": "new-uid", "agencyID": "changed"}`, http.StatusOK, "new-uid", "changed"},
+		// パスワードとトークンは設定APIからは変更できない
+		{"ハッシュの書き換え", `{"version": 2, "security": {"adminPasswordHash": "$2a$10$other", "viewerPasswordHash": "", "adminTokenHash": "` +
+			strings.Repeat("f", 64) + `"}}`, http.StatusOK, testUID, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useTestSettings(t)
+
+			rec := httptest.NewRecorder()
+			settingsAPIHandler(rec, httptest.NewRequest(http.MethodPut, "/api/settings", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			// 保存された設定ファイルを読み直して確認する
+			file, err := readConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.UID != tt.wantUID {
+				t.Errorf("uid = %q, want %q", file.UID, tt.wantUID)
+			}
+			if file.AgencyID != tt.wantAgency {
+				t.Errorf("agencyID = %q, want %q", file.AgencyID, tt.wantAgency)
+			}
+			if file.Security.AdminPasswordHash != testAdminPasswordHash ||
+				file.Security.ViewerPasswordHash != testViewerPasswordHash ||
+				file.Security.AdminTokenHash != testAdminTokenHash {
+				t.Errorf("パスワード・トークンのハッシュが変わりました: %+v", file.Security)
+			}
+			if got := appConfig.Get().UID; got != tt.wantUID {
+				t.Errorf("現在の設定の uid = %q, want %q", got, tt.wantUID)
+			}
+		})
+	}
+}
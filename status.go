@@ -1,16 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 type TimeTable struct {
@@ -19,24 +15,23 @@ type TimeTable struct {
 	DepartureTime string `json:"departure_time"`
 	Delay         string `json:"delay"`
 	Destination   string `json:"destination"`
+	Operator      string `json:"operator"`
+	// 系統番号と系統の色 (16進数6桁。色がなければ空)
+	RouteShortName string `json:"route_short_name"`
+	RouteColor     string `json:"route_color"`
+	RouteTextColor string `json:"route_text_color"`
+	// 運行状況 (departureStatus.go) と表示名
+	Status      DepartureStatus `json:"status"`
+	StatusLabel string          `json:"status_label"`
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // 全てのオリジンからの接続を許可 (本番環境では制限すべき)
-	},
-}
-
-var clients = make(map[*websocket.Conn]bool)
 var broadcast = make(chan []TimeTable)
-var mutex sync.Mutex
 
 // getTimetable 定期的に運行情報を取得する
 func getTimetable() []TimeTable {
 
 	timeTables := make([]TimeTable, 0)
+	config := appConfig.Get()
 
 	// マスタDBに接続
 	staticDb, err := setupDb(staticDbFile)
@@ -53,7 +48,7 @@ func getTimetable() []TimeTable {
 	defer dynamicDb.Close()
 
 	// マスタDBにトランザクションDBを接続
-	staticDb.Exec("ATTACH DATABASE './databases/dynamic.sql' AS d;")
+	staticDb.Exec("ATTACH DATABASE ? AS d;", databasePath(dynamicDbFile))
 
 	vehiclePosData := fetchVehiclePosition()
 	tripUpdateData := fetchTripUpdate()
@@ -62,11 +57,18 @@ func getTimetable() []TimeTable {
 
 	// DBを更新
 	insertTripUpdateResponse(staticDb, tripUpdateData)
+	if err := insertVehiclePositionResponse(dynamicDb, vehiclePosData); err != nil {
+		log.Printf("車両位置の保存に失敗: %v", err)
+	}
+
+	relationships := newRealtimeRelationships(tripUpdateData)
+	currentTime := time.Now()
 
 	// vehiclePosData と tripUpdateData を組み合わせて TimeTable を作成
 	count := 0
+	seenTrips := make(map[string]bool)
 	for _, vpEntity := range vehiclePosData.Entity {
-		if count >= 128 {
+		if count >= config.Display.MaxRows {
 			break
 		}
 
@@ -76,7 +78,7 @@ func getTimetable() []TimeTable {
 		// stopSeq := vpEntity.Vehicle.CurrentStopSequence
 
 		// 停留所名から表示する項目を検索
-		stopName := "福島駅東口" // あとで変数化する
+		stopName := config.Display.StopName
 		// ばかでかいクエリ trip_update_entity_idの最新版を抽出しようとしたらこうなった
 		// 有識者による修正求む
 		staticDataQuery := `
@@ -85,8 +87,14 @@ func getTimetable() []TimeTable {
 					st.departure_time,
 					st.stop_headsign,
 					r.route_long_name,
+					r.route_id,
+					COALESCE(r.route_short_name, '') AS route_short_name,
+					COALESCE(r.route_color, '') AS route_color,
+					COALESCE(r.route_text_color, '') AS route_text_color,
+					COALESCE(a.agency_name, '') AS agency_name,
 					stu.departure_delay,
-					st.stop_sequence,
+					CAST(st.stop_sequence AS INTEGER) AS stop_sequence,
+					(SELECT MIN(CAST(fst.stop_sequence AS INTEGER)) FROM stop_times AS fst WHERE fst.trip_id = st.trip_id) AS first_stop_sequence,
 					stu.trip_update_entity_id,
 					CAST(
 						SUBSTR(
@@ -130,6 +138,9 @@ func getTimetable() []TimeTable {
 				JOIN
 					routes AS r
 					ON t.route_id = r.route_id
+				LEFT JOIN
+					agency AS a
+					ON r.agency_id = a.agency_id
 				JOIN
 					d.stop_time_update AS stu
 					ON stu.stop_id = s.stop_id
@@ -143,21 +154,27 @@ func getTimetable() []TimeTable {
 				departure_time,
 				stop_headsign,
 				route_long_name,
+				route_id,
+				route_short_name,
+				route_color,
+				route_text_color,
+				agency_name,
 				departure_delay,
 				stop_sequence,
+				first_stop_sequence,
 				trip_update_entity_id
 			FROM
 				ParsedTripUpdate
 			WHERE
 				version_number = (SELECT MAX(version_number) FROM ParsedTripUpdate)
-			LIMIT 128;
+			LIMIT ?;
 		`
-		staticData, err := QueryRows(staticDb, staticDataQuery, stopName, tripID)
+		staticData, err := QueryRows(staticDb, staticDataQuery, stopName, tripID, config.Display.MaxRows)
 		if err != nil {
-			fmt.Printf("%v\n", err)
+			log.Printf("便 %s の時刻の取得に失敗しました: %v", tripID, err)
 		}
 
-		currentTime := time.Now()
+		seenTrips[tripID] = true
 
 		for _, i := range staticData {
 			departureTimeStr := i["departure_time"].(string)
@@ -165,7 +182,7 @@ func getTimetable() []TimeTable {
 			// departure timeの文字列をtime.Timeオブジェクトにパース
 			parts := strings.Split(departureTimeStr, ":")
 			if len(parts) != 3 {
-				fmt.Printf("Invalid departure_time format: %s. Skipping.\n", departureTimeStr)
+				log.Printf("departure_time の形式が不正なため読み飛ばします: %s", departureTimeStr)
 				continue
 			}
 
@@ -176,96 +193,152 @@ func getTimetable() []TimeTable {
 			// 現在時刻のtime.Timeオブジェクトを作成
 			departureTime := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), hour, minute, second, 0, currentTime.Location())
 
-			// departure_timeが現在以降の場合のみappend
-			if departureTime.Before(currentTime) {
-				continue
+			stopSequence := i["stop_sequence"].(int64)
+			facts := departureFacts{
+				Scheduled:           departureTime,
+				Delay:               int(i["departure_delay"].(int64)),
+				StopSequence:        stopSequence,
+				FirstStopSequence:   i["first_stop_sequence"].(int64),
+				VehicleStopSequence: vpEntity.Vehicle.CurrentStopSequence,
+				TripRelationship:    relationships.trips[tripID],
+				StopRelationship:    relationships.stops[tripID][stopSequence],
 			}
 
-			// 遅延が60秒未満の場合は表示しない
-			delay := ""
-			if i["departure_delay"].(int64) > 60 {
-				delay = fmt.Sprintf("遅れ 約%d分", i["departure_delay"].(int64)/60)
+			// 出発予定時刻 (遅延を含む) から display.departedRetention 秒を過ぎた便は表示しない
+			if !facts.visible(config.Display, currentTime) {
+				continue
 			}
 
-			timeTables = append(timeTables, TimeTable{
-				RouteID:       i["route_long_name"].(string),
-				Delay:         delay,
-				DepartureTime: removeLastSymbol(":", i["departure_time"].(string)),
-				Destination:   i["stop_headsign"].(string),
-			})
+			timeTables = append(timeTables, newTimeTableRow(i, facts, config, currentTime))
 		}
 		count++
 	}
-	return timeTables
-}
 
-// デバッグ用
-// fmt.Printf("test\n")
+	// 運休の便は車両位置がないため、時刻表から停留所の出発時刻を求めて表示する
+	today := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, currentTime.Location())
+	for _, tripID := range relationships.cancelledTrips() {
+		if count >= config.Display.MaxRows {
+			break
+		}
+		if seenTrips[tripID] {
+			continue
+		}
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Fatal(err)
+		cancelledData, err := QueryRows(staticDb, `
+			SELECT
+				st.departure_time,
+				COALESCE(st.stop_headsign, '') AS stop_headsign,
+				r.route_long_name,
+				r.route_id,
+				COALESCE(r.route_short_name, '') AS route_short_name,
+				COALESCE(r.route_color, '') AS route_color,
+				COALESCE(r.route_text_color, '') AS route_text_color,
+				COALESCE(a.agency_name, '') AS agency_name,
+				CAST(st.stop_sequence AS INTEGER) AS stop_sequence
+			FROM stop_times AS st
+			JOIN stops AS s ON st.stop_id = s.stop_id
+			JOIN trips AS t ON st.trip_id = t.trip_id
+			JOIN routes AS r ON t.route_id = r.route_id
+			LEFT JOIN agency AS a ON r.agency_id = a.agency_id
+			WHERE s.stop_name = ? AND st.trip_id = ?`, config.Display.StopName, tripID)
+		if err != nil {
+			log.Printf("運休の便 %s の時刻の取得に失敗しました: %v", tripID, err)
+			continue
+		}
+
+		for _, i := range cancelledData {
+			departureTime, ok := gtfsTimeOn(today, i["departure_time"].(string))
+			if !ok {
+				continue
+			}
+			facts := departureFacts{
+				Scheduled:        departureTime,
+				StopSequence:     i["stop_sequence"].(int64),
+				TripRelationship: relationships.trips[tripID],
+			}
+			if !facts.visible(config.Display, currentTime) {
+				continue
+			}
+			timeTables = append(timeTables, newTimeTableRow(i, facts, config, currentTime))
+		}
+		count++
 	}
-	defer ws.Close()
 
-	mutex.Lock()
-	clients[ws] = true
-	mutex.Unlock()
+	// 複数事業者の便を出発時刻順に並べる
+	sort.SliceStable(timeTables, func(a, b int) bool {
+		return timeTables[a].DepartureTime < timeTables[b].DepartureTime
+	})
 
-	fmt.Println("Client connected")
+	return timeTables
+}
 
-	for {
-		var msg map[string]interface{}
-		err := ws.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("error: %v", err)
-			delete(clients, ws)
-			break
-		}
-		fmt.Printf("Received message: %v\n", msg)
-		// クライアントからのメッセージを処理する場合はここに記述
+// newTimeTableRow は getTimetable のクエリ結果の1行と運行状況から発車標の1行を作成する
+func newTimeTableRow(row map[string]interface{}, facts departureFacts, config *Config, now time.Time) TimeTable {
+	// 遅延が閾値以下の場合は表示しない
+	delay := ""
+	if facts.Delay > *config.Display.DelayThreshold {
+		delay = fmt.Sprintf("遅れ 約%d分", facts.Delay/60)
+	}
+
+	routeColor, routeTextColor := config.routeColor(row["route_id"].(string), row["route_short_name"].(string),
+		row["route_long_name"].(string), row["route_color"].(string), row["route_text_color"].(string))
+
+	status := classifyDeparture(facts, config.Display, now)
+	return TimeTable{
+		RouteID:        row["route_long_name"].(string),
+		RouteShortName: row["route_short_name"].(string),
+		RouteColor:     routeColor,
+		RouteTextColor: routeTextColor,
+		Delay:          delay,
+		DepartureTime:  removeLastSymbol(":", row["departure_time"].(string)),
+		Destination:    row["stop_headsign"].(string),
+		Operator:       row["agency_name"].(string),
+		Status:         status,
+		StatusLabel:    departureStatusLabel(status, facts.Delay),
 	}
 }
 
+// デバッグ用
+// fmt.Printf("test\n")
+
 func broadcastTimetable() {
-	ticker := time.NewTicker(30 * time.Second) // 1分間隔で運行情報を送信
+	interval := time.Duration(appConfig.Get().Realtime.PollInterval) * time.Second
+	ticker := time.NewTicker(interval) // 設定された間隔で運行情報を送信
 	defer ticker.Stop()
 
-	for range ticker.C {
+	// 設定が変更された場合は次の周期を待たずに送信する
+	changes := appConfig.Subscribe()
+
+	// 起動直後に接続したクライアントにも送れるよう、最初の運行情報はすぐに作成する
+	for {
 		timetable := getTimetable()
 		broadcast <- timetable
+
+		select {
+		case <-ticker.C:
+		case config := <-changes:
+			if d := time.Duration(config.Realtime.PollInterval) * time.Second; d != interval {
+				interval = d
+				ticker.Reset(interval)
+			}
+		}
 	}
 }
 
 func handleBroadcasts() {
+	var seq uint64
 	for timetable := range broadcast {
-		jsonBytes, err := json.Marshal(timetable)
+		seq++
+		message, err := newBoardMessage(seq, timetable)
 
 		// デバッグ用 取得した運行情報をコンソールに表示
-		// fmt.Printf("%s", jsonBytes)
+		// fmt.Printf("%s", message.data)
 
 		if err != nil {
 			log.Println("Error marshalling JSON:", err)
 			continue
 		}
 
-		mutex.Lock()
-		for client := range clients {
-			err := client.WriteMessage(websocket.TextMessage, jsonBytes)
-			if err != nil {
-				log.Printf("error: %v", err)
-				client.Close()
-				delete(clients, client)
-			}
-		}
-		mutex.Unlock()
+		hub.broadcast <- message
 	}
 }
-
-func timetableHandler(w http.ResponseWriter, r *http.Request) {
-
-	// timeTable := getTimetable()
-
-	renderTemplate(w, "time-table", nil)
-}
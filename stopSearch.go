@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 近傍検索に使う格子の大きさ (度)。緯度方向で約1.1km
+const stopBucketSize float64 = 0.01
+
+// 地球の半径 (メートル)
+const earthRadius float64 = 6371000
+
+// translations の言語のうち、読み仮名とローマ字として扱うもの
+const (
+	kanaLanguage   string = "ja-Hrkt"
+	romajiLanguage string = "en"
+)
+
+// stopBucket は近傍検索の格子の番号
+type stopBucket struct {
+	lat int
+	lon int
+}
+
+func bucketOf(lat float64, lon float64) stopBucket {
+	return stopBucket{lat: int(math.Floor(lat / stopBucketSize)), lon: int(math.Floor(lon / stopBucketSize))}
+}
+
+type stopIndexEntry struct {
+	stop apiStop
+	// 検索に使う正規化済みの停留所名・読み仮名・ローマ字など
+	keys []string
+}
+
+// stopIndex は停留所の検索用の索引。静的DBが更新されるまで使い回す
+type stopIndex struct {
+	modTime time.Time
+	entries []stopIndexEntry
+	buckets map[stopBucket][]int
+}
+
+var stopIndexCache *stopIndex
+var stopIndexMutex sync.Mutex
+
+// currentStopIndex は静的DBから作成した索引を返す。DBが更新されていれば作り直す
+func currentStopIndex() (*stopIndex, error) {
+	info, err := os.Stat(databasePath(staticDbFile))
+	if err != nil {
+		return nil, fmt.Errorf("静的DBの確認に失敗: %w", err)
+	}
+
+	stopIndexMutex.Lock()
+	defer stopIndexMutex.Unlock()
+
+	if stopIndexCache != nil && stopIndexCache.modTime.Equal(info.ModTime()) {
+		return stopIndexCache, nil
+	}
+
+	db, err := openReadOnlyDb(staticDbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	index, err := loadStopIndex(db)
+	if err != nil {
+		return nil, err
+	}
+	index.modTime = info.ModTime()
+	stopIndexCache = index
+	return index, nil
+}
+
+func loadStopIndex(db *sql.DB) (*stopIndex, error) {
+	stops, err := queryStops(db, `SELECT `+apiStopColumns+` FROM stops AS s WHERE s.stop_id <> 'stop_id' ORDER BY s.stop_name, s.stop_id`)
+	if err != nil {
+		return nil, err
+	}
+
+	// 停留所名の翻訳 (record_id が停留所ID、または field_value が停留所名のもの)
+	rows, err := db.Query(`
+		SELECT COALESCE(language, ''), COALESCE(translation, ''), COALESCE(record_id, ''), COALESCE(field_value, '')
+		FROM translations
+		WHERE table_name = 'stops' AND field_name = 'stop_name'`)
+	if err != nil {
+		return nil, fmt.Errorf("translationsの取得に失敗: %w", err)
+	}
+	defer rows.Close()
+
+	type translation struct{ language, text string }
+	byID := make(map[string][]translation)
+	byName := make(map[string][]translation)
+	for rows.Next() {
+		var language, text, recordID, fieldValue string
+		if err := rows.Scan(&language, &text, &recordID, &fieldValue); err != nil {
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+		if recordID != "" {
+			byID[recordID] = append(byID[recordID], translation{language, text})
+		} else if fieldValue != "" {
+			byName[fieldValue] = append(byName[fieldValue], translation{language, text})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	index := &stopIndex{
+		entries: make([]stopIndexEntry, 0, len(stops)),
+		buckets: make(map[stopBucket][]int),
+	}
+	for _, stop := range stops {
+		entry := stopIndexEntry{keys: []string{normalizeSearchText(stop.Name)}}
+		for _, t := range append(byID[stop.ID], byName[stop.Name]...) {
+			switch t.language {
+			case kanaLanguage:
+				stop.Kana = t.text
+			case romajiLanguage:
+				stop.Romaji = t.text
+			}
+			if key := normalizeSearchText(t.text); key != "" {
+				entry.keys = append(entry.keys, key)
+			}
+		}
+		entry.stop = stop
+
+		i := len(index.entries)
+		index.entries = append(index.entries, entry)
+		// 座標のない停留所は近傍検索の対象外
+		if stop.Lat != 0 || stop.Lon != 0 {
+			b := bucketOf(stop.Lat, stop.Lon)
+			index.buckets[b] = append(index.buckets[b], i)
+		}
+	}
+	return index, nil
+}
+
+// normalizeSearchText は検索用に文字列を正規化する。
+// 全角英数字を半角に、カタカナをひらがなに、英字を小文字にし、空白と記号を除く
+func normalizeSearchText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 0xFF01 && r <= 0xFF5E:
+			r -= 0xFEE0
+		case r >= 0x30A1 && r <= 0x30F6:
+			r -= 0x60
+		}
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// matchScore は検索語と停留所の一致度を返す (小さいほど良い)。一致しなければ -1
+func matchScore(query string, key string) int {
+	switch {
+	case key == query:
+		return 0
+	case strings.HasPrefix(key, query):
+		return 1
+	case strings.Contains(key, query):
+		return 2
+	}
+
+	// 入力の誤りを許容する。短い検索語では誤りを許さない
+	q := []rune(query)
+	maxDistance := len(q) / 4
+	if maxDistance == 0 {
+		return -1
+	}
+	if d := prefixEditDistance(q, []rune(key)); d <= maxDistance {
+		return 2 + d
+	}
+	return -1
+}
+
+// prefixEditDistance は query と、target の先頭部分との編集距離の最小値を返す
+func prefixEditDistance(query []rune, target []rune) int {
+	prev := make([]int, len(target)+1)
+	curr := make([]int, len(target)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(query); i++ {
+		curr[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if query[i-1] == target[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	best := prev[0]
+	for _, d := range prev {
+		best = min(best, d)
+	}
+	return best
+}
+
+// Search は停留所名・読み仮名・ローマ字で停留所を検索し、一致度の高い順に返す
+func (index *stopIndex) Search(query string) []apiStop {
+	q := normalizeSearchText(query)
+	if q == "" {
+		return []apiStop{}
+	}
+
+	type match struct {
+		entry *stopIndexEntry
+		score int
+	}
+	matches := make([]match, 0)
+	for i := range index.entries {
+		entry := &index.entries[i]
+		best := -1
+		for _, key := range entry.keys {
+			if score := matchScore(q, key); score >= 0 && (best < 0 || score < best) {
+				best = score
+			}
+		}
+		if best >= 0 {
+			matches = append(matches, match{entry, best})
+		}
+	}
+
+	sort.SliceStable(matches, func(a, b int) bool {
+		if matches[a].score != matches[b].score {
+			return matches[a].score < matches[b].score
+		}
+		return len([]rune(matches[a].entry.stop.Name)) < len([]rune(matches[b].entry.stop.Name))
+	})
+
+	stops := make([]apiStop, len(matches))
+	for i, m := range matches {
+		stops[i] = m.entry.stop
+	}
+	return stops
+}
+
+// apiNearbyStop は近傍検索の結果
+type apiNearbyStop struct {
+	apiStop
+	Distance float64 `json:"distance"` // メートル
+}
+
+// Nearby は指定地点から radius メートル以内の停留所を近い順に返す
+func (index *stopIndex) Nearby(lat float64, lon float64, radius float64) []apiNearbyStop {
+	// radius を覆う範囲の格子のみを調べる。経度方向の格子は高緯度ほど狭い
+	metersPerDegree := earthRadius * math.Pi / 180
+	latCells := int(math.Ceil(radius / (stopBucketSize * metersPerDegree)))
+	lonCells := int(math.Ceil(radius / (stopBucketSize * metersPerDegree * math.Max(math.Cos(lat*math.Pi/180), 0.01))))
+
+	center := bucketOf(lat, lon)
+	stops := make([]apiNearbyStop, 0)
+	for dy := -latCells; dy <= latCells; dy++ {
+		for dx := -lonCells; dx <= lonCells; dx++ {
+			for _, i := range index.buckets[stopBucket{lat: center.lat + dy, lon: center.lon + dx}] {
+				stop := index.entries[i].stop
+				if d := haversine(lat, lon, stop.Lat, stop.Lon); d <= radius {
+					stops = append(stops, apiNearbyStop{apiStop: stop, Distance: math.Round(d)})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(stops, func(a, b int) bool {
+		return stops[a].Distance < stops[b].Distance
+	})
+	return stops
+}
+
+// haversine は2地点間の距離 (メートル) を返す
+func haversine(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
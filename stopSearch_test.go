@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newTestStopIndex は停留所と読み仮名・ローマ字の翻訳から索引を作る
+func newTestStopIndex(t *testing.T, stops []apiStop, translations [][4]string) *stopIndex {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "static.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := createStaticTables(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stops {
+		if _, err := db.Exec(`INSERT INTO stops (stop_id, stop_name, stop_lat, stop_lon) VALUES (?, ?, ?, ?)`, s.ID, s.Name, s.Lat, s.Lon); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// {record_id, field_value, language, translation}
+	for _, tr := range translations {
+		if _, err := db.Exec(`INSERT INTO translations (table_name, field_name, record_id, record_sub_id, field_value, language, translation)
+			VALUES ('stops', 'stop_name', ?, '', ?, ?, ?)`, tr[0], tr[1], tr[2], tr[3]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, err := loadStopIndex(db)
+	if err != nil {
+		t.Fatalf("loadStopIndex: %v", err)
+	}
+	return index
+}
+
+func TestNormalizeSearchText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ＡＢＣ１２３", "abc123"},
+		{"フクシマエキ", "ふくしまえき"},
+		{"ヴィラ", "ゔぃら"},
+		{"福島駅　東口", "福島駅東口"},
+		{"福島駅（東口）", "福島駅東口"},
+		{"Fukushima-Eki Higashiguchi", "fukushimaekihigashiguchi"},
+		{"・ー", "ー"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeSearchText(tt.in); got != tt.want {
+			t.Errorf("normalizeSearchText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchScore(t *testing.T) {
+	tests := []struct {
+		name       string
+		query, key string
+		want       int
+	}{
+		{"完全一致", "ふくしま", "ふくしま", 0},
+		{"前方一致", "ふくしま", "ふくしまえき", 1},
+		{"部分一致", "ふくしま", "しんふくしま", 2},
+		{"1文字違い", "fukushma", "fukushimaeki", 3},
+		{"2文字違い", "fukshma", "fukushimaeki", -1},
+		{"8文字で2文字違い", "fukshmae", "fukushimaeki", 4},
+		{"短い検索語は誤りを許さない", "ふか", "ふくしま", -1},
+		{"一致しない", "びょういん", "ふくしま", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchScore(tt.query, tt.key); got != tt.want {
+				t.Errorf("matchScore(%q, %q) = %d, want %d", tt.query, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixEditDistance(t *testing.T) {
+	tests := []struct {
+		query, target string
+		want          int
+	}{
+		{"abc", "abcdef", 0},
+		{"abd", "abcdef", 1},
+		{"axc", "abcdef", 1},
+		{"ac", "abcdef", 1},
+		{"abc", "", 3},
+		{"", "abc", 0},
+	}
+	for _, tt := range tests {
+		if got := prefixEditDistance([]rune(tt.query), []rune(tt.target)); got != tt.want {
+			t.Errorf("prefixEditDistance(%q, %q) = %d, want %d", tt.query, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestStopIndexSearch(t *testing.T) {
+	index := newTestStopIndex(t, []apiStop{
+		{ID: "1", Name: "福島駅東口"},
+		{ID: "2", Name: "福島"},
+		{ID: "3", Name: "新福島"},
+		{ID: "4", Name: "県庁前"},
+	}, [][4]string{
+		{"1", "", kanaLanguage, "フクシマエキヒガシグチ"},
+		{"1", "", romajiLanguage, "Fukushima-Eki Higashiguchi"},
+		{"", "福島", kanaLanguage, "フクシマ"},
+		{"", "福島", romajiLanguage, "Fukushima"},
+		{"3", "", kanaLanguage, "シンフクシマ"},
+		{"3", "", romajiLanguage, "Shin-Fukushima"},
+	})
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		// 完全一致、前方一致、部分一致の順
+		{"読み仮名", "ふくしま", []string{"2", "1", "3"}},
+		{"全角カタカナ", "フクシマ", []string{"2", "1", "3"}},
+		{"停留所名", "福島", []string{"2", "1", "3"}},
+		// 誤りを含む場合は同じ一致度なら短い停留所名を先にする
+		{"ローマ字の誤り", "fukushma", []string{"2", "1"}},
+		{"全角英字", "ＦＵＫＵＳＨＩＭＡ", []string{"2", "1", "3"}},
+		{"一致なし", "びょういん", []string{}},
+		{"記号のみ", "・", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := make([]string, 0)
+			for _, s := range index.Search(tt.query) {
+				ids = append(ids, s.ID)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, ids, tt.want)
+			}
+		})
+	}
+
+	// 検索結果には読み仮名とローマ字を含める
+	if got := index.Search("ひがしぐち"); len(got) != 1 || got[0].Kana != "フクシマエキヒガシグチ" || got[0].Romaji != "Fukushima-Eki Higashiguchi" {
+		t.Errorf("Search(ひがしぐち) = %+v", got)
+	}
+}
+
+func TestStopIndexNearby(t *testing.T) {
+	// 中心は格子 (3775, 14045) の角の近く。隣の格子の停留所も距離が近ければ返す
+	const lat, lon = 37.7598, 140.4598
+	index := newTestStopIndex(t, []apiStop{
+		{ID: "same", Name: "同じ格子", Lat: 37.7596, Lon: 140.4596},
+		{ID: "north", Name: "北の格子", Lat: 37.7601, Lon: 140.4598},
+		{ID: "diagonal", Name: "斜めの格子", Lat: 37.7603, Lon: 140.4603},
+		{ID: "far", Name: "遠く", Lat: 37.7700, Lon: 140.4598},
+		{ID: "nocoord", Name: "座標なし"},
+	}, nil)
+
+	if b := bucketOf(37.7601, 140.4598); b == bucketOf(lat, lon) {
+		t.Fatalf("北の停留所が中心と同じ格子 %v です", b)
+	}
+
+	tests := []struct {
+		radius float64
+		want   []string
+	}{
+		{10, []string{}},
+		{40, []string{"same", "north"}},
+		{100, []string{"same", "north", "diagonal"}},
+		{2000, []string{"same", "north", "diagonal", "far"}},
+	}
+	for _, tt := range tests {
+		got := index.Nearby(lat, lon, tt.radius)
+		ids := make([]string, 0, len(got))
+		for _, s := range got {
+			ids = append(ids, s.ID)
+		}
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("Nearby(radius=%v) = %v, want %v", tt.radius, ids, tt.want)
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i].Distance < got[i-1].Distance {
+				t.Errorf("Nearby(radius=%v) が距離順ではありません: %v", tt.radius, got)
+			}
+		}
+	}
+}
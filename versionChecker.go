@@ -1,8 +1,18 @@
 package main
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -57,3 +67,515 @@ func checkFeedEndDate(dbFile string, processFunc func(string)) {
 		log.Printf("行の処理中にエラーが発生しました: %v", err)
 	}
 }
+
+// feedStatePath は静的フィードの取得状態 (ETag等) を保存するファイルのパスを返す
+func feedStatePath() string {
+	return databasePath("feed_state.json")
+}
+
+// feed_end_date までの残り日数がこれ以下になった場合は条件付きリクエストを使わずに再取得する
+const feedRefreshLeadDays int = 7
+
+// FeedSourceState はフィードごとの前回取得時の情報を保持する
+type FeedSourceState struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// FeedState は前回取得した静的フィードの情報を保持する
+type FeedState struct {
+	// フィードID -> 取得時の情報 (単一事業者の場合のキーは "")
+	Sources     map[string]FeedSourceState `json:"sources,omitempty"`
+	FeedVersion string                     `json:"feedVersion,omitempty"`
+	CheckedAt   string                     `json:"checkedAt,omitempty"`
+	UpdatedAt   string                     `json:"updatedAt,omitempty"`
+}
+
+// 静的フィードの更新が同時に実行されないようにする
+var feedUpdateMutex sync.Mutex
+
+func loadFeedState() FeedState {
+	state := FeedState{Sources: make(map[string]FeedSourceState)}
+
+	b, err := os.ReadFile(feedStatePath())
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		log.Printf("feed_state.json の読み込みに失敗しました: %v", err)
+	}
+	if state.Sources == nil {
+		state.Sources = make(map[string]FeedSourceState)
+	}
+	return state
+}
+
+// clone は Sources を複製した FeedState を返す
+func (s FeedState) clone() FeedState {
+	c := s
+	c.Sources = make(map[string]FeedSourceState, len(s.Sources))
+	for k, v := range s.Sources {
+		c.Sources[k] = v
+	}
+	return c
+}
+
+func saveFeedState(state FeedState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+
+	tmp := feedStatePath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return os.Rename(tmp, feedStatePath())
+}
+
+// readFeedInfo は dbFile の feed_info を読み込む。
+// 複数事業者のフィードを統合したDBの場合は、feed_version を連結し、有効期間は全フィードに共通の範囲を返す。
+func readFeedInfo(dbFile string) (*FeedInfo, error) {
+	db, err := setupDb(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// CSVのヘッダ行も登録されているため、日付が数字で始まる行のみを対象にする
+	rows, err := db.Query(`
+		SELECT COALESCE(feed_id, ''), feed_publisher_name, feed_publisher_url, feed_lang, feed_start_date, feed_end_date, feed_version
+		FROM feed_info
+		WHERE feed_start_date GLOB '[0-9]*'
+		ORDER BY feed_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("feed_infoの取得に失敗: %w", err)
+	}
+	defer rows.Close()
+
+	var result *FeedInfo
+	versions := make([]string, 0)
+	for rows.Next() {
+		var feedID string
+		var fi FeedInfo
+		if err := rows.Scan(&feedID, &fi.FeedPublisherName, &fi.FeedPublisherURL, &fi.FeedLang, &fi.FeedStartDate, &fi.FeedEndDate, &fi.FeedVersion); err != nil {
+			return nil, fmt.Errorf("スキャンに失敗しました: %w", err)
+		}
+
+		if feedID != "" {
+			versions = append(versions, feedID+"="+fi.FeedVersion)
+		}
+		if result == nil {
+			result = &fi
+			continue
+		}
+		if fi.FeedStartDate > result.FeedStartDate {
+			result.FeedStartDate = fi.FeedStartDate
+		}
+		if fi.FeedEndDate < result.FeedEndDate {
+			result.FeedEndDate = fi.FeedEndDate
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("行の反復処理中にエラーが発生しました: %w", err)
+	}
+	if result == nil {
+		return nil, fmt.Errorf("feed_infoの取得に失敗: %w", sql.ErrNoRows)
+	}
+	if len(versions) > 0 {
+		result.FeedVersion = strings.Join(versions, ",")
+	}
+	return result, nil
+}
+
+// feedExpiresWithin は現在のフィードの feed_end_date まで days 日以内かどうかを返す
+func feedExpiresWithin(dbFile string, days int) bool {
+	fi, err := readFeedInfo(dbFile)
+	if err != nil {
+		return true
+	}
+
+	endDate, err := time.ParseInLocation("20060102", fi.FeedEndDate, time.Local)
+	if err != nil {
+		return true
+	}
+	return time.Until(endDate) <= time.Duration(days)*24*time.Hour
+}
+
+// feedStagingDir は静的フィードの作業用ディレクトリを返す
+func feedStagingDir() string {
+	return databasePath("staging")
+}
+
+// prepareStagingDir は作業用ディレクトリを空の状態で作成する
+func prepareStagingDir() error {
+	if err := os.RemoveAll(feedStagingDir()); err != nil {
+		return fmt.Errorf("作業用ディレクトリの削除に失敗: %w", err)
+	}
+	if err := os.MkdirAll(feedStagingDir(), 0755); err != nil {
+		return fmt.Errorf("作業用ディレクトリの作成に失敗: %w", err)
+	}
+	return nil
+}
+
+// hashFile はファイルのSHA-256を16進数で返す
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// downloadFeedArchive は静的フィードのZIPを dest に保存する。
+// conditional が true の場合は前回の ETag / Last-Modified を送信し、変更がなければ notModified を返す。
+func downloadFeedArchive(targetURL, dest string, prev FeedSourceState, conditional bool) (src FeedSourceState, notModified bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, targetURL, nil)
+	if err != nil {
+		return src, false, fmt.Errorf("リクエストの作成に失敗: %w", err)
+	}
+	if conditional {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return src, false, fmt.Errorf("静的フィードの取得に失敗: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return prev, true, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return src, false, fmt.Errorf("HTTP status error: %d", resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return src, false, err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return src, false, err
+	}
+	_, err = io.Copy(out, resp.Body)
+	out.Close()
+	if err != nil {
+		return src, false, fmt.Errorf("静的フィードの保存に失敗: %w", err)
+	}
+
+	src.ETag = resp.Header.Get("ETag")
+	src.LastModified = resp.Header.Get("Last-Modified")
+	if src.Hash, err = hashFile(dest); err != nil {
+		return src, false, fmt.Errorf("静的フィードのハッシュ計算に失敗: %w", err)
+	}
+	return src, false, nil
+}
+
+// stageFeedArchive はZIPを作業用ディレクトリ内のフィードのディレクトリに展開する
+func stageFeedArchive(zipPath string, feeds []FeedConfig) error {
+	if err := extract(zipPath, filepath.Dir(zipPath)); err != nil {
+		return fmt.Errorf("静的フィードの展開に失敗: %w", err)
+	}
+	// 複数事業者の場合、ZIPはGTFSディレクトリ内に置かれるため削除する
+	if isMultiFeed(feeds) {
+		os.Remove(zipPath)
+	}
+	return nil
+}
+
+// stagingZipPath はフィードのZIPを保存する作業用のパスを返す
+func stagingZipPath(feed FeedConfig) string {
+	return feedDir(filepath.Join(feedStagingDir(), "gtfs"), feed) + ".zip"
+}
+
+// stageInstalledFeed は現在展開済みのフィードを作業用ディレクトリに複製する
+func stageInstalledFeed(feed FeedConfig) error {
+	stagingDir := feedDir(filepath.Join(feedStagingDir(), "gtfs"), feed)
+	if err := copyGtfsDir(feedDir("./static/gtfs", feed), stagingDir); err != nil {
+		return err
+	}
+	return validateGtfsDir(stagingDir)
+}
+
+// refreshStaticFeed は新しい静的フィードがあれば取得し、無停止でDBを差し替える。
+// 新しいDBは別ファイルに作成してからリネームするため、更新中も表示は止まらない。
+// force が true の場合は ETag や内容が同じでも再作成する。
+func refreshStaticFeed(dbFile string, force bool) (bool, error) {
+	if !feedUpdateMutex.TryLock() {
+		return false, fmt.Errorf("静的フィードの更新は既に実行中です")
+	}
+	defer feedUpdateMutex.Unlock()
+
+	return refreshStaticFeedLocked(dbFile, force)
+}
+
+// refreshStaticFeedLocked は feedUpdateMutex を取得済みの呼び出し元から refreshStaticFeed を実行する
+func refreshStaticFeedLocked(dbFile string, force bool) (bool, error) {
+	config := appConfig.Get()
+	feeds := config.feeds()
+
+	state := loadFeedState()
+	state.CheckedAt = time.Now().Format(time.RFC3339)
+	newState := state.clone()
+
+	// 期限が近い場合は条件付きリクエストを使わずに内容を確認する
+	conditional := !force && !feedExpiresWithin(dbFile, feedRefreshLeadDays)
+
+	if err := prepareStagingDir(); err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(feedStagingDir())
+
+	// 変更のあったフィードのみ展開する
+	unchanged := make([]FeedConfig, 0)
+	for _, feed := range feeds {
+		prev := state.Sources[feed.ID]
+		zipPath := stagingZipPath(feed)
+
+		src, notModified, err := downloadFeedArchive(feedDownloadURL(config, feed), zipPath, prev, conditional)
+		if err != nil {
+			return false, err
+		}
+		if notModified || (!force && src.Hash == prev.Hash) {
+			log.Printf("静的フィード %q に変更はありません。", feed.ID)
+			newState.Sources[feed.ID] = src
+			os.Remove(zipPath)
+			unchanged = append(unchanged, feed)
+			continue
+		}
+
+		newState.Sources[feed.ID] = src
+		if err := stageFeedArchive(zipPath, feeds); err != nil {
+			return false, err
+		}
+	}
+
+	if len(unchanged) == len(feeds) {
+		return false, saveFeedState(newState)
+	}
+
+	// 変更のないフィードは展開済みのものを使う (なければ再取得する)
+	for _, feed := range unchanged {
+		if err := stageInstalledFeed(feed); err == nil {
+			continue
+		}
+		zipPath := stagingZipPath(feed)
+		src, _, err := downloadFeedArchive(feedDownloadURL(config, feed), zipPath, state.Sources[feed.ID], false)
+		if err != nil {
+			return false, err
+		}
+		newState.Sources[feed.ID] = src
+		if err := stageFeedArchive(zipPath, feeds); err != nil {
+			return false, err
+		}
+	}
+
+	// 初回の確認でハッシュが不明な場合、feed_versionが同じなら差し替えない
+	skipSameVersion := !force && len(state.Sources) == 0
+	return installStagedFeed(dbFile, feeds, state, newState, skipSameVersion)
+}
+
+// importStaticFeed はアップロードされたZIP、またはローカルのZIPファイル・GTFSディレクトリから
+// 静的フィードを取り込み、refreshStaticFeed と同じ手順でDBを差し替える。
+// 複数事業者の構成では feedID で取り込み先のフィードを指定する。
+func importStaticFeed(dbFile string, source string, feedID string) error {
+	if !feedUpdateMutex.TryLock() {
+		return fmt.Errorf("静的フィードの更新は既に実行中です")
+	}
+	defer feedUpdateMutex.Unlock()
+
+	return importStaticFeedLocked(dbFile, source, feedID)
+}
+
+// importStaticFeedLocked は feedUpdateMutex を取得済みの呼び出し元から importStaticFeed を実行する
+func importStaticFeedLocked(dbFile string, source string, feedID string) error {
+	feeds := appConfig.Get().feeds()
+
+	var target *FeedConfig
+	for i := range feeds {
+		if feeds[i].ID == feedID || (feedID == "" && len(feeds) == 1) {
+			target = &feeds[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("取り込み先のフィードID %q が設定にありません", feedID)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("取り込み元が見つかりません: %w", err)
+	}
+
+	if err := prepareStagingDir(); err != nil {
+		return err
+	}
+	defer os.RemoveAll(feedStagingDir())
+
+	state := loadFeedState()
+	newState := state.clone()
+	src := FeedSourceState{}
+
+	if info.IsDir() {
+		if err := copyGtfsDir(source, feedDir(filepath.Join(feedStagingDir(), "gtfs"), *target)); err != nil {
+			return fmt.Errorf("GTFSディレクトリの複製に失敗: %w", err)
+		}
+	} else {
+		zipPath := stagingZipPath(*target)
+		if err := os.MkdirAll(filepath.Dir(zipPath), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(source, zipPath); err != nil {
+			return fmt.Errorf("ZIPファイルの複製に失敗: %w", err)
+		}
+		if src.Hash, err = hashFile(zipPath); err != nil {
+			return fmt.Errorf("静的フィードのハッシュ計算に失敗: %w", err)
+		}
+		if err := stageFeedArchive(zipPath, feeds); err != nil {
+			return err
+		}
+	}
+	newState.Sources[target.ID] = src
+
+	// 他の事業者のフィードは展開済みのものを使う
+	for _, feed := range feeds {
+		if feed.ID == target.ID {
+			continue
+		}
+		if err := stageInstalledFeed(feed); err != nil {
+			return fmt.Errorf("フィード %q の展開済みファイルが使用できません: %w", feed.ID, err)
+		}
+	}
+
+	log.Printf("ローカルの静的フィードを取り込みます: %s", source)
+	_, err = installStagedFeed(dbFile, feeds, state, newState, false)
+	return err
+}
+
+// installStagedFeed は作業用ディレクトリに展開されたGTFSを検証してDBを作成し、現在のDBと差し替える
+func installStagedFeed(dbFile string, feeds []FeedConfig, state, newState FeedState, skipSameVersion bool) (bool, error) {
+	stagingGtfsDir := filepath.Join(feedStagingDir(), "gtfs")
+	for _, feed := range feeds {
+		if err := validateGtfsDir(feedDir(stagingGtfsDir, feed)); err != nil {
+			return false, fmt.Errorf("フィード %q: %w", feed.ID, err)
+		}
+	}
+
+	stagingDbFile := "staging-" + dbFile
+	stagingDbPath := databasePath(stagingDbFile)
+	os.Remove(stagingDbPath)
+	defer os.Remove(stagingDbPath)
+
+	if isMultiFeed(feeds) {
+		err := buildMultiFeedStaticDb(stagingDbFile, stagingGtfsDir, feeds)
+		if err != nil {
+			return false, fmt.Errorf("新しい静的DBの作成に失敗: %w", err)
+		}
+	} else if err := buildStaticDb(stagingDbFile, stagingGtfsDir); err != nil {
+		return false, fmt.Errorf("新しい静的DBの作成に失敗: %w", err)
+	}
+
+	newInfo, err := readFeedInfo(stagingDbFile)
+	if err != nil {
+		return false, fmt.Errorf("新しい静的DBの検証に失敗: %w", err)
+	}
+	oldInfo, _ := readFeedInfo(dbFile)
+
+	if skipSameVersion && oldInfo != nil && newInfo.FeedVersion == oldInfo.FeedVersion {
+		log.Printf("静的フィードのfeed_versionに変更はありません (%s)。", newInfo.FeedVersion)
+		newState.FeedVersion = newInfo.FeedVersion
+		return false, saveFeedState(newState)
+	}
+
+	// 差分表示用に現在のDBを残してから、DBと展開済みファイルを差し替える
+	currentDbPath := databasePath(dbFile)
+	previousDbPath := databasePath(previousStaticDbFile)
+	os.Remove(previousDbPath)
+	if err := os.Link(currentDbPath, previousDbPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("旧静的DBの保存に失敗しました: %v", err)
+	}
+	if err := os.Rename(stagingDbPath, currentDbPath); err != nil {
+		return false, fmt.Errorf("静的DBの差し替えに失敗: %w", err)
+	}
+	if err := replaceDir(stagingGtfsDir, "./static/gtfs"); err != nil {
+		log.Printf("展開済みGTFSファイルの差し替えに失敗しました: %v", err)
+	}
+	stagingZip := filepath.Join(feedStagingDir(), "gtfs.zip")
+	if _, err := os.Stat(stagingZip); err == nil {
+		if err := os.Rename(stagingZip, filepath.Join("./static", "gtfs.zip")); err != nil {
+			log.Printf("gtfs.zip の差し替えに失敗しました: %v", err)
+		}
+	}
+
+	logFeedChange(oldInfo, newInfo, state, newState)
+	if diff, err := currentFeedDiff(nil); err == nil {
+		logFeedDiff(diff)
+	}
+
+	newState.FeedVersion = newInfo.FeedVersion
+	newState.UpdatedAt = time.Now().Format(time.RFC3339)
+	return true, saveFeedState(newState)
+}
+
+// replaceDir は dest を src で置き換える
+func replaceDir(src, dest string) error {
+	old := dest + ".old"
+	os.RemoveAll(old)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dest); err == nil {
+		if err := os.Rename(dest, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(src, dest); err != nil {
+		// 失敗した場合は元に戻す
+		os.Rename(old, dest)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// logFeedChange は静的フィードの差し替え内容をログに出力する
+func logFeedChange(oldInfo, newInfo *FeedInfo, oldState, newState FeedState) {
+	if oldInfo == nil {
+		oldInfo = &FeedInfo{}
+	}
+
+	log.Println("静的フィードを更新しました。")
+	log.Printf("  feed_version: %q -> %q", oldInfo.FeedVersion, newInfo.FeedVersion)
+	log.Printf("  有効期間: %s-%s -> %s-%s", oldInfo.FeedStartDate, oldInfo.FeedEndDate, newInfo.FeedStartDate, newInfo.FeedEndDate)
+
+	for id, newSrc := range newState.Sources {
+		oldSrc := oldState.Sources[id]
+		label := ""
+		if id != "" {
+			label = "[" + id + "] "
+		}
+		if oldSrc.ETag != newSrc.ETag {
+			log.Printf("  %sETag: %q -> %q", label, oldSrc.ETag, newSrc.ETag)
+		}
+		if oldSrc.LastModified != newSrc.LastModified {
+			log.Printf("  %sLast-Modified: %q -> %q", label, oldSrc.LastModified, newSrc.LastModified)
+		}
+		if oldSrc.Hash != newSrc.Hash {
+			log.Printf("  %sSHA-256: %s -> %s", label, oldSrc.Hash, newSrc.Hash)
+		}
+	}
+}